@@ -0,0 +1,86 @@
+package cryto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+)
+
+// cidPrefix is the multihash header of a sha2-256 digest,
+// the function code 0x12 followed by the digest length 0x20
+const cidPrefix = "1220"
+
+var ErrDigestMismatch = errors.New("content does not match its identifier")
+
+// CIDHasher computes the content identifier of the bytes written to it
+type CIDHasher struct {
+	h hash.Hash
+}
+
+func NewCIDHasher() *CIDHasher {
+	return &CIDHasher{h: sha256.New()}
+}
+
+func (c *CIDHasher) Write(p []byte) (int, error) {
+	return c.h.Write(p)
+}
+
+// CID returns the multihash of the bytes written so far in hex
+func (c *CIDHasher) CID() string {
+	return cidPrefix + hex.EncodeToString(c.h.Sum(nil))
+}
+
+// CID returns the content identifier of everything read from r
+func CID(r io.Reader) (string, error) {
+	h := NewCIDHasher()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return h.CID(), nil
+}
+
+// IsCID reports if s has the form of a content identifier
+func IsCID(s string) bool {
+	if len(s) != len(cidPrefix)+2*sha256.Size || !strings.HasPrefix(s, cidPrefix) {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// VerifyCID checks that the content read from r matches cid
+func VerifyCID(cid string, r io.Reader) error {
+	got, err := CID(r)
+	if err != nil {
+		return err
+	}
+	if got != cid {
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+type verifyingReader struct {
+	cid string
+	r   io.Reader
+	h   *CIDHasher
+}
+
+// NewVerifyingReader returns a reader of r that fails with
+// ErrDigestMismatch instead of io.EOF when the content
+// read does not match cid.
+func NewVerifyingReader(cid string, r io.Reader) io.Reader {
+	return &verifyingReader{cid: cid, r: r, h: NewCIDHasher()}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && v.h.CID() != v.cid {
+		return n, ErrDigestMismatch
+	}
+	return n, err
+}
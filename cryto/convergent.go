@@ -0,0 +1,63 @@
+package cryto
+
+import (
+	"crypto/aes"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// Convergent encryption derives the key from the content itself, so
+// the same plaintext always produces the same ciphertext no matter
+// which node encrypts it, which lets identical objects be stored once.
+//
+// The trade-off is privacy: anyone who already has (or can guess) the
+// plaintext can compute the key and confirm that the object is stored,
+// and low entropy content (e.g. a template with a PIN in it) can be
+// brute forced. Only use it for data where that is acceptable, and
+// keep the content keys wrapped with WrapKey per owner.
+
+var ErrInvalidWrappedKey = errors.New("invalid wrapped key")
+
+// ConvergentKey returns the 32 bytes content key of the data in r.
+func ConvergentKey(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte("convergent-key"))
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// CopyEncryptConvergent works like CopyEncrypt but the IV is derived
+// from the content key instead of being random, the key must come
+// from ConvergentKey. The output can be decrypted with CopyDecrypt.
+func CopyEncryptConvergent(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	return copyEncryptIV(block, convergentIV(key, block.BlockSize()), src, dst)
+}
+
+// WrapKey encrypts the content key with the owner's key
+// so that only the owner can use it.
+func WrapKey(ownerKey, contentKey []byte) ([]byte, error) {
+	return Encrypt(ownerKey, contentKey)
+}
+
+// UnwrapKey reverses WrapKey
+func UnwrapKey(ownerKey, wrapped []byte) ([]byte, error) {
+	key, err := Decrypt(ownerKey, wrapped)
+	if err != nil {
+		return nil, ErrInvalidWrappedKey
+	}
+	return key, nil
+}
+
+func convergentIV(key []byte, size int) []byte {
+	h := sha256.New()
+	h.Write([]byte("convergent-iv"))
+	h.Write(key)
+	return h.Sum(nil)[:size]
+}
@@ -6,9 +6,13 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 )
 
+var ErrDecrypt = errors.New("message authentication failed")
+
 func Hash(key string) string {
 	hash := sha256.Sum256([]byte(key))
 	return hex.EncodeToString(hash[:])
@@ -75,6 +79,10 @@ func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 		return 0, err
 	}
+	return copyEncryptIV(block, iv, src, dst)
+}
+
+func copyEncryptIV(block cipher.Block, iv []byte, src io.Reader, dst io.Writer) (int, error) {
 	rn, err := dst.Write(iv)
 	if err != nil {
 		return 0, err
@@ -82,3 +90,68 @@ func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	stream := cipher.NewCTR(block, iv)
 	return writeStream(rn, stream, src, dst)
 }
+
+// Encrypt seals a small plaintext such as a key name with
+// AES-GCM, the random nonce is put in front of the output.
+func Encrypt(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt reverses Encrypt
+func Decrypt(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewDecryptReader decrypts r, the part of a CopyEncrypt output
+// that starts offset bytes after the IV. AES-CTR lets any offset
+// be decrypted without the bytes before it.
+func NewDecryptReader(key, iv []byte, offset int64, r io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, fmt.Errorf("invalid IV size %v", len(iv))
+	}
+	// move the counter to the block holding offset
+	counter := make([]byte, len(iv))
+	copy(counter, iv)
+	blocks := uint64(offset / int64(block.BlockSize()))
+	for i := len(counter) - 1; i >= 0 && blocks > 0; i-- {
+		sum := uint64(counter[i]) + blocks&0xff
+		counter[i] = byte(sum)
+		blocks = blocks>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(block, counter)
+	skip := make([]byte, offset%int64(block.BlockSize()))
+	stream.XORKeyStream(skip, skip)
+	return &cipher.StreamReader{S: stream, R: r}, nil
+}
@@ -2,6 +2,10 @@ package cryto
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -28,4 +32,185 @@ func TestCopyEncrypt(t *testing.T) {
 	if res.String() != data {
 		t.Fatalf("decryption failed expected (%v) got (%v)", data, res.String())
 	}
+
+	// a header asking for too many iterations is refused before deriving
+	header := new(bytes.Buffer)
+	PassphraseHeader{Iterations: MaxIterations + 1, Salt: make([]byte, saltSize), Check: make([]byte, checkSize)}.WriteTo(header)
+	_, err = DecryptWithPassphrase("passphrase", header, new(bytes.Buffer))
+	if !errors.Is(err, ErrInvalidHeader) {
+		t.Fatalf("expected (%v) got (%v)", ErrInvalidHeader, err)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 test vector from RFC 7914 section 11
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if hex.EncodeToString(key) != expected {
+		t.Fatalf("invalid derived key expected (%v) got (%x)", expected, key)
+	}
+	// DeriveKey is the first 32 bytes of the same derivation
+	key = DeriveKey("passwd", []byte("salt"), 1)
+	if hex.EncodeToString(key) != expected[:64] {
+		t.Fatalf("invalid derived key expected (%v) got (%x)", expected[:64], key)
+	}
+}
+
+func TestEncryptWithPassphrase(t *testing.T) {
+	data := "secret data"
+	dst := new(bytes.Buffer)
+	if _, err := EncryptWithPassphrase("passphrase", strings.NewReader(data), dst); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := dst.Bytes()
+	if bytes.Contains(encrypted, []byte(data)) {
+		t.Fatal("plaintext found in encrypted output")
+	}
+
+	_, err := DecryptWithPassphrase("wrong", bytes.NewReader(encrypted), new(bytes.Buffer))
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected (%v) got (%v)", ErrWrongPassphrase, err)
+	}
+
+	res := new(bytes.Buffer)
+	if _, err := DecryptWithPassphrase("passphrase", bytes.NewReader(encrypted), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.String() != data {
+		t.Fatalf("decryption failed expected (%v) got (%v)", data, res.String())
+	}
+}
+
+func TestCopyEncryptConvergent(t *testing.T) {
+	data := "same content"
+	key, err := ConvergentKey(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := new(bytes.Buffer), new(bytes.Buffer)
+	if _, err := CopyEncryptConvergent(key, strings.NewReader(data), first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CopyEncryptConvergent(key, strings.NewReader(data), second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatal("convergent encryption should be deterministic")
+	}
+
+	ownerKey := New()
+	wrapped, err := WrapKey(ownerKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnwrapKey(New(), wrapped); !errors.Is(err, ErrInvalidWrappedKey) {
+		t.Fatalf("expected (%v) got (%v)", ErrInvalidWrappedKey, err)
+	}
+	unwrapped, err := UnwrapKey(ownerKey, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := new(bytes.Buffer)
+	if _, err := CopyDecrypt(unwrapped, first, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.String() != data {
+		t.Fatalf("decryption failed expected (%v) got (%v)", data, res.String())
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := New()
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subset := range [][][]byte{shares[:3], shares[2:], {shares[4], shares[0], shares[2]}, shares} {
+		res, err := Combine(subset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(secret, res) {
+			t.Fatalf("combine failed expected (%x) got (%x)", secret, res)
+		}
+	}
+	res, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(secret, res) {
+		t.Fatal("secret should not be recovered below the threshold")
+	}
+	if _, err := Split(secret, 2, 3); !errors.Is(err, ErrInvalidThreshold) {
+		t.Fatalf("expected (%v) got (%v)", ErrInvalidThreshold, err)
+	}
+}
+
+func TestSealTo(t *testing.T) {
+	priv, err := ExchangeKey(New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := SealTo(priv.PublicKey().Bytes(), []byte("share"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := ExchangeKey(New())
+	if _, err := OpenSealed(other, sealed); !errors.Is(err, ErrInvalidSealed) {
+		t.Fatalf("expected (%v) got (%v)", ErrInvalidSealed, err)
+	}
+	res, err := OpenSealed(priv, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != "share" {
+		t.Fatalf("open failed expected (share) got (%v)", string(res))
+	}
+}
+
+func TestNewDecryptReader(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	key := New()
+	encrypted := new(bytes.Buffer)
+	if _, err := CopyEncrypt(key, bytes.NewReader(data), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	iv, ciphertext := encrypted.Bytes()[:16], encrypted.Bytes()[16:]
+	for _, offset := range []int64{0, 5, 16, 4099, 9990} {
+		r, err := NewDecryptReader(key, iv, offset, bytes.NewReader(ciphertext[offset:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make([]byte, 10)
+		if _, err := io.ReadFull(r, res); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[offset:offset+10], res) {
+			t.Fatalf("decryption at %v failed expected (%s) got (%s)", offset, data[offset:offset+10], res)
+		}
+	}
+}
+
+func TestCID(t *testing.T) {
+	cid, err := CID(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid != "12202cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected cid %v", cid)
+	}
+	if !IsCID(cid) || IsCID("key") || IsCID(cid[4:]) {
+		t.Fatal("IsCID failed")
+	}
+	if err := VerifyCID(cid, strings.NewReader("hellO")); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected %v got %v", ErrDigestMismatch, err)
+	}
+	if _, err := io.ReadAll(NewVerifyingReader(cid, strings.NewReader("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(NewVerifyingReader(cid, strings.NewReader("hellO"))); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected %v got %v", ErrDigestMismatch, err)
+	}
 }
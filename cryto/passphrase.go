@@ -0,0 +1,161 @@
+package cryto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// DefaultIterations is the PBKDF2 iteration count used
+	// by EncryptWithPassphrase
+	DefaultIterations = 600000
+	// MaxIterations bounds the iteration count read from a header,
+	// a crafted one could make the key derivation run for hours
+	MaxIterations   = 10 * DefaultIterations
+	saltSize        = 16
+	checkSize       = 8
+	headerVersion   = byte(1)
+	kdfPBKDF2SHA256 = byte(1)
+)
+
+var (
+	headerMagic = []byte("DSPE")
+
+	ErrInvalidHeader   = errors.New("invalid passphrase header")
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+)
+
+// PassphraseHeader is written in front of every object encrypted
+// with a passphrase, it holds everything needed to derive the
+// key again except the passphrase itself.
+type PassphraseHeader struct {
+	Iterations int
+	Salt       []byte
+	// Check is used to detect a wrong passphrase before decrypting
+	Check []byte
+}
+
+// DeriveKey derives a 32 bytes AES key from the passphrase
+// with PBKDF2-HMAC-SHA256.
+func DeriveKey(passphrase string, salt []byte, iterations int) []byte {
+	return pbkdf2([]byte(passphrase), salt, iterations, 32)
+}
+
+// EncryptWithPassphrase writes a PassphraseHeader followed by the
+// encrypted content of src to dst. It returns the total bytes written.
+func EncryptWithPassphrase(passphrase string, src io.Reader, dst io.Writer) (int, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return 0, err
+	}
+	key := DeriveKey(passphrase, salt, DefaultIterations)
+	header := PassphraseHeader{
+		Iterations: DefaultIterations,
+		Salt:       salt,
+		Check:      keyCheck(key),
+	}
+	hn, err := header.WriteTo(dst)
+	if err != nil {
+		return int(hn), err
+	}
+	n, err := CopyEncrypt(key, src, dst)
+	return int(hn) + n, err
+}
+
+// DecryptWithPassphrase reads the PassphraseHeader from src, derives
+// the key and writes the decrypted content to dst.
+func DecryptWithPassphrase(passphrase string, src io.Reader, dst io.Writer) (int, error) {
+	header, err := ReadPassphraseHeader(src)
+	if err != nil {
+		return 0, err
+	}
+	key := DeriveKey(passphrase, header.Salt, header.Iterations)
+	if !hmac.Equal(keyCheck(key), header.Check) {
+		return 0, ErrWrongPassphrase
+	}
+	return CopyDecrypt(key, src, dst)
+}
+
+// WriteTo encodes the header as
+// magic | version | kdf | iterations | salt length | salt | check
+func (h PassphraseHeader) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, len(headerMagic)+7+len(h.Salt)+checkSize)
+	buf = append(buf, headerMagic...)
+	buf = append(buf, headerVersion, kdfPBKDF2SHA256)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(h.Iterations))
+	buf = append(buf, byte(len(h.Salt)))
+	buf = append(buf, h.Salt...)
+	buf = append(buf, h.Check...)
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadPassphraseHeader reads a header written by PassphraseHeader.WriteTo
+func ReadPassphraseHeader(r io.Reader) (PassphraseHeader, error) {
+	fixed := make([]byte, len(headerMagic)+7)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return PassphraseHeader{}, err
+	}
+	if string(fixed[:len(headerMagic)]) != string(headerMagic) {
+		return PassphraseHeader{}, ErrInvalidHeader
+	}
+	fixed = fixed[len(headerMagic):]
+	if fixed[0] != headerVersion || fixed[1] != kdfPBKDF2SHA256 {
+		return PassphraseHeader{}, fmt.Errorf("%w: unsupported version (%v) or kdf (%v)", ErrInvalidHeader, fixed[0], fixed[1])
+	}
+	iterations := binary.BigEndian.Uint32(fixed[2:6])
+	if iterations == 0 {
+		return PassphraseHeader{}, ErrInvalidHeader
+	}
+	if iterations > MaxIterations {
+		return PassphraseHeader{}, fmt.Errorf("%w: %v iterations, at most %v", ErrInvalidHeader, iterations, MaxIterations)
+	}
+	rest := make([]byte, int(fixed[6])+checkSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return PassphraseHeader{}, err
+	}
+	return PassphraseHeader{
+		Iterations: int(iterations),
+		Salt:       rest[:fixed[6]],
+		Check:      rest[fixed[6]:],
+	}, nil
+}
+
+func keyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("passphrase-check"))
+	return mac.Sum(nil)[:checkSize]
+}
+
+// pbkdf2 implements RFC 8018 with HMAC-SHA256 as the PRF
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, uint32(block)))
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for i := 2; i <= iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
@@ -0,0 +1,85 @@
+package cryto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+var ErrInvalidSealed = errors.New("invalid sealed message")
+
+// ExchangeKey derives the X25519 key of a node from the seed of its
+// ed25519 signing key, so one seed holds the whole node identity.
+func ExchangeKey(seed []byte) (*ecdh.PrivateKey, error) {
+	h := sha256.New()
+	h.Write([]byte("x25519"))
+	h.Write(seed)
+	return ecdh.X25519().NewPrivateKey(h.Sum(nil))
+}
+
+// SealTo encrypts plaintext so that only the owner of the X25519
+// public key pub can open it with OpenSealed. The output is the
+// ephemeral public key followed by the AES-GCM nonce and ciphertext.
+func SealTo(pub, plaintext []byte) ([]byte, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(sealKey(shared, ephemeral.PublicKey().Bytes(), pub))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append(ephemeral.PublicKey().Bytes(), nonce...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// OpenSealed reverses SealTo
+func OpenSealed(priv *ecdh.PrivateKey, sealed []byte) ([]byte, error) {
+	keySize := len(priv.PublicKey().Bytes())
+	if len(sealed) < keySize {
+		return nil, ErrInvalidSealed
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[:keySize])
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	shared, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	gcm, err := newGCM(sealKey(shared, sealed[:keySize], priv.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[keySize:]
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrInvalidSealed
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	return plaintext, nil
+}
+
+func sealKey(shared, ephemeral, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
@@ -0,0 +1,122 @@
+package cryto
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+var (
+	ErrInvalidShares    = errors.New("invalid shares")
+	ErrInvalidThreshold = errors.New("threshold must be between 2 and the number of shares")
+)
+
+// Split splits secret into n shares with Shamir secret sharing
+// over GF(256), any k of them are needed to rebuild it with Combine.
+// Each share is the x coordinate followed by one byte per secret byte.
+func Split(secret []byte, n, k int) ([][]byte, error) {
+	if k < 2 || k > n || n > 255 {
+		return nil, ErrInvalidThreshold
+	}
+	if len(secret) == 0 {
+		return nil, ErrInvalidShares
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coeffs := make([]byte, k)
+	for b, secretByte := range secret {
+		if _, err := io.ReadFull(rand.Reader, coeffs[1:]); err != nil {
+			return nil, err
+		}
+		coeffs[0] = secretByte
+		for _, share := range shares {
+			share[b+1] = evalPolynomial(coeffs, share[0])
+		}
+	}
+	return shares, nil
+}
+
+// Combine rebuilds the secret from at least k shares made by Split,
+// with fewer shares it returns a wrong secret without error.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrInvalidShares
+	}
+	size := len(shares[0])
+	seen := map[byte]bool{}
+	for _, share := range shares {
+		if len(share) != size || size < 2 || share[0] == 0 || seen[share[0]] {
+			return nil, ErrInvalidShares
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, size-1)
+	for b := range secret {
+		// lagrange interpolation at x = 0
+		var value byte
+		for i, si := range shares {
+			basis := byte(1)
+			for j, sj := range shares {
+				if i == j {
+					continue
+				}
+				basis = gfMul(basis, gfDiv(sj[0], sj[0]^si[0]))
+			}
+			value ^= gfMul(si[b+1], basis)
+		}
+		secret[b] = value
+	}
+	return secret, nil
+}
+
+func evalPolynomial(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+var gfExp, gfLog = gfTables()
+
+// gfTables builds the exp and log tables of GF(256)
+// with the AES polynomial x^8 + x^4 + x^3 + x + 1
+func gfTables() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var log [256]byte
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		log[x] = byte(i)
+		// multiply by the generator 3
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
@@ -0,0 +1,193 @@
+// Package erasure implements systematic Reed-Solomon erasure coding
+// over GF(256): data is split in k data shards and m parity shards
+// are computed so that any k of the k+m shards rebuild the data.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrInvalidShardCount = errors.New("erasure: invalid number of shards")
+	ErrShardSize         = errors.New("erasure: shards of different sizes")
+	ErrTooFewShards      = errors.New("erasure: too few shards to reconstruct")
+)
+
+type Encoder struct {
+	dataShards   int
+	parityShards int
+	// encoding is the (k+m) x k matrix whose top k rows are the identity
+	encoding matrix
+}
+
+// New returns an Encoder of dataShards data shards and parityShards
+// parity shards, at most 256 in total.
+func New(dataShards, parityShards int) (*Encoder, error) {
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > 256 {
+		return nil, ErrInvalidShardCount
+	}
+	total := dataShards + parityShards
+	v := vandermonde(total, dataShards)
+	top, err := v[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		encoding:     v.mul(top),
+	}, nil
+}
+
+func (e *Encoder) DataShards() int   { return e.dataShards }
+func (e *Encoder) ParityShards() int { return e.parityShards }
+func (e *Encoder) TotalShards() int  { return e.dataShards + e.parityShards }
+
+// Split cuts data in data shards of equal size, the last one padded
+// with zeros, followed by empty parity shards to fill with Encode.
+func (e *Encoder) Split(data []byte) [][]byte {
+	size := (len(data) + e.dataShards - 1) / e.dataShards
+	size = max(size, 1)
+	shards := make([][]byte, e.TotalShards())
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < e.dataShards && i*size < len(data) {
+			copy(shards[i], data[i*size:])
+		}
+	}
+	return shards
+}
+
+// Encode computes the parity shards from the data shards
+func (e *Encoder) Encode(shards [][]byte) error {
+	size, err := e.checkShards(shards, false)
+	if err != nil {
+		return err
+	}
+	for p := e.dataShards; p < len(shards); p++ {
+		clear(shards[p][:size])
+		for d := 0; d < e.dataShards; d++ {
+			mulAdd(e.encoding[p][d], shards[d], shards[p])
+		}
+	}
+	return nil
+}
+
+// Verify reports if the parity shards match the data shards
+func (e *Encoder) Verify(shards [][]byte) (bool, error) {
+	size, err := e.checkShards(shards, false)
+	if err != nil {
+		return false, err
+	}
+	parity := make([]byte, size)
+	for p := e.dataShards; p < len(shards); p++ {
+		clear(parity)
+		for d := 0; d < e.dataShards; d++ {
+			mulAdd(e.encoding[p][d], shards[d], parity)
+		}
+		if string(parity) != string(shards[p]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Reconstruct rebuilds the missing shards, the nil or empty entries of
+// shards, from at least DataShards present ones.
+func (e *Encoder) Reconstruct(shards [][]byte) error {
+	size, err := e.checkShards(shards, true)
+	if err != nil {
+		return err
+	}
+	present := []int{}
+	for i, s := range shards {
+		if len(s) > 0 {
+			present = append(present, i)
+		}
+	}
+	if len(present) < e.dataShards {
+		return ErrTooFewShards
+	}
+	if len(present) == len(shards) {
+		return nil
+	}
+
+	// the rows of the encoding matrix of k present shards map the data
+	// to them, its inverse maps them back to the data
+	present = present[:e.dataShards]
+	sub := newMatrix(e.dataShards, e.dataShards)
+	for r, i := range present {
+		copy(sub[r], e.encoding[i])
+	}
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	for d := 0; d < e.dataShards; d++ {
+		if len(shards[d]) > 0 {
+			continue
+		}
+		shards[d] = make([]byte, size)
+		for r, i := range present {
+			mulAdd(decode[d][r], shards[i], shards[d])
+		}
+	}
+	for p := e.dataShards; p < len(shards); p++ {
+		if len(shards[p]) > 0 {
+			continue
+		}
+		shards[p] = make([]byte, size)
+		for d := 0; d < e.dataShards; d++ {
+			mulAdd(e.encoding[p][d], shards[d], shards[p])
+		}
+	}
+	return nil
+}
+
+// Join writes the first size bytes of the data shards to w
+func (e *Encoder) Join(w io.Writer, shards [][]byte, size int64) error {
+	if len(shards) < e.dataShards {
+		return ErrTooFewShards
+	}
+	for _, s := range shards[:e.dataShards] {
+		if len(s) == 0 {
+			return ErrTooFewShards
+		}
+		n := min(int64(len(s)), size)
+		if _, err := w.Write(s[:n]); err != nil {
+			return err
+		}
+		size -= n
+	}
+	if size > 0 {
+		return fmt.Errorf("%w: shards hold %v bytes less than the size", ErrShardSize, size)
+	}
+	return nil
+}
+
+func (e *Encoder) checkShards(shards [][]byte, allowMissing bool) (int, error) {
+	if len(shards) != e.TotalShards() {
+		return 0, ErrInvalidShardCount
+	}
+	size := 0
+	for _, s := range shards {
+		if len(s) == 0 {
+			if !allowMissing {
+				return 0, ErrShardSize
+			}
+			continue
+		}
+		if size == 0 {
+			size = len(s)
+		}
+		if len(s) != size {
+			return 0, ErrShardSize
+		}
+	}
+	if size == 0 {
+		return 0, ErrTooFewShards
+	}
+	return size, nil
+}
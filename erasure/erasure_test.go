@@ -0,0 +1,68 @@
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReconstruct(t *testing.T) {
+	data := bytes.Repeat([]byte("erasure coded data "), 1000)
+	enc, err := New(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := enc.Split(data)
+	if err := enc.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := enc.Verify(shards); !ok || err != nil {
+		t.Fatalf("verify failed %v", err)
+	}
+
+	// any 2 lost shards are rebuilt
+	for a := 0; a < 6; a++ {
+		for b := a + 1; b < 6; b++ {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			damaged[a], damaged[b] = nil, nil
+			if err := enc.Reconstruct(damaged); err != nil {
+				t.Fatal(err)
+			}
+			for i := range shards {
+				if !bytes.Equal(shards[i], damaged[i]) {
+					t.Fatalf("shard %v rebuilt wrong without %v and %v", i, a, b)
+				}
+			}
+			res := new(bytes.Buffer)
+			if err := enc.Join(res, damaged, int64(len(data))); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, res.Bytes()) {
+				t.Fatal("join failed")
+			}
+		}
+	}
+
+	shards[0], shards[1], shards[5] = nil, nil, nil
+	if err := enc.Reconstruct(shards); !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("expected %v got %v", ErrTooFewShards, err)
+	}
+}
+
+func TestMatrixInvert(t *testing.T) {
+	m := vandermonde(5, 5)
+	inv, err := m.invert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := m.mul(inv)
+	for r := range id {
+		if !bytes.Equal(id[r], identity(5)[r]) {
+			t.Fatalf("m * inv(m) is not the identity: %v", id)
+		}
+	}
+	if _, err := (matrix{{1, 2}, {1, 2}}).invert(); !errors.Is(err, errSingular) {
+		t.Fatalf("expected %v got %v", errSingular, err)
+	}
+}
@@ -0,0 +1,64 @@
+package erasure
+
+// GF(256) with the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d)
+// and the generator 2, the field used by most Reed-Solomon codes.
+
+var expTable, logTable = galoisTables()
+
+func galoisTables() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(exp); i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}
+
+func galMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func galDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	if b == 0 {
+		panic("erasure: division by zero")
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+func galExp(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// mulAdd adds c * in to out
+func mulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(logTable[c])
+	for i, v := range in {
+		if v != 0 {
+			out[i] ^= expTable[logC+int(logTable[v])]
+		}
+	}
+}
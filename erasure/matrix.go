@@ -0,0 +1,88 @@
+package erasure
+
+import "errors"
+
+var errSingular = errors.New("erasure: singular matrix")
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func identity(n int) matrix {
+	m := newMatrix(n, n)
+	for i := range m {
+		m[i][i] = 1
+	}
+	return m
+}
+
+// vandermonde returns the rows x cols matrix m[r][c] = r^c, any
+// cols rows of it are linearly independent
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = galExp(byte(r), c)
+		}
+	}
+	return m
+}
+
+func (m matrix) mul(o matrix) matrix {
+	res := newMatrix(len(m), len(o[0]))
+	for r := range res {
+		for c := range res[r] {
+			var v byte
+			for i := range o {
+				v ^= galMul(m[r][i], o[i][c])
+			}
+			res[r][c] = v
+		}
+	}
+	return res
+}
+
+// invert returns the inverse of the square matrix m
+// with Gauss-Jordan elimination
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errSingular
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		if v := work[c][c]; v != 1 {
+			for i := range work[c] {
+				work[c][i] = galDiv(work[c][i], v)
+			}
+		}
+		for r := range work {
+			if r != c && work[r][c] != 0 {
+				f := work[r][c]
+				for i := range work[r] {
+					work[r][i] ^= galMul(f, work[c][i])
+				}
+			}
+		}
+	}
+	inv := newMatrix(n, n)
+	for r := range inv {
+		copy(inv[r], work[r][n:])
+	}
+	return inv, nil
+}
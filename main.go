@@ -52,7 +52,11 @@ func CreateServer(listenAddr, root string, outboundServer []string) *server.Serv
 		OutboundServer:    outboundServer,
 		TransformPathFunc: store.SHA1PathTransformFunc,
 	}
-	s1 := server.New(serverOpts)
+	s1, err := server.New(serverOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
 	transport.OnPeer = s1.OnPeer
+	transport.OnPeerClose = s1.OnPeerClose
 	return s1
 }
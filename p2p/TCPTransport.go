@@ -6,25 +6,43 @@ import (
 	"io"
 	"log"
 	"net"
-	"sync"
+	"time"
 )
 
 type TCPPeer struct {
 	net.Conn
 	inbound bool
-	wg      *sync.WaitGroup
+	// streaming is signaled when the transport hands over an
+	// incoming stream and done when the stream was read
+	streaming chan struct{}
+	done      chan struct{}
 }
 
 func NewTCPPeer(conn net.Conn, inbound bool) *TCPPeer {
 	return &TCPPeer{
-		Conn:    conn,
-		inbound: inbound,
-		wg:      &sync.WaitGroup{},
+		Conn:      conn,
+		inbound:   inbound,
+		streaming: make(chan struct{}, 1),
+		done:      make(chan struct{}, 1),
+	}
+}
+
+func (t *TCPPeer) Stream() {
+	<-t.streaming
+}
+
+func (t *TCPPeer) WaitStream(timeout time.Duration) error {
+	select {
+	case <-t.streaming:
+		return nil
+	case <-time.After(timeout):
+		t.Conn.Close()
+		return ErrStreamTimeout
 	}
 }
 
 func (t *TCPPeer) Done() {
-	t.wg.Done()
+	t.done <- struct{}{}
 }
 
 type TCPTransportOpts struct {
@@ -32,6 +50,9 @@ type TCPTransportOpts struct {
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// OnPeerClose is called once the connection of a peer
+	// accepted by OnPeer is closed
+	OnPeerClose func(Peer)
 }
 
 type TCPTransport struct {
@@ -109,6 +130,9 @@ func (t *TCPTransport) handleConnection(conn net.Conn, inbound bool) {
 			return
 		}
 	}
+	if t.OnPeerClose != nil {
+		defer t.OnPeerClose(peer)
+	}
 	fmt.Printf("%v had established connection from %v\n", conn.LocalAddr().String(), conn.RemoteAddr().String())
 	for {
 		rpc := RPC{}
@@ -121,9 +145,9 @@ func (t *TCPTransport) handleConnection(conn net.Conn, inbound bool) {
 			continue
 		}
 		if rpc.Stream {
-			peer.wg.Add(1)
 			fmt.Println("streaming from:", peer.RemoteAddr().String())
-			peer.wg.Wait()
+			peer.streaming <- struct{}{}
+			<-peer.done
 			fmt.Println("stream completed from:", peer.RemoteAddr().String())
 			continue
 		}
@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -15,3 +16,19 @@ func TestTCPTransport(t *testing.T) {
 	assert.Equal(t, tcp.ListenAddr, ":8080")
 	assert.Nil(t, tcp.ListenAndAccept())
 }
+
+func TestDefaultDecoder(t *testing.T) {
+	payload := bytes.Repeat([]byte("message"), 1000)
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteMessage(buf, payload))
+	buf.Write([]byte{IncomingStream})
+
+	rpc := RPC{}
+	assert.Nil(t, DefaultDecoder{}.Decode(buf, &rpc))
+	assert.Equal(t, payload, rpc.Payload)
+	assert.False(t, rpc.Stream)
+
+	rpc = RPC{}
+	assert.Nil(t, DefaultDecoder{}.Decode(buf, &rpc))
+	assert.True(t, rpc.Stream)
+}
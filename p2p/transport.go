@@ -1,14 +1,24 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"io"
 	"net"
+	"time"
 )
 
 // Peer is a remote node in the connections
 type Peer interface {
 	net.Conn
+	// Stream blocks until the transport has read the start of an
+	// incoming stream, the stream is then read from the peer
+	Stream()
+	// WaitStream works like Stream but gives up after timeout with
+	// ErrStreamTimeout, the connection is then closed since the
+	// stream may still come and be taken for another one
+	WaitStream(timeout time.Duration) error
 	// Done is called when the receiving peer has
 	// finished processing a stream
 	Done()
@@ -28,6 +38,28 @@ var (
 	IncomingStream  = byte(2)
 )
 
+// MaxMessageSize is the largest message payload accepted by DefaultDecoder
+const MaxMessageSize = 1 << 20
+
+var (
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrStreamTimeout   = errors.New("stream timed out")
+)
+
+// WriteMessage writes payload to w in the format read by DefaultDecoder,
+// IncomingMessage followed by the payload length and the payload.
+func WriteMessage(w io.Writer, payload []byte) error {
+	if len(payload) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	buf := make([]byte, 0, 5+len(payload))
+	buf = append(buf, IncomingMessage)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
 // RPC is the data passed between Peers
 type RPC struct {
 	Payload []byte
@@ -56,7 +88,8 @@ type DefaultDecoder struct{}
 
 // Decode implements the Decoder interface, it
 // checks the first byte of r if it is
-// IncomingMessage or IncomingStream
+// IncomingMessage or IncomingStream. A message
+// is followed by its length, see WriteMessage.
 func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
 	peekBuf := make([]byte, 1)
 	if _, err := r.Read(peekBuf); err != nil {
@@ -68,11 +101,17 @@ func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
 		return nil
 	}
 
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
-	rpc.Payload = buf[:n]
+	rpc.Payload = buf
 	return nil
 }
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+)
+
+const (
+	// MaxClockSkew is how far the timestamp of a message can be
+	// from the local clock before the message is rejected
+	MaxClockSkew = 2 * time.Minute
+	nonceSize    = 16
+)
+
+// keyringName is the file keeping the keys of the nodes seen by
+// the server, next to the index of the store
+const keyringName = "keyring.json"
+
+const (
+	ActionWrite  = "write"
+	ActionDelete = "delete"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrReplayedMessage  = errors.New("replayed message")
+	ErrStaleMessage     = errors.New("message timestamp out of range")
+	ErrUnknownSender    = errors.New("public key does not match sender")
+	ErrNotAuthorized    = errors.New("not authorized")
+)
+
+// Envelope is what is actually sent across the connections, it
+// carries the encoded Message signed with the sender's node key.
+type Envelope struct {
+	Body      []byte
+	From      string
+	PublicKey []byte
+	// ExchangeKey is the X25519 key used to seal data to the sender
+	ExchangeKey []byte
+	Timestamp   int64
+	Nonce       []byte
+	Signature   []byte
+}
+
+func (e *Envelope) digest() []byte {
+	h := sha256.New()
+	for _, field := range [][]byte{e.Body, []byte(e.From), e.PublicKey, e.ExchangeKey, e.Nonce} {
+		binary.Write(h, binary.LittleEndian, uint32(len(field)))
+		h.Write(field)
+	}
+	binary.Write(h, binary.LittleEndian, e.Timestamp)
+	return h.Sum(nil)
+}
+
+// Capability lets the Owner delegate an action on its objects to the
+// Grantee. An empty Key covers every key of the owner.
+type Capability struct {
+	Owner     string
+	Grantee   string
+	Action    string
+	Key       string
+	Expires   int64
+	PublicKey []byte
+	Signature []byte
+}
+
+func (c *Capability) digest() []byte {
+	h := sha256.New()
+	for _, field := range []string{c.Owner, c.Grantee, c.Action, c.Key} {
+		binary.Write(h, binary.LittleEndian, uint32(len(field)))
+		h.Write([]byte(field))
+	}
+	binary.Write(h, binary.LittleEndian, c.Expires)
+	h.Write(c.PublicKey)
+	return h.Sum(nil)
+}
+
+// Delegate signs a Capability allowing grantee to perform action on
+// key, the key is hashed the same way as in the peer messages.
+func (s *Server) Delegate(grantee, action, key string, ttl time.Duration) Capability {
+	c := Capability{
+		Owner:     s.id,
+		Grantee:   grantee,
+		Action:    action,
+		Expires:   time.Now().Add(ttl).UnixNano(),
+		PublicKey: s.PublicKey(),
+	}
+	if len(key) > 0 {
+		c.Key = cryto.Hash(key)
+	}
+	c.Signature = ed25519.Sign(s.privateKey, c.digest())
+	return c
+}
+
+// PublicKey returns the node key used to sign the messages
+func (s *Server) PublicKey() ed25519.PublicKey {
+	return s.privateKey.Public().(ed25519.PublicKey)
+}
+
+// seal encodes and signs m
+func (s *Server) seal(m *Message) ([]byte, error) {
+	body := new(bytes.Buffer)
+	if err := gob.NewEncoder(body).Encode(m); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	env := Envelope{
+		Body:        body.Bytes(),
+		From:        s.id,
+		PublicKey:   s.PublicKey(),
+		ExchangeKey: s.exchangeKey.PublicKey().Bytes(),
+		Timestamp:   time.Now().UnixNano(),
+		Nonce:       nonce,
+	}
+	env.Signature = ed25519.Sign(s.privateKey, env.digest())
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(env); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// open verifies the envelope in payload and returns the Message
+// in it together with the id of the node that signed it.
+func (s *Server) open(payload []byte) (Message, string, error) {
+	var env Envelope
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&env); err != nil {
+		return Message{}, "", err
+	}
+	if len(env.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(env.PublicKey, env.digest(), env.Signature) {
+		return Message{}, "", ErrInvalidSignature
+	}
+	if err := s.checkSender(env.From, env.PublicKey, env.ExchangeKey); err != nil {
+		return Message{}, "", err
+	}
+	if err := s.checkFresh(env.Timestamp, env.Nonce); err != nil {
+		return Message{}, "", err
+	}
+
+	var msg Message
+	if err := gob.NewDecoder(bytes.NewReader(env.Body)).Decode(&msg); err != nil {
+		return Message{}, "", err
+	}
+	return msg, env.From, nil
+}
+
+// checkSender rejects a node whose id is not its public key and
+// pins the keys of a node the first time it is seen, see saveKeyring.
+func (s *Server) checkSender(id string, pub ed25519.PublicKey, exchangeKey []byte) error {
+	if id != hex.EncodeToString(pub) {
+		return fmt.Errorf("%w: %v", ErrUnknownSender, id)
+	}
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	known, ok := s.keyring[id]
+	if !ok {
+		s.keyring[id] = pub
+		s.exchangeKeys[id] = exchangeKey
+		if err := s.saveKeyring(); err != nil {
+			log.Printf("server (%v) failed to save the keyring: %v\n", s.store.Root, err)
+		}
+		return nil
+	}
+	if !known.Equal(pub) {
+		return fmt.Errorf("%w: %v", ErrUnknownSender, id)
+	}
+	return nil
+}
+
+// keyringEntry are the keys of a node in the saved keyring
+type keyringEntry struct {
+	PublicKey   []byte
+	ExchangeKey []byte
+}
+
+// saveKeyring keeps the keyring under the IndexDir of the store,
+// without one it only lives in memory like the index. authMu
+// must be held.
+func (s *Server) saveKeyring() error {
+	if len(s.store.IndexDir) == 0 {
+		return nil
+	}
+	keyring := make(map[string]keyringEntry, len(s.keyring))
+	for id, pub := range s.keyring {
+		keyring[id] = keyringEntry{PublicKey: pub, ExchangeKey: s.exchangeKeys[id]}
+	}
+	data, err := json.Marshal(keyring)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.store.IndexDir, os.ModePerm); err != nil {
+		return err
+	}
+	path := filepath.Join(s.store.IndexDir, keyringName)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadKeyring reads back the keyring saved by saveKeyring
+func (s *Server) loadKeyring() error {
+	if len(s.store.IndexDir) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(s.store.IndexDir, keyringName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keyring := map[string]keyringEntry{}
+	if err := json.Unmarshal(data, &keyring); err != nil {
+		return fmt.Errorf("failed to read the keyring: %w", err)
+	}
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	for id, entry := range keyring {
+		s.keyring[id] = entry.PublicKey
+		s.exchangeKeys[id] = entry.ExchangeKey
+	}
+	return nil
+}
+
+// checkFresh rejects messages outside MaxClockSkew and
+// messages whose nonce has already been seen.
+func (s *Server) checkFresh(timestamp int64, nonce []byte) error {
+	now := time.Now()
+	sent := time.Unix(0, timestamp)
+	if sent.Before(now.Add(-MaxClockSkew)) || sent.After(now.Add(MaxClockSkew)) {
+		return ErrStaleMessage
+	}
+	if len(nonce) != nonceSize {
+		return ErrReplayedMessage
+	}
+
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	for n, expires := range s.nonces {
+		if now.After(expires) {
+			delete(s.nonces, n)
+		}
+	}
+	key := hex.EncodeToString(nonce)
+	if _, ok := s.nonces[key]; ok {
+		return ErrReplayedMessage
+	}
+	// a replay after the nonce expired is caught by the timestamp check
+	s.nonces[key] = sent.Add(2 * MaxClockSkew)
+	return nil
+}
+
+// authorize checks that sender may perform action on the key
+// owned by owner, either as the owner or through a Capability.
+func (s *Server) authorize(sender, owner, action, key string, c *Capability) error {
+	if sender == owner {
+		return nil
+	}
+	if c == nil {
+		return fmt.Errorf("%w: %v cannot %v keys of %v", ErrNotAuthorized, sender, action, owner)
+	}
+	if c.Owner != owner || c.Grantee != sender || c.Action != action {
+		return fmt.Errorf("%w: capability does not cover %v", ErrNotAuthorized, action)
+	}
+	if len(c.Key) > 0 && c.Key != key {
+		return fmt.Errorf("%w: capability does not cover key %v", ErrNotAuthorized, key)
+	}
+	if time.Now().After(time.Unix(0, c.Expires)) {
+		return fmt.Errorf("%w: capability expired", ErrNotAuthorized)
+	}
+
+	s.authMu.Lock()
+	ownerKey, ok := s.keyring[owner]
+	s.authMu.Unlock()
+	if !ok || !ownerKey.Equal(ed25519.PublicKey(c.PublicKey)) {
+		return fmt.Errorf("%w: unknown owner key for %v", ErrNotAuthorized, owner)
+	}
+	if !ed25519.Verify(ownerKey, c.digest(), c.Signature) {
+		return fmt.Errorf("%w: %v", ErrNotAuthorized, ErrInvalidSignature)
+	}
+	return nil
+}
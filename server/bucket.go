@@ -0,0 +1,404 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+	"github.com/jun-hf/distributedstorage/p2p"
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+const (
+	// EncryptionServer encrypts the replicas with the server's key
+	EncryptionServer = "server"
+	// EncryptionConvergent encrypts the replicas with a key derived
+	// from the content, see ServerOpts.Convergent
+	EncryptionConvergent = "convergent"
+	// EncryptionClient stores the data as sent, the clients encrypt
+	// it beforehand, see ServerOpts.PreEncrypted
+	EncryptionClient = "client"
+)
+
+// bucketsPath is where the buckets of the server are kept in the Backend
+const bucketsPath = ".buckets.json"
+
+var (
+	ErrNoSuchBucket       = errors.New("no such bucket")
+	ErrBucketExists       = errors.New("bucket already exists")
+	ErrBucketNotEmpty     = errors.New("bucket not empty")
+	ErrInvalidBucketName  = errors.New("invalid bucket name")
+	ErrInvalidBucketValue = errors.New("invalid bucket setting")
+	ErrInvalidKey         = errors.New("invalid key")
+	ErrInvalidNamespace   = errors.New("invalid namespace")
+)
+
+// BucketConfig are the settings of a bucket, the zero values
+// keep the settings of the server. They only apply on the node
+// owning the bucket, the peers holding its replicas know the
+// bucket by name but apply their own quotas and versioning.
+type BucketConfig struct {
+	// Replicas is the number of peers holding a replica of each
+	// object, all of them when zero
+	Replicas int
+	// Encryption is one of EncryptionServer, EncryptionConvergent
+	// and EncryptionClient
+	Encryption string
+	// TTL is how long the objects are kept when PutOptions
+	// sets neither TTL nor Expires
+	TTL time.Duration
+	// Quota limits what the bucket stores on this node
+	Quota store.Quota
+	// Compression is the compression of the objects stored
+	// without one in PutOptions, see ServerOpts.Compression
+	Compression string
+	// Versioning keeps the older versions of the objects, see SetVersioning
+	Versioning bool
+}
+
+func (c BucketConfig) validate() error {
+	if c.Replicas < 0 || c.TTL < 0 {
+		return ErrInvalidBucketValue
+	}
+	if err := store.ValidCompression(c.Compression); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBucketValue, err)
+	}
+	switch c.Encryption {
+	case "", EncryptionServer, EncryptionConvergent, EncryptionClient:
+		return nil
+	}
+	return fmt.Errorf("%w: encryption %q", ErrInvalidBucketValue, c.Encryption)
+}
+
+// validBucketName reports if name is 3 to 63 lower case letters,
+// digits and dashes, not starting or ending with a dash
+func validBucketName(name string) bool {
+	if len(name) < 3 || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateBucket creates the bucket name with the settings in cfg
+func (s *Server) CreateBucket(name string, cfg BucketConfig) error {
+	if !validBucketName(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidBucketName, name)
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	if _, ok := s.buckets[name]; ok {
+		return fmt.Errorf("%w: %v", ErrBucketExists, name)
+	}
+	s.buckets[name] = cfg
+	if err := s.saveBuckets(); err != nil {
+		delete(s.buckets, name)
+		return err
+	}
+	s.applyBucket(name, cfg)
+	return nil
+}
+
+// ListBuckets returns the names of the buckets in lexical order
+func (s *Server) ListBuckets() []string {
+	s.bucketMu.RLock()
+	defer s.bucketMu.RUnlock()
+	names := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BucketConfig returns the settings of the bucket name
+func (s *Server) BucketConfig(name string) (BucketConfig, error) {
+	s.bucketMu.RLock()
+	defer s.bucketMu.RUnlock()
+	cfg, ok := s.buckets[name]
+	if !ok {
+		return BucketConfig{}, fmt.Errorf("%w: %v", ErrNoSuchBucket, name)
+	}
+	return cfg, nil
+}
+
+// DeleteBucket deletes the bucket name, it must hold no object
+func (s *Server) DeleteBucket(name string) error {
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	cfg, ok := s.buckets[name]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrNoSuchBucket, name)
+	}
+	keys, _, err := s.store.ListBucket(s.id, name, "", "", 1)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return fmt.Errorf("%w: %v", ErrBucketNotEmpty, name)
+	}
+	delete(s.buckets, name)
+	if err := s.saveBuckets(); err != nil {
+		s.buckets[name] = cfg
+		return err
+	}
+	// a bucket created again under the name starts afresh
+	s.store.RemoveNamespaceQuota(bucketNamespace(name))
+	s.store.SetVersioning(bucketNamespace(name), false)
+	return nil
+}
+
+// bucketNamespace is the namespace of the objects of the bucket name.
+// It ends with the separator of the bucket keys, which the namespaces
+// of PutOptions cannot hold, so the two never share a quota.
+func bucketNamespace(name string) string {
+	return store.BucketKey(name, "")
+}
+
+// applyBucket sets the quota and versioning of the namespace of the bucket name
+func (s *Server) applyBucket(name string, cfg BucketConfig) {
+	if cfg.Quota != (store.Quota{}) {
+		s.store.SetNamespaceQuota(bucketNamespace(name), cfg.Quota)
+	}
+	if cfg.Versioning {
+		s.store.SetVersioning(bucketNamespace(name), true)
+	}
+}
+
+// saveBuckets keeps the buckets in the Backend, bucketMu must be held
+func (s *Server) saveBuckets() error {
+	data, err := json.Marshal(s.buckets)
+	if err != nil {
+		return err
+	}
+	_, err = s.store.Backend.Put(bucketsPath, bytes.NewReader(data))
+	return err
+}
+
+// loadBuckets reads back the buckets saved by saveBuckets
+func (s *Server) loadBuckets() error {
+	f, err := s.store.Backend.Get(bucketsPath)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	if err := json.NewDecoder(f).Decode(&s.buckets); err != nil {
+		return fmt.Errorf("failed to read the buckets: %w", err)
+	}
+	for name, cfg := range s.buckets {
+		s.applyBucket(name, cfg)
+	}
+	return nil
+}
+
+// bucketConfig returns the settings of the bucket of key,
+// the zero BucketConfig for the keys outside of buckets
+func (s *Server) bucketConfig(key string) BucketConfig {
+	bucket, _ := store.SplitBucketKey(key)
+	if len(bucket) == 0 {
+		return BucketConfig{}
+	}
+	s.bucketMu.RLock()
+	defer s.bucketMu.RUnlock()
+	return s.buckets[bucket]
+}
+
+// encryption returns how the replicas of key are encrypted
+func (s *Server) encryption(key string) string {
+	if cfg := s.bucketConfig(key); len(cfg.Encryption) > 0 {
+		return cfg.Encryption
+	}
+	switch {
+	case s.preEncrypted:
+		return EncryptionClient
+	case s.convergent:
+		return EncryptionConvergent
+	}
+	return EncryptionServer
+}
+
+// replicaPeers returns the peers to hold the size bytes replicas of key
+func (s *Server) replicaPeers(key string, size int64) []p2p.Peer {
+	peers := s.writablePeers(s.peerList(), size)
+	if n := s.bucketConfig(key).Replicas; n > 0 {
+		return selectPeers(peers, key, n)
+	}
+	return peers
+}
+
+// selectPeers picks n of peers for key by rendezvous hashing, the same
+// peers as long as they are connected and the others when they are not
+func selectPeers(peers []p2p.Peer, key string, n int) []p2p.Peer {
+	if n >= len(peers) {
+		return peers
+	}
+	weights := make(map[p2p.Peer]string, len(peers))
+	for _, p := range peers {
+		weights[p] = cryto.Hash(key + p.RemoteAddr().String())
+	}
+	sorted := slices.Clone(peers)
+	slices.SortFunc(sorted, func(a, b p2p.Peer) int {
+		return strings.Compare(weights[a], weights[b])
+	})
+	return sorted[:n]
+}
+
+// peerBucketKey returns the local key of the replica key of bucket sent
+// by a peer. The bucket names a directory of the store, it must be
+// a valid bucket name so that it cannot point outside of it.
+func peerBucketKey(bucket, key string) (string, error) {
+	if len(bucket) > 0 && !validBucketName(bucket) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidBucketName, bucket)
+	}
+	return store.BucketKey(bucket, key), nil
+}
+
+// peerKey returns the bucket of key and the key its replicas are
+// stored under in that bucket on the peers
+func peerKey(key string) (bucket, remote string) {
+	bucket, _ = store.SplitBucketKey(key)
+	return bucket, cryto.Hash(key)
+}
+
+// Bucket is a handle on the objects of a bucket of the server
+type Bucket struct {
+	Name   string
+	server *Server
+}
+
+// Bucket returns the handle of the bucket name
+func (s *Server) Bucket(name string) (*Bucket, error) {
+	if _, err := s.BucketConfig(name); err != nil {
+		return nil, err
+	}
+	return &Bucket{Name: name, server: s}, nil
+}
+
+func (b *Bucket) key(key string) string {
+	return store.BucketKey(b.Name, key)
+}
+
+// Store stores data under key in the bucket, see Server.Store
+func (b *Bucket) Store(key string, data io.Reader) (int64, error) {
+	return b.StoreWithOptions(key, data, PutOptions{})
+}
+
+// StoreWithOptions works like Server.StoreWithOptions with the
+// settings of the bucket. The objects count in the quota of the
+// bucket, in place of the namespace of opts.
+func (b *Bucket) StoreWithOptions(key string, data io.Reader, opts PutOptions) (int64, error) {
+	cfg, err := b.server.BucketConfig(b.Name)
+	if err != nil {
+		return 0, err
+	}
+	if b.server.contentAddressed {
+		return 0, ErrContentAddressed
+	}
+	if opts.TTL == 0 && opts.Expires.IsZero() {
+		opts.TTL = cfg.TTL
+	}
+	opts.Namespace = bucketNamespace(b.Name)
+	meta := opts.metadata(key)
+	meta.Bucket = b.Name
+	return b.server.storeObject(b.key(key), data, meta)
+}
+
+// Read returns the content of key in the bucket, see Server.Read
+func (b *Bucket) Read(key string) (io.ReadCloser, error) {
+	return b.server.Read(b.key(key))
+}
+
+// ReadRange returns length bytes of key in the bucket from offset,
+// see Server.ReadRange
+func (b *Bucket) ReadRange(key string, offset, length int64) (io.ReadCloser, error) {
+	return b.server.ReadRange(b.key(key), offset, length)
+}
+
+// Open opens key in the bucket for reading, see Server.Open
+func (b *Bucket) Open(key string) (io.ReadSeekCloser, error) {
+	return b.server.Open(b.key(key))
+}
+
+// Stat returns the metadata of key in the bucket
+func (b *Bucket) Stat(key string) (store.Metadata, error) {
+	meta, err := b.server.Stat(b.key(key))
+	if err != nil {
+		return meta, err
+	}
+	meta.Name, meta.Bucket = key, b.Name
+	return meta, nil
+}
+
+// Delete deletes key from the bucket and the peers
+func (b *Bucket) Delete(key string) error {
+	return b.server.Delete(b.key(key))
+}
+
+// Versions returns the versions of key in the bucket, see Server.Versions
+func (b *Bucket) Versions(key string) []store.Metadata {
+	versions := b.server.Versions(b.key(key))
+	for i := range versions {
+		versions[i].Name = key
+	}
+	return versions
+}
+
+// ReadVersion returns the content of the version versionId of key
+// in the bucket, see Server.ReadVersion
+func (b *Bucket) ReadVersion(key, versionId string) (io.ReadCloser, error) {
+	return b.server.ReadVersion(b.key(key), versionId)
+}
+
+// RestoreVersion makes the version versionId of key in the bucket its
+// current version again, see Server.RestoreVersion
+func (b *Bucket) RestoreVersion(key, versionId string) (int64, error) {
+	return b.server.RestoreVersion(b.key(key), versionId)
+}
+
+// PruneVersions prunes the older versions of key in the bucket,
+// see Server.PruneVersions
+func (b *Bucket) PruneVersions(key string, keep int, maxAge time.Duration) (int, error) {
+	return b.server.PruneVersions(b.key(key), keep, maxAge)
+}
+
+// Trash returns the deleted objects of the bucket starting with prefix,
+// see Server.Trash
+func (b *Bucket) Trash(prefix string) []store.Metadata {
+	return b.server.trash(b.Name, prefix)
+}
+
+// Undelete moves key back from the trash of the bucket, see Server.Undelete
+func (b *Bucket) Undelete(key string) error {
+	return b.server.Undelete(b.key(key))
+}
+
+// UndeletePrefix moves back from the trash the objects of the bucket
+// starting with prefix, see Server.UndeletePrefix
+func (b *Bucket) UndeletePrefix(prefix string) ([]string, error) {
+	return b.server.undeletePrefix(b.Name, prefix)
+}
+
+// List returns up to limit keys of the bucket starting with prefix,
+// in lexical order after cursor, see Server.List
+func (b *Bucket) List(prefix, cursor string, limit int) ([]string, string, error) {
+	return b.server.store.ListBucket(b.server.id, b.Name, prefix, cursor, limit)
+}
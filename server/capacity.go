@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/p2p"
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+// DefaultCapacityInterval is the time between two advertisements
+// of the free space of the node to its peers
+const DefaultCapacityInterval = 10 * time.Second
+
+// PeerCapacity is the free space last advertised by a peer
+type PeerCapacity struct {
+	// Available is what the peer still accepts, -1 when unknown
+	Available int64
+	ReadOnly  bool
+	Updated   time.Time
+}
+
+// Capacity returns the space of the local store
+func (s *Server) Capacity() (store.Capacity, error) {
+	return s.store.Capacity()
+}
+
+// ReadOnly reports if the node refuses new objects and replicas
+// for lack of space, see ServerOpts.Reserve
+func (s *Server) ReadOnly() bool {
+	return s.store.ReadOnly()
+}
+
+// PeerCapacities returns the free space advertised by the peers, by address
+func (s *Server) PeerCapacities() map[string]PeerCapacity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	capacities := make(map[string]PeerCapacity, len(s.capacities))
+	for addr, c := range s.capacities {
+		capacities[addr] = c
+	}
+	return capacities
+}
+
+func (s *Server) capacityMessage() *Message {
+	available := s.store.Available()
+	return &Message{
+		Payload: MessageCapacity{
+			Available: available,
+			ReadOnly:  available == 0,
+		},
+	}
+}
+
+// advertiseCapacity sends the free space of the node to peers
+func (s *Server) advertiseCapacity(peers ...p2p.Peer) {
+	if err := s.sendTo(peers, s.capacityMessage()); err != nil {
+		log.Printf("server (%v) failed to advertise its capacity: %v\n", s.store.Root, err)
+	}
+}
+
+func (s *Server) handleMessageCapacity(m MessageCapacity, from string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacities[from] = PeerCapacity{
+		Available: m.Available,
+		ReadOnly:  m.ReadOnly,
+		Updated:   time.Now(),
+	}
+	return nil
+}
+
+// OnPeerClose forgets the capacity advertised by p once it leaves
+func (s *Server) OnPeerClose(p p2p.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.capacities, p.RemoteAddr().String())
+}
+
+// writablePeers drops the peers known to have no room for size bytes,
+// the peers that did not advertise their capacity are kept
+func (s *Server) writablePeers(peers []p2p.Peer, size int64) []p2p.Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	writable := make([]p2p.Peer, 0, len(peers))
+	for _, p := range peers {
+		c, ok := s.capacities[p.RemoteAddr().String()]
+		if ok && (c.ReadOnly || c.Available >= 0 && c.Available < size) {
+			continue
+		}
+		writable = append(writable, p)
+	}
+	return writable
+}
+
+// spaceError reports if err is a refusal for lack of space
+func spaceError(err error) bool {
+	return errors.Is(err, store.ErrReadOnly) || errors.Is(err, store.ErrNoSpace)
+}
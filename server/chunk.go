@@ -0,0 +1,445 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+	"github.com/jun-hf/distributedstorage/p2p"
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+// Manifest is stored in place of an object split in chunks. Each
+// chunk is an unnamed object stored under its content identifier,
+// so chunks shared by several objects are only stored once.
+type Manifest struct {
+	Size      int64
+	ChunkSize int64
+	Chunks    []Chunk
+	// DataShards and ParityShards are set when the object is erasure
+	// coded, Chunks then lists the data shards and the parity shards.
+	DataShards   int `json:",omitempty"`
+	ParityShards int `json:",omitempty"`
+}
+
+type Chunk struct {
+	Key  string
+	Size int64
+	// ContentKey is the wrapped convergent key of a shard, the
+	// shards are only kept by the peers
+	ContentKey []byte `json:",omitempty"`
+}
+
+// storeChunked stores and replicates data chunk by chunk, then the
+// manifest under key. Chunks already replicated to every peer are
+// skipped so storing an object again resumes a failed transfer.
+func (s *Server) storeChunked(key string, data io.Reader, meta store.Metadata) (int64, error) {
+	m := Manifest{ChunkSize: s.chunkSize}
+	content := sha256.New()
+	buf := make([]byte, s.chunkSize)
+	written := int64(0)
+	for {
+		n, err := io.ReadFull(data, buf)
+		if n > 0 {
+			chunk := buf[:n]
+			content.Write(chunk)
+			cid, _ := cryto.CID(bytes.NewReader(chunk))
+			w, err := s.storeChunk(cid, chunk)
+			written += w
+			if err != nil {
+				return written, err
+			}
+			m.Chunks = append(m.Chunks, Chunk{Key: cid, Size: int64(n)})
+			m.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	meta.ContentChecksum = hex.EncodeToString(content.Sum(nil))
+	w, err := s.writeManifest(key, &m, meta)
+	return written + w, err
+}
+
+// writeManifest stores m under key with meta and counts its chunks,
+// the chunks of the manifest it replaces are released unless it is
+// kept as an older version
+func (s *Server) writeManifest(key string, m *Manifest, meta store.Metadata) (int64, error) {
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	var old *Manifest
+	if current, err := s.store.Stat(s.id, key); err == nil && current.Manifest {
+		if old, err = s.loadManifest(key); err != nil {
+			return 0, err
+		}
+	}
+	meta.Manifest = true
+	n, err := s.writeObject(key, bytes.NewReader(manifest), meta)
+	if err != nil {
+		return n, err
+	}
+	s.acquireChunks(m)
+	if current, err := s.store.Stat(s.id, key); old != nil && err == nil && len(current.VersionId) == 0 {
+		return n, s.releaseChunks(old)
+	}
+	return n, nil
+}
+
+func (s *Server) storeChunk(cid string, chunk []byte) (int64, error) {
+	if !s.store.Has(s.id, cid) {
+		return s.writeObject(cid, bytes.NewReader(chunk), store.Metadata{})
+	}
+	peers := s.unreplicated(cid, s.peerList())
+	if len(peers) == 0 {
+		return 0, nil
+	}
+	encryptKey, err := s.replicaKey(cid, chunk)
+	if err != nil {
+		return 0, err
+	}
+	return s.replicate(peers, cid, encryptKey, bytes.NewReader(chunk), int64(len(chunk)))
+}
+
+// unreplicated returns the peers without a replica of key
+func (s *Server) unreplicated(key string, peers []p2p.Peer) []p2p.Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	missing := []p2p.Peer{}
+	for _, p := range peers {
+		r, ok := s.replicas[key][p.RemoteAddr().String()]
+		if !ok || r.lost {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// manifest returns the manifest of key, nil when key is a whole object
+func (s *Server) manifest(key string) (*Manifest, error) {
+	meta, err := s.stat(key)
+	if err != nil || !meta.Manifest {
+		return nil, err
+	}
+	return s.loadManifest(key)
+}
+
+func (s *Server) loadManifest(key string) (*Manifest, error) {
+	var data []byte
+	if r, err := s.store.Read(s.id, key); err == nil {
+		data, err = io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// the peer clamps the range to the size of the manifest
+		data, err = s.readRemoteRange(key, 0, maxManifestSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest of %v: %w", key, err)
+	}
+	s.loadContentKeys(m)
+	return m, nil
+}
+
+// loadContentKeys remembers the convergent keys of the shards of m
+func (s *Server) loadContentKeys(m *Manifest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range m.Chunks {
+		if _, ok := s.contentKeys[c.Key]; !ok && len(c.ContentKey) > 0 {
+			s.contentKeys[c.Key] = c.ContentKey
+		}
+	}
+}
+
+// maxManifestSize bounds what is read of a manifest, enough
+// for hundreds of thousands of chunks
+const maxManifestSize = 16 << 20
+
+// readChunk returns the content of c, from the local store or from
+// the peers starting with peers[i % len(peers)] so that consecutive
+// chunks are fetched from different peers.
+func (s *Server) readChunk(c Chunk, peers []p2p.Peer, i int) ([]byte, error) {
+	if r, err := s.store.Read(s.id, c.Key); err == nil {
+		data, err := io.ReadAll(r)
+		if err == nil && cryto.VerifyCID(c.Key, bytes.NewReader(data)) == nil {
+			return data, nil
+		}
+	}
+	return s.fetchChunk(c, peers, i)
+}
+
+// fetchChunk returns the content of c from the peers only
+func (s *Server) fetchChunk(c Chunk, peers []p2p.Peer, i int) ([]byte, error) {
+	for j := range peers {
+		peer := peers[(i+j)%len(peers)]
+		data, err := s.readPeerRange(peer, c.Key, 0, c.Size)
+		if err == nil {
+			err = cryto.VerifyCID(c.Key, bytes.NewReader(data))
+		}
+		if err != nil {
+			if !errors.Is(err, store.ErrNotFound) {
+				log.Printf("server (%v) chunk %v from %v failed: %v\n", s.store.Root, c.Key, peer.RemoteAddr(), err)
+			}
+			continue
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("%w: chunk %v", store.ErrNotFound, c.Key)
+}
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// readChunks streams the content of m in order while fetching up to
+// one chunk per peer ahead in parallel. Closing the reader before its
+// end stops the fetches.
+func (s *Server) readChunks(m *Manifest) io.ReadCloser {
+	pr, pw := io.Pipe()
+	stop := make(chan struct{})
+	go func() {
+		peers := s.peerList()
+		results := make([]chan chunkResult, len(m.Chunks))
+		for i := range results {
+			results[i] = make(chan chunkResult, 1)
+		}
+		ahead := make(chan struct{}, max(len(peers), 1))
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for i, c := range m.Chunks {
+				select {
+				case ahead <- struct{}{}:
+				case <-done:
+					return
+				}
+				go func() {
+					data, err := s.readChunk(c, peers, i)
+					results[i] <- chunkResult{data, err}
+				}()
+			}
+		}()
+
+		for i := range m.Chunks {
+			var res chunkResult
+			select {
+			case res = <-results[i]:
+			case <-stop:
+				return
+			}
+			<-ahead
+			if res.err != nil {
+				pw.CloseWithError(res.err)
+				return
+			}
+			if _, err := pw.Write(res.data); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return &chunkReader{pr: pr, stop: stop}
+}
+
+// chunkReader is the reader of readChunks
+type chunkReader struct {
+	pr   *io.PipeReader
+	stop chan struct{}
+	once sync.Once
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	return r.pr.Read(p)
+}
+
+func (r *chunkReader) Close() error {
+	r.once.Do(func() { close(r.stop) })
+	return r.pr.CloseWithError(io.ErrClosedPipe)
+}
+
+// chunkedObject is a seekable handle on a chunked object,
+// the last chunk read is kept for the next reads.
+type chunkedObject struct {
+	s     *Server
+	m     *Manifest
+	pos   int64
+	index int
+	data  []byte
+}
+
+func (s *Server) openChunked(m *Manifest) *chunkedObject {
+	return &chunkedObject{s: s, m: m, index: -1}
+}
+
+func (o *chunkedObject) Read(p []byte) (int, error) {
+	if o.pos >= o.m.Size || o.m.ChunkSize <= 0 {
+		return 0, io.EOF
+	}
+	i := int(o.pos / o.m.ChunkSize)
+	if i >= len(o.m.Chunks) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if i != o.index {
+		data, err := o.s.readChunk(o.m.Chunks[i], o.s.peerList(), i)
+		if err != nil && o.m.DataShards > 0 {
+			// rebuild the data shard from the others
+			var shards [][]byte
+			var lost []int
+			shards, lost, err = o.s.readShards(o.m)
+			if err == nil {
+				o.s.restoreInBackground(o.m, shards, lost)
+				data = shards[i]
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		o.index, o.data = i, data
+	}
+	off := o.pos - int64(i)*o.m.ChunkSize
+	if off >= int64(len(o.data)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, o.data[off:])
+	o.pos += int64(n)
+	return n, nil
+}
+
+func (o *chunkedObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.m.Size
+	default:
+		return 0, fmt.Errorf("invalid whence %v", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %v", offset)
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *chunkedObject) Close() error {
+	o.data = nil
+	return nil
+}
+
+// countChunks counts the local manifests of the server using each
+// chunk, the expired ones not reaped yet, the ones of the older
+// versions and in the trash included, see releaseChunks
+func (s *Server) countChunks() {
+	refs := map[string]int{}
+	count := func(key string, open func() (io.ReadCloser, error)) {
+		m, err := readManifest(key, open)
+		if err != nil {
+			log.Printf("server (%v) cannot count the chunks of %v: %v\n", s.store.Root, key, err)
+			return
+		}
+		for _, c := range m.Chunks {
+			refs[c.Key]++
+		}
+	}
+	for _, meta := range s.store.Entries(s.id) {
+		if meta.Manifest {
+			count(meta.Key, func() (io.ReadCloser, error) { return s.store.Peek(s.id, meta.Key) })
+		}
+	}
+	for _, meta := range s.store.OlderVersions(s.id) {
+		if meta.Manifest && !meta.DeleteMarker {
+			count(meta.Key, func() (io.ReadCloser, error) { return s.store.PeekVersion(s.id, meta.Key, meta.VersionId) })
+		}
+	}
+	for _, meta := range s.store.Trash(s.id) {
+		if meta.Manifest {
+			count(meta.Key, func() (io.ReadCloser, error) { return s.store.OpenTrash(s.id, meta.Key) })
+		}
+	}
+	s.refMu.Lock()
+	s.chunkRefs = refs
+	s.refMu.Unlock()
+}
+
+// readManifest decodes the manifest of key read from open
+func readManifest(key string, open func() (io.ReadCloser, error)) (*Manifest, error) {
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &Manifest{}
+	if err := json.NewDecoder(io.LimitReader(f, maxManifestSize)).Decode(m); err != nil {
+		return nil, fmt.Errorf("invalid manifest of %v: %w", key, err)
+	}
+	return m, nil
+}
+
+// acquireChunks counts a new manifest m using its chunks
+func (s *Server) acquireChunks(m *Manifest) {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	for _, c := range m.Chunks {
+		s.chunkRefs[c.Key]++
+	}
+}
+
+// releaseChunks uncounts the manifest m deleted for good and deletes
+// its chunks no other local manifest uses
+func (s *Server) releaseChunks(m *Manifest) error {
+	unused := []Chunk{}
+	s.refMu.Lock()
+	for _, c := range m.Chunks {
+		s.chunkRefs[c.Key]--
+		if s.chunkRefs[c.Key] <= 0 {
+			delete(s.chunkRefs, c.Key)
+			unused = append(unused, c)
+		}
+	}
+	s.refMu.Unlock()
+	deleted := map[string]bool{}
+	for _, c := range unused {
+		if deleted[c.Key] {
+			continue
+		}
+		deleted[c.Key] = true
+		if s.store.Has(s.id, c.Key) {
+			if err := s.Delete(c.Key); err != nil {
+				return err
+			}
+			continue
+		}
+		bucket, remote := peerKey(c.Key)
+		msg := &Message{
+			Payload: MessageDeleteKey{
+				Key:    remote,
+				Id:     s.id,
+				Bucket: bucket,
+			},
+		}
+		if err := s.broadcast(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+)
+
+var ErrContentAddressed = errors.New("server is content addressed, use Put")
+
+// Put stores data under its content identifier (see cryto.CID) and
+// returns it. Content already stored is not written nor replicated
+// again, so the identifier of an object always names the same bytes.
+func (s *Server) Put(data io.Reader) (string, error) {
+	return s.PutWithOptions(data, PutOptions{})
+}
+
+// PutWithOptions works like Put and keeps the attributes in opts
+func (s *Server) PutWithOptions(data io.Reader, opts PutOptions) (string, error) {
+	if strings.Contains(opts.Namespace, "\x00") {
+		// reserved for the buckets, see bucketNamespace
+		return "", fmt.Errorf("%w: %q", ErrInvalidNamespace, opts.Namespace)
+	}
+	h := cryto.NewCIDHasher()
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(io.MultiWriter(buf, h), data); err != nil {
+		return "", err
+	}
+	cid := h.CID()
+	if s.store.Has(s.id, cid) {
+		return cid, nil
+	}
+	if _, err := s.storeObject(cid, buf, opts.metadata(cid)); err != nil {
+		return cid, err
+	}
+	return cid, nil
+}
+
+// readVerified reads key from the local store, in content addressed
+// mode the content is checked against the key before it is returned.
+func (s *Server) readVerified(key string) (io.Reader, error) {
+	r, err := s.store.Read(s.id, key)
+	if err != nil || !s.contentAddressed {
+		return r, err
+	}
+	if !cryto.IsCID(key) {
+		return nil, fmt.Errorf("%w: %v is not a content identifier", cryto.ErrDigestMismatch, key)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := cryto.VerifyCID(key, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("%w: %v", err, key)
+	}
+	return bytes.NewReader(data), nil
+}
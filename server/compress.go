@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+	"github.com/jun-hf/distributedstorage/p2p"
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+// compressionOf returns the compression of the objects of key
+// stored without their own, the one of its bucket or of the server
+func (s *Server) compressionOf(key string) string {
+	if cfg := s.bucketConfig(key); len(cfg.Compression) > 0 {
+		return cfg.Compression
+	}
+	return s.compression
+}
+
+func (s *Server) handleMessageHello(m MessageHello, from string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compressions[from] = m.Compressions
+	return nil
+}
+
+// accepts reports if all the peers said they support alg, the
+// peers whose hello did not arrive yet are sent plain replicas
+func (s *Server) accepts(peers []p2p.Peer, alg string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range peers {
+		if !slices.Contains(s.compressions[p.RemoteAddr().String()], alg) {
+			return false
+		}
+	}
+	return true
+}
+
+// encode compresses the n bytes of r with alg before they are encrypted
+// for peers. It returns the content to send, its size and the encoding
+// applied, none when a peer does not support alg or it does not shrink
+// enough, see store.WorthCompressing. The caller closes the content.
+func (s *Server) encode(peers []p2p.Peer, alg string, r io.ReadSeeker, n int64) (io.ReadCloser, int64, string, error) {
+	if len(alg) == 0 || !s.accepts(peers, alg) {
+		return io.NopCloser(r), n, "", nil
+	}
+	// the size is sent ahead of the content, r is compressed
+	// once to count it and once more as it is sent
+	size, err := store.CompressedSize(alg, r)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, "", err
+	}
+	if !store.WorthCompressing(n, size) {
+		return io.NopCloser(r), n, "", nil
+	}
+	compressed, err := store.CompressStream(alg, r)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return compressed, size, alg, nil
+}
+
+// decodeReplica returns the content of the replica of key read from r,
+// decrypted and decompressed with encoding when there is one
+func (s *Server) decodeReplica(key, encoding string, r io.Reader) (io.ReadCloser, error) {
+	if s.encryption(key) != EncryptionClient {
+		decryptKey, err := s.decryptKey(key)
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, s.replicaSize(key, 0))
+		if _, err := io.ReadFull(r, iv); err != nil {
+			return nil, fmt.Errorf("short replica of %v: %w", key, err)
+		}
+		if r, err = cryto.NewDecryptReader(decryptKey, iv, 0, r); err != nil {
+			return nil, err
+		}
+	}
+	if len(encoding) == 0 {
+		return io.NopCloser(r), nil
+	}
+	return store.Decompress(encoding, r)
+}
+
+// writeStreamHeader starts the reply to a MessageGetFile with the size
+// of the stream, negative when there is none, and its ContentEncoding
+func writeStreamHeader(w io.Writer, size int64, encoding string) error {
+	if err := binary.Write(w, binary.LittleEndian, size); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint8(len(encoding))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, encoding)
+	return err
+}
+
+// readStreamHeader reads what writeStreamHeader wrote
+func readStreamHeader(r io.Reader) (int64, string, error) {
+	var size int64
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return 0, "", err
+	}
+	var n uint8
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return 0, "", err
+	}
+	encoding := make([]byte, n)
+	if _, err := io.ReadFull(r, encoding); err != nil {
+		return 0, "", err
+	}
+	return size, string(encoding), nil
+}
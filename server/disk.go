@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"log"
+
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+// ErrSingleDisk is returned by the disk operations of a
+// server that does not keep its objects on a store.MultiBackend
+var ErrSingleDisk = errors.New("server has a single disk")
+
+func (s *Server) multiBackend() (*store.MultiBackend, error) {
+	multi, ok := s.store.Backend.(*store.MultiBackend)
+	if !ok {
+		return nil, ErrSingleDisk
+	}
+	return multi, nil
+}
+
+// Disks returns the status of the disks of the server, nil
+// when it does not keep its objects on a store.MultiBackend
+func (s *Server) Disks() []store.DiskStatus {
+	multi, err := s.multiBackend()
+	if err != nil {
+		return nil
+	}
+	return multi.Disks()
+}
+
+// AddDisk adds the directory root of a new disk and moves objects
+// onto it, it returns the number of objects moved.
+func (s *Server) AddDisk(root string) (int, error) {
+	multi, err := s.multiBackend()
+	if err != nil {
+		return 0, err
+	}
+	if err := multi.AddDisk(root, store.NewFSBackend(root)); err != nil {
+		return 0, err
+	}
+	return multi.Rebalance()
+}
+
+// CheckDisks probes every disk, the failed ones are marked so
+// and their objects restored from the peers in the background.
+func (s *Server) CheckDisks() []string {
+	multi, err := s.multiBackend()
+	if err != nil {
+		return nil
+	}
+	return multi.Check()
+}
+
+// RestoreMissing fetches back from the peers the local objects lost
+// with a failed disk. It returns the keys restored and the keys no
+// peer could send back.
+func (s *Server) RestoreMissing() (restored, lost []string, err error) {
+	missing, err := s.store.Missing()
+	for _, meta := range missing {
+		if !meta.Deleted.IsZero() {
+			// a deleted object lost from the trash
+			lost = append(lost, meta.Key)
+			continue
+		}
+		if err := s.restore(meta); err != nil {
+			log.Printf("server (%v) failed to restore %v: %v\n", s.store.Root, meta.Key, err)
+			lost = append(lost, meta.Key)
+			continue
+		}
+		restored = append(restored, meta.Key)
+	}
+	return restored, lost, err
+}
+
+// watchDisks restores the objects of the disks that fail
+func (s *Server) watchDisks() {
+	multi, err := s.multiBackend()
+	if err != nil {
+		return
+	}
+	onFail := multi.OnFail
+	multi.OnFail = func(disk string) {
+		if onFail != nil {
+			onFail(disk)
+		}
+		go func() {
+			restored, lost, err := s.RestoreMissing()
+			if err != nil {
+				log.Printf("server (%v) failed to restore disk %v: %v\n", s.store.Root, disk, err)
+			}
+			log.Printf("server (%v) restored %v objects of disk %v, %v lost\n", s.store.Root, len(restored), disk, len(lost))
+		}()
+	}
+}
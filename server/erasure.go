@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+	"github.com/jun-hf/distributedstorage/erasure"
+	"github.com/jun-hf/distributedstorage/p2p"
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+const (
+	// StorageReplicated keeps a full copy of the object on every peer
+	StorageReplicated = ""
+	// StorageErasure spreads the object over DataShards data shards
+	// and ParityShards parity shards, each on a different peer
+	StorageErasure = "erasure"
+
+	DefaultDataShards   = 4
+	DefaultParityShards = 2
+	// DefaultRepairInterval is the time between two background
+	// repairs of the erasure coded objects, see RepairAllShards
+	DefaultRepairInterval = 10 * time.Minute
+)
+
+// ErrNotEnoughPeers is returned when there are less peers than shards
+var ErrNotEnoughPeers = errors.New("not enough peers")
+
+// storeErasure encodes data in shards sent each to its own peer, then
+// stores the manifest listing them under key. The shards are not kept
+// locally, any DataShards of them rebuild the content.
+func (s *Server) storeErasure(key string, data io.Reader, meta store.Metadata) (int64, error) {
+	enc, err := erasure.New(s.dataShards, s.parityShards)
+	if err != nil {
+		return 0, err
+	}
+	if n := len(s.peerList()); n < enc.TotalShards() {
+		return 0, fmt.Errorf("%w: %v shards for %v peers", ErrNotEnoughPeers, enc.TotalShards(), n)
+	}
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return 0, err
+	}
+	shards := enc.Split(content)
+	if err := enc.Encode(shards); err != nil {
+		return 0, err
+	}
+	// only the peers with room for a shard
+	peers := s.writablePeers(s.peerList(), s.replicaSize("", int64(len(shards[0]))))
+	if len(peers) < enc.TotalShards() {
+		return 0, fmt.Errorf("%w: %v shards for %v peers with room", ErrNotEnoughPeers, enc.TotalShards(), len(peers))
+	}
+
+	m := Manifest{
+		Size:         int64(len(content)),
+		ChunkSize:    int64(len(shards[0])),
+		DataShards:   enc.DataShards(),
+		ParityShards: enc.ParityShards(),
+	}
+	written := int64(0)
+	for i, shard := range shards {
+		cid, _ := cryto.CID(bytes.NewReader(shard))
+		w, err := s.placeShard(cid, shard, peers[i])
+		written += w
+		if err != nil {
+			return written, err
+		}
+		m.Chunks = append(m.Chunks, Chunk{Key: cid, Size: int64(len(shard)), ContentKey: s.wrappedKey(cid)})
+	}
+
+	sum := sha256.Sum256(content)
+	meta.ContentChecksum = hex.EncodeToString(sum[:])
+	w, err := s.writeManifest(key, &m, meta)
+	return written + w, err
+}
+
+// placeShard sends the shard stored under cid to peer only
+func (s *Server) placeShard(cid string, shard []byte, peer p2p.Peer) (int64, error) {
+	encryptKey, err := s.replicaKey(cid, shard)
+	if err != nil {
+		return 0, err
+	}
+	return s.replicate([]p2p.Peer{peer}, cid, encryptKey, bytes.NewReader(shard), int64(len(shard)))
+}
+
+func (m *Manifest) encoder() (*erasure.Encoder, error) {
+	return erasure.New(m.DataShards, m.ParityShards)
+}
+
+// readErasure rebuilds the content of the erasure coded m, the
+// shards that could not be read are restored in the background.
+func (s *Server) readErasure(m *Manifest) (io.Reader, error) {
+	enc, err := m.encoder()
+	if err != nil {
+		return nil, err
+	}
+	shards, lost, err := s.readShards(m)
+	if err != nil {
+		return nil, err
+	}
+	s.restoreInBackground(m, shards, lost)
+	buf := new(bytes.Buffer)
+	if err := enc.Join(buf, shards, m.Size); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readShards returns every shard of m. The data shards are fetched
+// first and parity shards only in place of the missing ones, the
+// others are rebuilt. lost are the shards that could not be read.
+func (s *Server) readShards(m *Manifest) ([][]byte, []int, error) {
+	enc, err := m.encoder()
+	if err != nil {
+		return nil, nil, err
+	}
+	peers := s.peerList()
+	shards := make([][]byte, len(m.Chunks))
+	fetch := func(from, to int) {
+		var wg sync.WaitGroup
+		for i := from; i < to; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if data, err := s.readChunk(m.Chunks[i], peers, i); err == nil {
+					shards[i] = data
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	next := min(m.DataShards, len(shards))
+	fetch(0, next)
+	for next < len(shards) {
+		have := 0
+		for _, shard := range shards[:next] {
+			if shard != nil {
+				have++
+			}
+		}
+		if have >= m.DataShards {
+			break
+		}
+		to := min(next+m.DataShards-have, len(shards))
+		fetch(next, to)
+		next = to
+	}
+
+	lost := []int{}
+	for i := range next {
+		if shards[i] == nil {
+			lost = append(lost, i)
+		}
+	}
+	if len(lost) > 0 {
+		if err := enc.Reconstruct(shards); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v of %v shards lost: %w", store.ErrNotFound, len(lost), len(shards), err)
+		}
+	}
+	return shards, lost, nil
+}
+
+func (s *Server) restoreInBackground(m *Manifest, shards [][]byte, lost []int) {
+	if len(lost) == 0 {
+		return
+	}
+	go func() {
+		if _, err := s.restoreShards(m, shards, lost); err != nil {
+			log.Printf("server (%v) failed to restore %v shards: %v\n", s.store.Root, len(lost), err)
+		}
+	}()
+}
+
+// RepairShards checks that a peer still holds each shard of the
+// erasure coded key and re-encodes the missing ones, it returns
+// the number of shards restored.
+func (s *Server) RepairShards(key string) (int, error) {
+	m, err := s.manifest(key)
+	if err != nil {
+		return 0, err
+	}
+	if m == nil || m.DataShards == 0 {
+		return 0, fmt.Errorf("%v is not erasure coded", key)
+	}
+	enc, err := m.encoder()
+	if err != nil {
+		return 0, err
+	}
+	peers := s.peerList()
+	shards := make([][]byte, len(m.Chunks))
+	lost := []int{}
+	for i, c := range m.Chunks {
+		data, err := s.fetchChunk(c, peers, i)
+		if err != nil {
+			lost = append(lost, i)
+			continue
+		}
+		shards[i] = data
+	}
+	if len(lost) == 0 {
+		return 0, nil
+	}
+	if err := enc.Reconstruct(shards); err != nil {
+		return 0, fmt.Errorf("%w: %v of %v shards lost: %w", store.ErrNotFound, len(lost), len(shards), err)
+	}
+	return s.restoreShards(m, shards, lost)
+}
+
+// RepairAllShards runs RepairShards on every local erasure coded
+// object and returns the number of shards restored
+func (s *Server) RepairAllShards() (int, error) {
+	restored := 0
+	var errs []error
+	for _, meta := range s.store.Objects(s.id) {
+		if !meta.Manifest || meta.StorageClass != StorageErasure {
+			continue
+		}
+		n, err := s.RepairShards(meta.Key)
+		restored += n
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", meta.Key, err))
+		}
+	}
+	return restored, errors.Join(errs...)
+}
+
+func (s *Server) repairShards() {
+	n, err := s.RepairAllShards()
+	if err != nil {
+		log.Printf("server (%v) failed to repair shards: %v\n", s.store.Root, err)
+	}
+	if n > 0 {
+		log.Printf("server (%v) restored %v shards\n", s.store.Root, n)
+	}
+}
+
+// restoreShards sends the rebuilt lost shards of m back to the peers
+func (s *Server) restoreShards(m *Manifest, shards [][]byte, lost []int) (int, error) {
+	peers := s.writablePeers(s.peerList(), s.replicaSize("", m.ChunkSize))
+	if len(peers) == 0 {
+		return 0, ErrNotEnoughPeers
+	}
+	restored := 0
+	for _, i := range lost {
+		peer := s.shardPeer(m, i, peers)
+		if _, err := s.placeShard(m.Chunks[i].Key, shards[i], peer); err != nil {
+			return restored, err
+		}
+		log.Printf("server (%v) restored shard %v of %v on %v\n", s.store.Root, i, len(shards), peer.RemoteAddr())
+		restored++
+	}
+	return restored, nil
+}
+
+// shardPeer picks the peer to hold shard i of m, one without another
+// shard of m when possible so that losing a node only costs one shard.
+func (s *Server) shardPeer(m *Manifest, i int, peers []p2p.Peer) p2p.Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	holders := map[string]bool{}
+	for j, c := range m.Chunks {
+		if j == i || c.Key == m.Chunks[i].Key {
+			continue
+		}
+		for addr, r := range s.replicas[c.Key] {
+			if !r.lost {
+				holders[addr] = true
+			}
+		}
+	}
+	for _, p := range peers {
+		if !holders[p.RemoteAddr().String()] {
+			return p
+		}
+	}
+	return peers[i%len(peers)]
+}
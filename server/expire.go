@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// DefaultReapInterval is the time between two deletions of the expired objects
+const DefaultReapInterval = time.Minute
+
+// Reap deletes the expired objects of the local store, replicas of
+// other nodes included so they go away even when their owner is
+// offline. The chunks of the expired manifests of this server are
+// deleted with them. It returns the number of objects deleted, an
+// object that cannot be deleted does not hold back the others.
+func (s *Server) Reap() (int, error) {
+	reaped := 0
+	var errs []error
+	for _, meta := range s.store.Expired(time.Now()) {
+		var m *Manifest
+		if meta.Manifest && meta.Id == s.id && !s.keepsChunks(meta) {
+			var err error
+			if m, err = s.loadManifest(meta.Key); err != nil {
+				log.Printf("server (%v) cannot read the chunks of %v: %v\n", s.store.Root, meta.Key, err)
+			}
+		}
+		if err := s.store.Delete(meta.Id, meta.Key); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", meta.Key, err))
+			continue
+		}
+		reaped++
+		if meta.Id == s.id {
+			s.mu.Lock()
+			delete(s.contentKeys, meta.Key)
+			delete(s.replicas, meta.Key)
+			s.mu.Unlock()
+		}
+		if m != nil {
+			if err := s.releaseChunks(m); err != nil {
+				errs = append(errs, fmt.Errorf("chunks of %v: %w", meta.Key, err))
+			}
+		}
+	}
+	return reaped, errors.Join(errs...)
+}
+
+func (s *Server) reap() {
+	n, err := s.Reap()
+	if err != nil {
+		log.Printf("server (%v) failed to delete expired objects: %v\n", s.store.Root, err)
+	}
+	if n > 0 {
+		log.Printf("server (%v) deleted %v expired objects\n", s.store.Root, n)
+	}
+	s.purgeTrash()
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+	"github.com/jun-hf/distributedstorage/p2p"
+)
+
+const (
+	// keyShareId is the store id under which a node
+	// keeps the key shares it holds for its peers
+	keyShareId      = "keyshares"
+	keyShareTimeout = 5 * time.Second
+)
+
+// BackupKey splits the server's encryption key into one share per
+// connected peer with Shamir secret sharing, any k of them rebuild
+// the key. Each share is sealed to the exchange key of its peer.
+func (s *Server) BackupKey(k int) error {
+	type holder struct {
+		peer        p2p.Peer
+		exchangeKey []byte
+	}
+	holders := []holder{}
+	for _, peer := range s.peerList() {
+		id, ok := s.peerId(peer.RemoteAddr().String())
+		if !ok {
+			log.Printf("server (%v) skipping unidentified peer %v\n", s.store.Root, peer.RemoteAddr())
+			continue
+		}
+		s.authMu.Lock()
+		exchangeKey := s.exchangeKeys[id]
+		s.authMu.Unlock()
+		holders = append(holders, holder{peer, exchangeKey})
+	}
+	if k > len(holders) {
+		return fmt.Errorf("server (%v) needs %v identified peers to back up the key, has %v", s.store.Root, k, len(holders))
+	}
+
+	shares, err := cryto.Split(s.nodeKey(), len(holders), k)
+	if err != nil {
+		return err
+	}
+	for i, h := range holders {
+		// the threshold travels with the share so the recovery knows when to stop
+		sealed, err := cryto.SealTo(h.exchangeKey, append([]byte{byte(k)}, shares[i]...))
+		if err != nil {
+			return err
+		}
+		msg := &Message{
+			Payload: MessageKeyShare{
+				Id:    s.id,
+				Share: sealed,
+			},
+		}
+		if err := s.sendTo([]p2p.Peer{h.peer}, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecoverKey asks the peers for the shares made by BackupKey and
+// replaces the server's encryption key with the rebuilt one. The
+// server must use the same PrivateKey as when the key was backed up.
+func (s *Server) RecoverKey() error {
+	shares := [][]byte{}
+	threshold := 0
+	for _, peer := range s.peerList() {
+		share, k, err := s.requestKeyShare(peer)
+		if err != nil {
+			log.Printf("server (%v) no key share from %v: %v\n", s.store.Root, peer.RemoteAddr(), err)
+			continue
+		}
+		shares = append(shares, share)
+		threshold = k
+		if len(shares) >= threshold {
+			break
+		}
+	}
+	if threshold == 0 || len(shares) < threshold {
+		return fmt.Errorf("server (%v) got %v key shares, needs %v", s.store.Root, len(shares), threshold)
+	}
+	key, err := cryto.Combine(shares)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.encryptKey = key
+	s.mu.Unlock()
+	return nil
+}
+
+// nodeKey returns the encryption key of the server,
+// RecoverKey may replace it at any time
+func (s *Server) nodeKey() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.encryptKey
+}
+
+func (s *Server) requestKeyShare(peer p2p.Peer) ([]byte, int, error) {
+	requestId := cryto.UUID()
+	msg := &Message{
+		Payload: MessageRecoverKey{
+			Id:        s.id,
+			RequestId: requestId,
+		},
+	}
+	payload, err := s.request(peer, requestId, msg, keyShareTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, ok := payload.(MessageKeyShareResponse)
+	if !ok {
+		return nil, 0, fmt.Errorf("unexpected response %T", payload)
+	}
+	if len(resp.Err) > 0 {
+		return nil, 0, fmt.Errorf("%v", resp.Err)
+	}
+	share, err := cryto.OpenSealed(s.exchangeKey, resp.Share)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(share) < 2 {
+		return nil, 0, cryto.ErrInvalidShares
+	}
+	return share[1:], int(share[0]), nil
+}
+
+// handleMessageKeyShare keeps the share of the sender's key together
+// with the sender's public key, only that key can ask for it back.
+func (s *Server) handleMessageKeyShare(m MessageKeyShare, sender string) error {
+	if m.Id != sender {
+		return fmt.Errorf("%w: %v sent a key share for %v", ErrNotAuthorized, sender, m.Id)
+	}
+	s.authMu.Lock()
+	pub := s.keyring[sender]
+	s.authMu.Unlock()
+	data := append(append([]byte{}, pub...), m.Share...)
+	_, err := s.store.Write(keyShareId, m.Id, bytes.NewReader(data))
+	return err
+}
+
+func (s *Server) handleMessageRecoverKey(m MessageRecoverKey, from, sender string) error {
+	peer, err := s.getPeer(from)
+	if err != nil {
+		return err
+	}
+	resp := MessageKeyShareResponse{RequestId: m.RequestId}
+	share, err := s.keyShareFor(m.Id, sender)
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	resp.Share = share
+	return s.sendTo([]p2p.Peer{peer}, &Message{Payload: resp})
+}
+
+// keyShareFor opens the share held for owner and seals it
+// to the exchange key of sender, which must be the owner.
+func (s *Server) keyShareFor(owner, sender string) ([]byte, error) {
+	if owner != sender {
+		return nil, fmt.Errorf("%w: %v asked for the key share of %v", ErrNotAuthorized, sender, owner)
+	}
+	if !s.store.Has(keyShareId, owner) {
+		return nil, fmt.Errorf("server (%v) holds no key share for %v", s.store.Root, owner)
+	}
+	r, err := s.store.Read(keyShareId, owner)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < ed25519.PublicKeySize {
+		return nil, cryto.ErrInvalidShares
+	}
+
+	s.authMu.Lock()
+	pub, exchangeKey := s.keyring[sender], s.exchangeKeys[sender]
+	s.authMu.Unlock()
+	if !pub.Equal(ed25519.PublicKey(data[:ed25519.PublicKeySize])) {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownSender, sender)
+	}
+	share, err := cryto.OpenSealed(s.exchangeKey, data[ed25519.PublicKeySize:])
+	if err != nil {
+		return nil, err
+	}
+	return cryto.SealTo(exchangeKey, share)
+}
+
+func (s *Server) handleMessageKeyShareResponse(m MessageKeyShareResponse) error {
+	return s.resolve(m.RequestId, m)
+}
+
+// peerId returns the node id of the peer at addr once
+// it has sent a message
+func (s *Server) peerId(addr string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.peerIds[addr]
+	return id, ok
+}
+
+func (s *Server) setPeerId(addr, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peerIds[addr] = id
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+// DefaultLifecycleInterval is the time between two runs of the lifecycle rules
+const DefaultLifecycleInterval = time.Hour
+
+// ApplyLifecycle moves the local objects that were not read for the
+// time of their rule to the cold tier, see ServerOpts.Lifecycle.
+// Reading them brings them back to the hot tier.
+func (s *Server) ApplyLifecycle() (store.LifecycleReport, error) {
+	return s.store.ApplyLifecycle(time.Now())
+}
+
+func (s *Server) applyLifecycle() {
+	report, err := s.ApplyLifecycle()
+	if err != nil && !errors.Is(err, store.ErrNoColdTier) {
+		log.Printf("server (%v) lifecycle failed: %v\n", s.store.Root, err)
+	}
+	if report.Objects > 0 {
+		log.Printf("server (%v) moved %v objects to the cold tier, %v bytes stored in %v\n", s.store.Root, report.Objects, report.Bytes, report.Stored)
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+	"github.com/jun-hf/distributedstorage/p2p"
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+const listTimeout = 5 * time.Second
+
+// listPageBytes bounds the sealed names sent in one
+// MessageListKeysResponse, well below p2p.MaxMessageSize
+var listPageBytes = p2p.MaxMessageSize / 2
+
+// ErrPartialList is returned by ListCluster with the keys
+// it could list when some of the peers could not be listed
+var ErrPartialList = errors.New("some peers could not be listed")
+
+// List returns up to limit keys of the server starting with prefix,
+// in lexical order after cursor. Pass the returned cursor to get
+// the next page, it is empty on the last page.
+func (s *Server) List(prefix, cursor string, limit int) ([]string, string, error) {
+	return s.store.List(s.id, prefix, cursor, limit)
+}
+
+// ListCluster works like List but also includes the keys of the
+// server only left on the peers. The peers only hold the names
+// sealed with the server's key, so they send all of them and the
+// filtering happens here. When some peers cannot be listed the
+// page is built from the others and returned with ErrPartialList.
+func (s *Server) ListCluster(prefix, cursor string, limit int) ([]string, string, error) {
+	names := []string{}
+	for _, meta := range s.store.Objects(s.id) {
+		if len(meta.Name) > 0 && len(meta.Bucket) == 0 {
+			names = append(names, meta.Name)
+		}
+	}
+	errs := []error{}
+	for _, peer := range s.peerList() {
+		peerNames, err := s.listPeer(peer)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", peer.RemoteAddr(), err))
+			continue
+		}
+		names = append(names, peerNames...)
+	}
+	slices.Sort(names)
+	page, next := store.Page(slices.Compact(names), prefix, cursor, limit)
+	if len(errs) > 0 {
+		return page, next, fmt.Errorf("%w: %w", ErrPartialList, errors.Join(errs...))
+	}
+	return page, next, nil
+}
+
+// listPeer returns the names of the keys of the server held by
+// peer, asking for one page after the other
+func (s *Server) listPeer(peer p2p.Peer) ([]string, error) {
+	names := []string{}
+	cursor := ""
+	for {
+		requestId := cryto.UUID()
+		msg := &Message{
+			Payload: MessageListKeys{
+				Id:        s.id,
+				RequestId: requestId,
+				Cursor:    cursor,
+			},
+		}
+		payload, err := s.request(peer, requestId, msg, listTimeout)
+		if err != nil {
+			return nil, err
+		}
+		resp, ok := payload.(MessageListKeysResponse)
+		if !ok {
+			return nil, fmt.Errorf("unexpected response %T", payload)
+		}
+		if len(resp.Err) > 0 {
+			return nil, fmt.Errorf("%v", resp.Err)
+		}
+		names = append(names, s.unsealNames(resp.Names)...)
+		if len(resp.Next) == 0 || resp.Next <= cursor {
+			return names, nil
+		}
+		cursor = resp.Next
+	}
+}
+
+// unsealNames returns the names of the keys outside the buckets
+// among the sealed ones
+func (s *Server) unsealNames(sealedNames [][]byte) []string {
+	names := []string{}
+	for _, sealed := range sealedNames {
+		name, err := cryto.Decrypt(s.nodeKey(), sealed)
+		if err != nil {
+			// sealed with a key this server no longer has
+			continue
+		}
+		if bucket, _ := store.SplitBucketKey(string(name)); len(bucket) > 0 {
+			continue
+		}
+		names = append(names, string(name))
+	}
+	return names
+}
+
+func (s *Server) handleMessageListKeys(m MessageListKeys, from, sender string) error {
+	peer, err := s.getPeer(from)
+	if err != nil {
+		return err
+	}
+	resp := MessageListKeysResponse{RequestId: m.RequestId}
+	if m.Id != sender {
+		resp.Err = fmt.Sprintf("%v: %v cannot list the keys of %v", ErrNotAuthorized, sender, m.Id)
+	} else {
+		resp.Names, resp.Next = s.sealedNames(m.Id, m.Cursor)
+	}
+	return s.sendTo([]p2p.Peer{peer}, &Message{Payload: resp})
+}
+
+// sealedNames returns the sealed names of the objects of id held
+// here after cursor in the order of their keys, as many as fit in
+// listPageBytes, and the cursor of the next page
+func (s *Server) sealedNames(id, cursor string) ([][]byte, string) {
+	objects := s.store.Objects(id)
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	names := [][]byte{}
+	size := 0
+	for _, meta := range objects {
+		if meta.Key <= cursor || len(meta.SealedName) == 0 {
+			continue
+		}
+		if size+len(meta.SealedName) > listPageBytes && len(names) > 0 {
+			return names, cursor
+		}
+		names = append(names, meta.SealedName)
+		size += len(meta.SealedName)
+		cursor = meta.Key
+	}
+	return names, ""
+}
+
+func (s *Server) handleMessageListKeysResponse(m MessageListKeysResponse) error {
+	return s.resolve(m.RequestId, m)
+}
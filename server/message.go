@@ -1,9 +1,18 @@
 package server
 
+import (
+	"time"
+
+	"github.com/jun-hf/distributedstorage/store"
+)
+
 // Message is the only sturct sent across the connections,
-// everything needs to be embeded in Payload field
+// everything needs to be embeded in Payload field.
+// It is signed and wrapped in an Envelope before sending.
 type Message struct {
 	Payload any
+	// Capability is attached when acting on another owner's keys
+	Capability *Capability
 }
 
 // MessageStoreFile is the message sent to peers to
@@ -11,19 +20,153 @@ type Message struct {
 type MessageStoreFile struct {
 	Id string
 	Key  string
-	Size int64
+	// Bucket is the bucket of the object, empty outside of buckets.
+	// Key is the hash of the key made by store.BucketKey.
+	Bucket string
+	Size   int64
+	// Meta is the metadata of the object, the original key
+	// is only in Meta.SealedName, encrypted with the owner's key
+	Meta store.Metadata
+}
+
+// MessageStoreRejected is sent back to the sender of a
+// MessageStoreFile that was not stored, Err tells why
+type MessageStoreRejected struct {
+	Id     string
+	Key    string
+	Bucket string
+	Err    string
 }
 
 // MessageGetFile is the message to get the file
 // with the Key
 type MessageGetFile struct {
-	Key string
-	Id string
+	Key    string
+	Id     string
+	Bucket string
+	// a non zero Length asks for Length bytes at Offset, preceded
+	// by the first Prefix bytes of the file (the IV of a replica),
+	// the offsets of a compressed replica are of its stored bytes
+	Offset int64
+	Length int64
+	Prefix int64
+	// VersionId asks for an older version of the file, whole
+	VersionId string
 }
 
 // MessageDeleteKey is the message send
 // to peer to delete the relevant key and Id
 type MessageDeleteKey struct {
-	Key string 
-	Id string
-}
\ No newline at end of file
+	Key    string
+	Id     string
+	Bucket string
+}
+
+// MessageChallenge asks a peer to prove it still holds
+// the replica by hashing Nonce and a byte range of it
+type MessageChallenge struct {
+	Id     string
+	Key    string
+	Bucket string
+	Nonce  []byte
+	Offset int64
+	Length int64
+}
+
+// MessageChallengeResponse is the answer to MessageChallenge,
+// Err is set when the peer cannot read the replica
+type MessageChallengeResponse struct {
+	Id     string
+	Key    string
+	Nonce  []byte
+	Digest []byte
+	Err    string
+}
+
+// MessageHello is sent to a newly connected peer so
+// it learns the node id and keys of the connection
+type MessageHello struct {
+	// Compressions are the replica encodings the sender
+	// supports, see store.Metadata.ContentEncoding
+	Compressions []string
+}
+
+// MessageKeyShare hands a peer a share of the
+// Id's encryption key, sealed to that peer
+type MessageKeyShare struct {
+	Id    string
+	Share []byte
+}
+
+// MessageRecoverKey asks a peer for the key share of Id
+type MessageRecoverKey struct {
+	Id        string
+	RequestId string
+}
+
+// MessageKeyShareResponse is the answer to MessageRecoverKey,
+// the Share is sealed to the requesting node
+type MessageKeyShareResponse struct {
+	RequestId string
+	Share     []byte
+	Err       string
+}
+
+// MessageListKeys asks a peer for a page of the keys it holds
+// for Id, the ones after Cursor in the order of the peer
+type MessageListKeys struct {
+	Id        string
+	RequestId string
+	Cursor    string
+}
+
+// MessageListKeysResponse is the answer to MessageListKeys, the
+// names are sealed with the owner's key. Next is the cursor of the
+// next page, empty on the last one.
+type MessageListKeysResponse struct {
+	RequestId string
+	Names     [][]byte
+	Next      string
+	Err       string
+}
+
+// MessageStatKey asks a peer for the metadata of Key
+type MessageStatKey struct {
+	Id        string
+	Key       string
+	Bucket    string
+	RequestId string
+}
+
+// MessageStatKeyResponse is the answer to MessageStatKey
+type MessageStatKeyResponse struct {
+	RequestId string
+	Meta      store.Metadata
+	Err       string
+}
+
+// MessagePruneVersions asks the peers to prune the older versions
+// of Key like the owner did, see Server.PruneVersions
+type MessagePruneVersions struct {
+	Id     string
+	Key    string
+	Bucket string
+	Keep   int
+	MaxAge time.Duration
+}
+
+// MessageUndelete asks the peers to move their replica
+// of Key back from the trash, see Server.Undelete
+type MessageUndelete struct {
+	Id     string
+	Key    string
+	Bucket string
+}
+
+// MessageCapacity advertises the free space of the sender so
+// its peers stop sending it replicas it has no room for
+type MessageCapacity struct {
+	// Available is what the sender still accepts, -1 when unknown
+	Available int64
+	ReadOnly  bool
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	mrand "math/rand/v2"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+	"github.com/jun-hf/distributedstorage/p2p"
+)
+
+const (
+	// DefaultChallenges is the number of challenges kept per replica
+	DefaultChallenges = 8
+	challengeLength   = 4096
+	challengeTimeout  = 5 * time.Second
+)
+
+// ErrNoChallenges is returned by Verify for the replicas whose
+// challenges are all used, Repair sends them with new ones
+var ErrNoChallenges = errors.New("no challenges left")
+
+// challenge is a precomputed proof of storage, the peer holding the
+// replica must answer sha256(Nonce | replica[Offset:Offset+Length]).
+type challenge struct {
+	Nonce  []byte
+	Offset int64
+	Length int64
+	Digest []byte
+}
+
+// replica is a copy of an object stored on a peer
+type replica struct {
+	challenges []challenge
+	lost       bool
+}
+
+// challengeWriter computes the challenges of a replica
+// while it is being streamed to the peers.
+type challengeWriter struct {
+	offset  int64
+	pending []challenge
+	hashes  []hash.Hash
+}
+
+func newChallengeWriter(size int64, count int) *challengeWriter {
+	w := &challengeWriter{}
+	length := min(int64(challengeLength), size)
+	if length == 0 {
+		return w
+	}
+	for range count {
+		nonce := make([]byte, nonceSize)
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			continue
+		}
+		h := sha256.New()
+		h.Write(nonce)
+		w.pending = append(w.pending, challenge{
+			Nonce:  nonce,
+			Offset: mrand.Int64N(size - length + 1),
+			Length: length,
+		})
+		w.hashes = append(w.hashes, h)
+	}
+	return w
+}
+
+func (w *challengeWriter) Write(p []byte) (int, error) {
+	start, end := w.offset, w.offset+int64(len(p))
+	for i, c := range w.pending {
+		lo, hi := max(c.Offset, start), min(c.Offset+c.Length, end)
+		if lo < hi {
+			w.hashes[i].Write(p[lo-start : hi-start])
+		}
+	}
+	w.offset = end
+	return len(p), nil
+}
+
+// challenges returns the challenges fully covered by the written data
+func (w *challengeWriter) challenges() []challenge {
+	done := []challenge{}
+	for i, c := range w.pending {
+		if w.offset < c.Offset+c.Length {
+			continue
+		}
+		c.Digest = w.hashes[i].Sum(nil)
+		done = append(done, c)
+	}
+	return done
+}
+
+func proofDigest(nonce []byte, r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	h.Write(nonce)
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// trackReplicas keeps the challenges computed while streaming key
+// to peers. Every peer gets its own, so that the answers of a peer
+// cannot be replayed for another.
+func (s *Server) trackReplicas(key string, peers []p2p.Peer, challenges []challenge) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replicas[key] == nil {
+		s.replicas[key] = make(map[string]*replica)
+	}
+	for i, p := range peers {
+		if r := s.rejected[cryto.Hash(key)]; r != nil {
+			if _, ok := r.peers[p.RemoteAddr().String()]; ok {
+				continue
+			}
+		}
+		r := &replica{}
+		for j := i; j < len(challenges); j += len(peers) {
+			r.challenges = append(r.challenges, challenges[j])
+		}
+		s.replicas[key][p.RemoteAddr().String()] = r
+	}
+}
+
+// Verify challenges every peer holding a replica of key and
+// returns the peers that failed, they are marked as lost.
+// Each challenge is used once, the replicas without any left
+// are reported with ErrNoChallenges until Repair issues new ones.
+func (s *Server) Verify(key string) ([]string, error) {
+	type check struct {
+		addr string
+		c    challenge
+	}
+	checks := []check{}
+	exhausted := []string{}
+	s.mu.Lock()
+	replicas, ok := s.replicas[key]
+	for addr, r := range replicas {
+		if r.lost {
+			continue
+		}
+		if len(r.challenges) == 0 {
+			exhausted = append(exhausted, addr)
+			continue
+		}
+		checks = append(checks, check{addr, r.challenges[0]})
+		r.challenges = r.challenges[1:]
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("server (%v) has no replicas of %v", s.store.Root, key)
+	}
+
+	lost := []string{}
+	for _, ch := range checks {
+		if err := s.challengePeer(key, ch.addr, ch.c); err != nil {
+			log.Printf("server (%v) replica of %v on %v lost: %v\n", s.store.Root, key, ch.addr, err)
+			s.mu.Lock()
+			replicas[ch.addr].lost = true
+			s.mu.Unlock()
+			lost = append(lost, ch.addr)
+		}
+	}
+	if len(exhausted) > 0 {
+		return lost, fmt.Errorf("%w: %v on %v", ErrNoChallenges, key, exhausted)
+	}
+	return lost, nil
+}
+
+func (s *Server) challengePeer(key, addr string, c challenge) error {
+	peer, err := s.getPeer(addr)
+	if err != nil {
+		return err
+	}
+	bucket, remote := peerKey(key)
+	msg := &Message{
+		Payload: MessageChallenge{
+			Id:     s.id,
+			Key:    remote,
+			Bucket: bucket,
+			Nonce:  c.Nonce,
+			Offset: c.Offset,
+			Length: c.Length,
+		},
+	}
+	payload, err := s.request(peer, hex.EncodeToString(c.Nonce), msg, challengeTimeout)
+	if err != nil {
+		return err
+	}
+	resp, ok := payload.(MessageChallengeResponse)
+	if !ok {
+		return fmt.Errorf("unexpected response %T", payload)
+	}
+	if len(resp.Err) > 0 {
+		return fmt.Errorf("%v", resp.Err)
+	}
+	if !hmac.Equal(resp.Digest, c.Digest) {
+		return fmt.Errorf("invalid proof")
+	}
+	return nil
+}
+
+// LostReplicas returns the peers whose replica of key failed a challenge
+func (s *Server) LostReplicas(key string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	lost := []string{}
+	for addr, r := range s.replicas[key] {
+		if r.lost {
+			lost = append(lost, addr)
+		}
+	}
+	return lost
+}
+
+// unchallenged returns the peers whose replica of key has no challenge left
+func (s *Server) unchallenged(key string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs := []string{}
+	for addr, r := range s.replicas[key] {
+		if !r.lost && len(r.challenges) == 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Repair sends key again to the peers that lost their replica and
+// to the ones whose challenges are used up, with new challenges
+func (s *Server) Repair(key string) (int64, error) {
+	peers := []p2p.Peer{}
+	for _, addr := range append(s.LostReplicas(key), s.unchallenged(key)...) {
+		peer, err := s.getPeer(addr)
+		if err != nil {
+			log.Printf("server (%v) cannot repair %v on %v: %v\n", s.store.Root, key, addr, err)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return s.replicateStored(key, peers)
+}
+
+// replicateStored sends the stored key to peers with new challenges
+func (s *Server) replicateStored(key string, peers []p2p.Peer) (int64, error) {
+	if len(peers) == 0 {
+		return 0, nil
+	}
+	n, err := s.store.FileSize(s.id, key)
+	if err != nil {
+		return 0, err
+	}
+	r, err := s.store.Peek(s.id, key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	encryptKey, err := s.decryptKey(key)
+	if err != nil {
+		return 0, err
+	}
+	return s.replicate(peers, key, encryptKey, r, n)
+}
+
+func (s *Server) handleMessageChallenge(m MessageChallenge, from string) error {
+	peer, err := s.getPeer(from)
+	if err != nil {
+		return err
+	}
+	resp := MessageChallengeResponse{
+		Id:    m.Id,
+		Key:   m.Key,
+		Nonce: m.Nonce,
+	}
+	digest, err := s.prove(m)
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	resp.Digest = digest
+	return s.sendTo([]p2p.Peer{peer}, &Message{Payload: resp})
+}
+
+func (s *Server) prove(m MessageChallenge) ([]byte, error) {
+	key, err := peerBucketKey(m.Bucket, m.Key)
+	if err != nil {
+		return nil, err
+	}
+	// a proof is not a read, a cold replica stays cold
+	r, err := s.store.PeekRange(m.Id, key, m.Offset, m.Length)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return proofDigest(m.Nonce, r)
+}
+
+func (s *Server) handleMessageChallengeResponse(m MessageChallengeResponse) error {
+	return s.resolve(hex.EncodeToString(m.Nonce), m)
+}
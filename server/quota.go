@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+	"github.com/jun-hf/distributedstorage/p2p"
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+// SetQuota sets the quota of the owner id on this node,
+// replicas of other nodes included
+func (s *Server) SetQuota(id string, q store.Quota) {
+	s.store.SetQuota(id, q)
+}
+
+// SetNamespaceQuota sets the quota of the namespace ns on this node
+func (s *Server) SetNamespaceQuota(ns string, q store.Quota) {
+	s.store.SetNamespaceQuota(ns, q)
+}
+
+// Usage returns what the owner id stores on this node
+func (s *Server) Usage(id string) store.Usage {
+	return s.store.Usage(id)
+}
+
+// NamespaceUsage returns what the namespace ns stores on this node
+func (s *Server) NamespaceUsage(ns string) store.Usage {
+	return s.store.NamespaceUsage(ns)
+}
+
+// Rejected returns the peers that refused the last replica
+// of key, e.g. over quota, with the reason they gave.
+func (s *Server) Rejected(key string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rejected := map[string]string{}
+	if r := s.rejected[cryto.Hash(key)]; r != nil {
+		for addr, reason := range r.peers {
+			rejected[addr] = reason
+		}
+	}
+	return rejected
+}
+
+const (
+	// rejectWindow is how long after sending a replica
+	// the rejection of the peer is accepted
+	rejectWindow = 10 * time.Minute
+	// maxRejected is the number of keys whose rejections are kept,
+	// the oldest are forgotten first
+	maxRejected = 1024
+)
+
+// rejection are the peers that refused the last replica of a key
+type rejection struct {
+	peers map[string]string
+	at    time.Time
+}
+
+// expectRejections forgets the earlier rejections of the replica remote
+// by peers and lets them reject the one about to be sent
+func (s *Server) expectRejections(remote string, peers []p2p.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, addrs := range s.storing {
+		for addr, until := range addrs {
+			if now.After(until) {
+				delete(addrs, addr)
+			}
+		}
+		if len(addrs) == 0 {
+			delete(s.storing, key)
+		}
+	}
+	if s.storing[remote] == nil {
+		s.storing[remote] = make(map[string]time.Time)
+	}
+	for _, p := range peers {
+		addr := p.RemoteAddr().String()
+		s.storing[remote][addr] = now.Add(rejectWindow)
+		if r := s.rejected[remote]; r != nil {
+			delete(r.peers, addr)
+		}
+	}
+}
+
+// reject tells the sender of m that its replica was not stored
+func (s *Server) reject(peer p2p.Peer, m MessageStoreFile, err error) {
+	msg := &Message{
+		Payload: MessageStoreRejected{
+			Id:     m.Id,
+			Key:    m.Key,
+			Bucket: m.Bucket,
+			Err:    err.Error(),
+		},
+	}
+	if err := s.sendTo([]p2p.Peer{peer}, msg); err != nil {
+		log.Printf("server (%v) failed to reject %v: %v\n", s.store.Root, m.Key, err)
+		return
+	}
+	if spaceError(err) {
+		// so the sender stops choosing this node
+		s.advertiseCapacity(peer)
+	}
+}
+
+// handleMessageStoreRejected records the rejection of a replica,
+// only in reply to one sent to that peer, see expectRejections
+func (s *Server) handleMessageStoreRejected(m MessageStoreRejected, from string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.storing[m.Key][from]
+	if !ok || time.Now().After(until) || m.Id != s.id {
+		return fmt.Errorf("server (%v) unexpected rejection of %v from %v", s.store.Root, m.Key, from)
+	}
+	delete(s.storing[m.Key], from)
+	log.Printf("server (%v) replica %v rejected by %v: %v\n", s.store.Root, m.Key, from, m.Err)
+	r := s.rejected[m.Key]
+	if r == nil {
+		if len(s.rejected) >= maxRejected {
+			s.forgetOldestRejection()
+		}
+		r = &rejection{peers: make(map[string]string)}
+		s.rejected[m.Key] = r
+	}
+	r.peers[from] = m.Err
+	r.at = time.Now()
+	// the rejection may arrive after the replica was tracked
+	for key, replicas := range s.replicas {
+		if cryto.Hash(key) == m.Key {
+			delete(replicas, from)
+		}
+	}
+	return nil
+}
+
+// forgetOldestRejection drops the rejections of the key rejected
+// the longest ago, s.mu must be held
+func (s *Server) forgetOldestRejection() {
+	oldest := ""
+	for key, r := range s.rejected {
+		if len(oldest) == 0 || r.at.Before(s.rejected[oldest].at) {
+			oldest = key
+		}
+	}
+	delete(s.rejected, oldest)
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+	"github.com/jun-hf/distributedstorage/p2p"
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+// ReadRange returns length bytes of key starting at offset. A key not
+// stored locally is read from a peer without fetching the whole object.
+// Only the chunks of a chunked object are verified, a range of a whole
+// object is returned as stored since it cannot be checked on its own.
+func (s *Server) ReadRange(key string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range %v+%v", offset, length)
+	}
+	m, err := s.manifest(key)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		o := s.openChunked(m)
+		if _, err := o.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(o, length), o}, nil
+	}
+	if s.store.Has(s.id, key) {
+		return s.store.ReadRange(s.id, key, offset, length)
+	}
+	if length == 0 {
+		// a zero length would ask a peer for the whole replica
+		if _, err := s.stat(key); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	data, err := s.readRemoteRange(key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Open returns a seekable handle on key, a key not stored locally
+// is read from the peers range by range as the handle is read. It is
+// verified like ReadRange, chunk by chunk for a chunked object only.
+func (s *Server) Open(key string) (io.ReadSeekCloser, error) {
+	meta, err := s.stat(key)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Manifest {
+		m, err := s.loadManifest(key)
+		if err != nil {
+			return nil, err
+		}
+		return s.openChunked(m), nil
+	}
+	if s.store.Has(s.id, key) {
+		return s.store.Open(s.id, key)
+	}
+	return &remoteObject{s: s, key: key, size: meta.Size}, nil
+}
+
+func (s *Server) readRemoteRange(key string, offset, length int64) ([]byte, error) {
+	data, replica, err := s.remoteRange(key, offset, length)
+	if err != nil || replica == nil {
+		return data, err
+	}
+	return replica.readRange(offset, length)
+}
+
+// readPeerRange is fetchRange decoding a compressed replica
+func (s *Server) readPeerRange(peer p2p.Peer, key string, offset, length int64) ([]byte, error) {
+	data, encoding, err := s.fetchRange(peer, key, offset, length)
+	if err != nil || len(encoding) == 0 {
+		return data, err
+	}
+	replica := &compressedReplica{s: s, peer: peer, key: key, encoding: encoding}
+	return replica.readRange(offset, length)
+}
+
+// remoteRange reads length bytes of key at offset from the first peer
+// with a replica, or returns the compressed replica of the peer that
+// has one, its content is then decoded from the start
+func (s *Server) remoteRange(key string, offset, length int64) ([]byte, *compressedReplica, error) {
+	for _, peer := range s.peerList() {
+		data, encoding, err := s.fetchRange(peer, key, offset, length)
+		if err != nil {
+			if !errors.Is(err, store.ErrNotFound) {
+				log.Printf("server (%v) range of %v from %v failed: %v\n", s.store.Root, key, peer.RemoteAddr(), err)
+			}
+			continue
+		}
+		if len(encoding) > 0 {
+			return nil, &compressedReplica{s: s, peer: peer, key: key, encoding: encoding}, nil
+		}
+		return data, nil, nil
+	}
+	return nil, nil, fmt.Errorf("%w: %v", store.ErrNotFound, key)
+}
+
+// fetchRange reads length bytes of key at offset from the replica on
+// peer. The replica IV comes along with the range so the ciphertext
+// can be decrypted from the middle of the stream. The offsets of a
+// compressed replica are not the ones of its content, only its
+// encoding is returned for it.
+func (s *Server) fetchRange(peer p2p.Peer, key string, offset, length int64) ([]byte, string, error) {
+	prefix := s.replicaSize(key, 0)
+	data, encoding, err := s.fetchStored(peer, key, prefix, prefix+offset, length)
+	if err != nil || len(encoding) > 0 {
+		return nil, encoding, err
+	}
+	if s.encryption(key) == EncryptionClient {
+		return data, "", nil
+	}
+	if int64(len(data)) < prefix {
+		return nil, "", fmt.Errorf("short replica of %v from %v", key, peer.RemoteAddr())
+	}
+	decryptKey, err := s.decryptKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := cryto.NewDecryptReader(decryptKey, data[:prefix], offset, bytes.NewReader(data[prefix:]))
+	if err != nil {
+		return nil, "", err
+	}
+	data, err = io.ReadAll(r)
+	return data, "", err
+}
+
+// fetchStored reads the first prefix bytes of the replica of key on
+// peer followed by length bytes at offset, as they are stored, and
+// returns them with the encoding of the replica
+func (s *Server) fetchStored(peer p2p.Peer, key string, prefix, offset, length int64) ([]byte, string, error) {
+	lock := s.streamLock(peer)
+	lock.Lock()
+	defer lock.Unlock()
+	bucket, remote := peerKey(key)
+	msg := &Message{
+		Payload: MessageGetFile{
+			Key:    remote,
+			Id:     s.id,
+			Bucket: bucket,
+			Offset: offset,
+			Length: length,
+			Prefix: prefix,
+		},
+	}
+	if err := s.sendTo([]p2p.Peer{peer}, msg); err != nil {
+		return nil, "", err
+	}
+	if err := peer.WaitStream(streamTimeout); err != nil {
+		return nil, "", err
+	}
+	defer peer.Done()
+	size, encoding, err := readStreamHeader(peer)
+	if err != nil {
+		return nil, "", err
+	}
+	if size < 0 {
+		return nil, "", store.ErrNotFound
+	}
+	if size > prefix+length {
+		// never allocate more than what was asked
+		io.Copy(io.Discard, io.LimitReader(peer, size))
+		return nil, "", fmt.Errorf("server (%v) got %v bytes of %v from %v, asked for %v", s.store.Root, size, key, peer.RemoteAddr(), prefix+length)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(peer, data); err != nil {
+		return nil, "", err
+	}
+	return data, encoding, nil
+}
+
+// storedWindow is how much of a compressed replica is fetched at a
+// time while its content is decoded
+const storedWindow = 1 << 20
+
+// compressedReplica is the replica of key on peer compressed with
+// encoding, its content can only be decoded from the start
+type compressedReplica struct {
+	s        *Server
+	peer     p2p.Peer
+	key      string
+	encoding string
+}
+
+// open returns the content of the replica decoded as it is read,
+// its stored bytes fetched window by window
+func (c *compressedReplica) open() (io.ReadCloser, error) {
+	return c.s.decodeReplica(c.key, c.encoding, &storedReader{c: c})
+}
+
+// readRange returns length bytes of the content at offset, the
+// content before offset is decoded and skipped
+func (c *compressedReplica) readRange(offset, length int64) ([]byte, error) {
+	r, err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(r, length))
+}
+
+// storedReader reads the stored bytes of a compressed replica
+type storedReader struct {
+	c   *compressedReplica
+	pos int64
+	buf []byte
+	eof bool
+}
+
+func (r *storedReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		data, _, err := r.c.s.fetchStored(r.c.peer, r.c.key, 0, r.pos, storedWindow)
+		if err != nil {
+			return 0, err
+		}
+		r.pos += int64(len(data))
+		r.buf, r.eof = data, len(data) < storedWindow
+		if len(data) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// streamLock returns the lock held while a stream is read from peer,
+// only one stream can be read from a connection at a time.
+func (s *Server) streamLock(peer p2p.Peer) *sync.Mutex {
+	addr := peer.RemoteAddr().String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lock, ok := s.streams[addr]
+	if !ok {
+		lock = new(sync.Mutex)
+		s.streams[addr] = lock
+	}
+	return lock
+}
+
+// remoteObject reads an object stored on the peers with ranged
+// reads, each Read is a round trip to a peer. A compressed replica is
+// decoded as a stream instead, seeking forward skips its content and
+// seeking backward decodes it again from the start.
+type remoteObject struct {
+	s    *Server
+	key  string
+	size int64
+	pos  int64
+	// replica is the compressed replica read once a peer sent one,
+	// content is its decoded content, at contentPos
+	replica    *compressedReplica
+	content    io.ReadCloser
+	contentPos int64
+}
+
+func (o *remoteObject) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	length := min(int64(len(p)), o.size-o.pos)
+	if o.replica == nil {
+		data, replica, err := o.s.remoteRange(o.key, o.pos, length)
+		if err != nil {
+			return 0, err
+		}
+		if replica == nil {
+			n := copy(p, data)
+			o.pos += int64(n)
+			if n == 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return n, nil
+		}
+		o.replica = replica
+	}
+	return o.readContent(p[:length])
+}
+
+func (o *remoteObject) readContent(p []byte) (int, error) {
+	if o.content != nil && o.contentPos > o.pos {
+		o.content.Close()
+		o.content = nil
+	}
+	if o.content == nil {
+		content, err := o.replica.open()
+		if err != nil {
+			return 0, err
+		}
+		o.content, o.contentPos = content, 0
+	}
+	if o.pos > o.contentPos {
+		n, err := io.CopyN(io.Discard, o.content, o.pos-o.contentPos)
+		o.contentPos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := o.content.Read(p)
+	o.contentPos += int64(n)
+	o.pos += int64(n)
+	if n == 0 && err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (o *remoteObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("invalid whence %v", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %v", offset)
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *remoteObject) Close() error {
+	if o.content == nil {
+		return nil
+	}
+	err := o.content.Close()
+	o.content = nil
+	return err
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+// ScrubReport is the outcome of a Scrub
+type ScrubReport struct {
+	store.ScrubReport
+	// Repaired are the keys of the corrupt objects fetched back from a peer
+	Repaired []string
+	// Lost are the keys of the corrupt objects no peer could send back
+	Lost []string
+}
+
+// ScrubMetrics are the totals of the scrubs since the server started
+type ScrubMetrics struct {
+	Runs     int64
+	Objects  int64
+	Bytes    int64
+	Corrupt  int64
+	Repaired int64
+	Lost     int64
+	LastRun  time.Time
+}
+
+// Scrub checks every local object against its checksum at the
+// ScrubBandwidth of the server. The corrupt objects are quarantined
+// and fetched back from a peer holding an intact copy.
+func (s *Server) Scrub() (ScrubReport, error) {
+	s.scrubMu.Lock()
+	defer s.scrubMu.Unlock()
+	checked, err := s.store.Scrub(s.scrubBandwidth, s.quitCh)
+	report := ScrubReport{ScrubReport: checked}
+	for _, meta := range checked.Corrupt {
+		if err := s.restore(meta); err != nil {
+			log.Printf("server (%v) failed to repair %v: %v\n", s.store.Root, meta.Key, err)
+			report.Lost = append(report.Lost, meta.Key)
+			continue
+		}
+		log.Printf("server (%v) repaired %v\n", s.store.Root, meta.Key)
+		report.Repaired = append(report.Repaired, meta.Key)
+	}
+
+	s.lastScrub = report
+	m := &s.scrubMetrics
+	m.Runs++
+	m.Objects += int64(report.Objects)
+	m.Bytes += report.Bytes
+	m.Corrupt += int64(len(report.Corrupt))
+	m.Repaired += int64(len(report.Repaired))
+	m.Lost += int64(len(report.Lost))
+	m.LastRun = report.Finished
+	return report, err
+}
+
+// LastScrub returns the report of the last Scrub
+func (s *Server) LastScrub() ScrubReport {
+	s.scrubMu.Lock()
+	defer s.scrubMu.Unlock()
+	return s.lastScrub
+}
+
+// ScrubMetrics returns the totals of the scrubs run so far
+func (s *Server) ScrubMetrics() ScrubMetrics {
+	s.scrubMu.Lock()
+	defer s.scrubMu.Unlock()
+	return s.scrubMetrics
+}
+
+func (s *Server) scrub() {
+	if _, err := s.Scrub(); err != nil && !errors.Is(err, store.ErrScrubStopped) {
+		log.Printf("server (%v) scrub failed: %v\n", s.store.Root, err)
+	}
+}
+
+// restore fetches the object described by meta back from a peer with
+// an intact copy and keeps its metadata. The objects of this server
+// are decrypted, the replicas of other nodes are stored as sent.
+func (s *Server) restore(meta store.Metadata) error {
+	id, key := meta.Id, meta.Key
+	bucket, remote := store.SplitBucketKey(key)
+	write := func(r io.Reader, encoding string) error {
+		_, err := s.store.WriteMeta(id, key, meta, r)
+		return err
+	}
+	if id == s.id {
+		bucket, remote = peerKey(key)
+		write = func(r io.Reader, encoding string) error {
+			_, err := s.writeFromPeer(key, meta, r, encoding)
+			return err
+		}
+	}
+	msg := MessageGetFile{Id: id, Key: remote, Bucket: bucket}
+	stat, discard := s.store.Stat, s.store.Discard
+	if !meta.Archived.IsZero() {
+		// an older version of key
+		msg.VersionId = meta.VersionId
+		if id != s.id {
+			write = func(r io.Reader, encoding string) error {
+				_, err := s.store.WriteVersion(id, key, meta, r)
+				return err
+			}
+		}
+		stat = func(id, key string) (store.Metadata, error) {
+			return s.store.StatVersion(id, key, meta.VersionId)
+		}
+		discard = func(id, key string) error {
+			return s.store.DeleteVersion(id, key, meta.VersionId)
+		}
+	}
+	for _, peer := range s.peerList() {
+		if err := s.fetch(peer, msg, write); err != nil {
+			continue
+		}
+		if got, err := stat(id, key); err == nil && got.Checksum == meta.Checksum {
+			return nil
+		}
+		discard(id, key)
+	}
+	return fmt.Errorf("%w: no intact copy of %v", store.ErrNotFound, key)
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"bytes"
-	"encoding/binary"
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,38 +24,261 @@ type ServerOpts struct {
 	Root              string
 	OutboundServer    []string
 	TransformPathFunc store.TransformPathFunc
+	// Id is the hex of the public key of PrivateKey, the peers
+	// reject the messages of a node whose id is another one
 	Id string
+	// PreEncrypted is set when the clients encrypt the data before
+	// calling Store (see cryto.EncryptWithPassphrase). The server then
+	// stores and streams the data to the peers as it is.
+	PreEncrypted bool
+	// Convergent encrypts the replicas with a key derived from the
+	// content (see cryto.ConvergentKey) so identical objects produce
+	// identical replicas across the cluster.
+	Convergent bool
+	// PrivateKey is the node key used to sign the messages, a new
+	// one is generated when empty. Keep it to keep the node identity.
+	PrivateKey ed25519.PrivateKey
+	// Backend is where the objects are kept, the files under Root when nil
+	Backend store.Backend
+	// Roots spreads the objects over the directories of several disks
+	// with a store.MultiBackend and its Placement, see AddDisk
+	Roots     []string
+	Placement string
+	// Challenges is the number of proof of storage challenges
+	// kept per replica, DefaultChallenges when zero.
+	Challenges int
+	// ContentAddressed stores objects under the identifier of their
+	// content with Put, Store with a caller chosen key is refused.
+	ContentAddressed bool
+	// ChunkSize splits the objects in chunks of ChunkSize bytes stored
+	// and replicated on their own, see Manifest. Zero keeps them whole.
+	ChunkSize int64
+	// Dedup keeps the local objects as content-defined chunks stored
+	// once on disk, see store.StoreOpts.Dedup and DedupStats
+	Dedup bool
+	// StorageClass is the storage class of the objects stored without
+	// one in PutOptions, StorageReplicated by default.
+	StorageClass string
+	// DataShards and ParityShards shape the objects of StorageErasure,
+	// DefaultDataShards and DefaultParityShards when zero.
+	DataShards   int
+	ParityShards int
+	// RepairInterval is the time between two repairs of the shards of
+	// the erasure coded objects, DefaultRepairInterval when zero and
+	// never when negative, see RepairAllShards
+	RepairInterval time.Duration
+	// ScrubInterval is the time between two scrubs of the local
+	// objects, see Scrub. Zero disables the background scrubs.
+	ScrubInterval time.Duration
+	// ScrubBandwidth is the most bytes per second a scrub reads,
+	// zero for no limit.
+	ScrubBandwidth int64
+	// ReapInterval is the time between two deletions of the expired
+	// objects, DefaultReapInterval when zero and never when negative.
+	ReapInterval time.Duration
+	// OwnerQuota and NamespaceQuota limit what each owner and each
+	// namespace stores on this node, see SetQuota and SetNamespaceQuota
+	OwnerQuota     store.Quota
+	NamespaceQuota store.Quota
+	// Reserve is the free disk space in bytes the node keeps, it turns
+	// read-only when there is no more, see ReadOnly
+	Reserve int64
+	// CapacityInterval is the time between two advertisements of the
+	// free space to the peers, DefaultCapacityInterval when zero and
+	// only on connection when negative
+	CapacityInterval time.Duration
+	// ColdRoot or ColdBackend is the cold tier the Lifecycle rules move
+	// the objects not read for a while to, see ApplyLifecycle.
+	// ColdCompression compresses them there, e.g. store.CompressionFlate.
+	ColdRoot        string
+	ColdBackend     store.Backend
+	ColdCompression string
+	Lifecycle       []store.LifecycleRule
+	// LifecycleInterval is the time between two runs of the Lifecycle
+	// rules, DefaultLifecycleInterval when zero
+	LifecycleInterval time.Duration
+	// Compression compresses the objects stored without one in
+	// PutOptions or their bucket, store.CompressionGzip or
+	// store.CompressionFlate. The replicas are sent compressed to the
+	// peers supporting it, see MessageHello.
+	Compression string
+	// Versioning are the namespaces whose objects keep their older
+	// versions, see SetVersioning
+	Versioning []string
+	// TrashRetention keeps the deleted objects in the trash of each
+	// node for that long before they are purged with the expired
+	// objects, see Undelete. Zero deletes them at once.
+	TrashRetention time.Duration
 }
 
 type Server struct {
-	transport      p2p.Transport
-	store          *store.Store
-	quitCh         chan struct{}
-	outboundServer []string
-	encryptKey     []byte
+	transport         p2p.Transport
+	store             *store.Store
+	quitCh            chan struct{}
+	outboundServer    []string
+	encryptKey        []byte
 	id string
+	preEncrypted      bool
+	convergent        bool
+	contentAddressed  bool
+	chunkSize         int64
+	storageClass      string
+	dataShards        int
+	parityShards      int
+	scrubInterval     time.Duration
+	scrubBandwidth    int64
+	reapInterval      time.Duration
+	repairInterval    time.Duration
+	capacityInterval  time.Duration
+	lifecycleInterval time.Duration
+	compression       string
 
 	mu    sync.RWMutex
 	peers map[string]p2p.Peer
+	// contentKeys holds the wrapped convergent key of each key
+	contentKeys map[string][]byte
+
+	privateKey   ed25519.PrivateKey
+	exchangeKey  *ecdh.PrivateKey
+	authMu       sync.Mutex
+	keyring      map[string]ed25519.PublicKey
+	exchangeKeys map[string][]byte
+	nonces       map[string]time.Time
+	// peerIds maps the address of a peer to its node id
+	peerIds map[string]string
+
+	// pending holds the requests waiting for a response
+	pending  map[string]chan any
+	replicas map[string]map[string]*replica
+	// rejected holds the peers that refused a replica, by replica key
+	rejected map[string]*rejection
+	// storing holds until when a peer may reject a replica sent to
+	// it, by replica key and peer address
+	storing map[string]map[string]time.Time
+	// capacities holds the free space advertised by each peer
+	capacities map[string]PeerCapacity
+	// compressions holds the compressions supported by each peer
+	compressions   map[string][]string
+	challengeCount int
+	// streams serializes the streams read from each peer
+	streams map[string]*sync.Mutex
+
+	refMu sync.Mutex
+	// chunkRefs counts the local manifests using each chunk
+	chunkRefs map[string]int
+
+	scrubMu      sync.Mutex
+	lastScrub    ScrubReport
+	scrubMetrics ScrubMetrics
+
+	bucketMu sync.RWMutex
+	buckets  map[string]BucketConfig
 }
 
-func New(opts ServerOpts) *Server {
-	store := store.New(store.StoreOpts{
+func New(opts ServerOpts) (*Server, error) {
+	store, err := store.New(store.StoreOpts{
 		TransformPathFunc: opts.TransformPathFunc,
 		Root:              opts.Root,
+		Backend:           opts.Backend,
+		Roots:             opts.Roots,
+		Placement:         opts.Placement,
+		Dedup:             opts.Dedup,
+		OwnerQuota:        opts.OwnerQuota,
+		NamespaceQuota:    opts.NamespaceQuota,
+		Reserve:           opts.Reserve,
+		ColdRoot:          opts.ColdRoot,
+		ColdBackend:       opts.ColdBackend,
+		ColdCompression:   opts.ColdCompression,
+		Lifecycle:         opts.Lifecycle,
+		TrashRetention:    opts.TrashRetention,
 	})
-	if len(opts.Id) == 0 {
-		opts.Id = cryto.UUID()
-	}
-	return &Server{
-		transport:      opts.Transport,
-		store:          store,
-		quitCh:         make(chan struct{}),
-		outboundServer: opts.OutboundServer,
-		encryptKey:     cryto.New(),
-		peers:          make(map[string]p2p.Peer),
+	if err != nil {
+		return nil, err
+	}
+	if opts.PrivateKey == nil {
+		_, opts.PrivateKey, _ = ed25519.GenerateKey(nil)
+	}
+	if opts.Challenges == 0 {
+		opts.Challenges = DefaultChallenges
+	}
+	if opts.ReapInterval == 0 {
+		opts.ReapInterval = DefaultReapInterval
+	}
+	if opts.RepairInterval == 0 {
+		opts.RepairInterval = DefaultRepairInterval
+	}
+	if opts.CapacityInterval == 0 {
+		opts.CapacityInterval = DefaultCapacityInterval
+	}
+	if opts.LifecycleInterval == 0 {
+		opts.LifecycleInterval = DefaultLifecycleInterval
+	}
+	if opts.DataShards == 0 {
+		opts.DataShards = DefaultDataShards
+	}
+	if opts.ParityShards == 0 {
+		opts.ParityShards = DefaultParityShards
+	}
+	// the peers only accept messages from the node whose key is its id
+	if id := hex.EncodeToString(opts.PrivateKey.Public().(ed25519.PublicKey)); opts.Id != id {
+		if len(opts.Id) > 0 {
+			log.Printf("server (%v) id %v is not the one of its PrivateKey, using %v\n", opts.Root, opts.Id, id)
+		}
+		opts.Id = id
+	}
+	// cannot fail, the seed is always hashed to a valid X25519 key
+	exchangeKey, _ := cryto.ExchangeKey(opts.PrivateKey.Seed())
+	s := &Server{
+		transport:         opts.Transport,
+		store:             store,
+		quitCh:            make(chan struct{}),
+		outboundServer:    opts.OutboundServer,
+		encryptKey:        cryto.New(),
+		peers:             make(map[string]p2p.Peer),
 		id: opts.Id,
+		preEncrypted:      opts.PreEncrypted,
+		convergent:        opts.Convergent,
+		contentAddressed:  opts.ContentAddressed,
+		chunkSize:         opts.ChunkSize,
+		storageClass:      opts.StorageClass,
+		dataShards:        opts.DataShards,
+		parityShards:      opts.ParityShards,
+		scrubInterval:     opts.ScrubInterval,
+		scrubBandwidth:    opts.ScrubBandwidth,
+		reapInterval:      opts.ReapInterval,
+		repairInterval:    opts.RepairInterval,
+		capacityInterval:  opts.CapacityInterval,
+		lifecycleInterval: opts.LifecycleInterval,
+		compression:       opts.Compression,
+		contentKeys:       make(map[string][]byte),
+		privateKey:        opts.PrivateKey,
+		exchangeKey:       exchangeKey,
+		keyring:           make(map[string]ed25519.PublicKey),
+		exchangeKeys:      make(map[string][]byte),
+		nonces:            make(map[string]time.Time),
+		peerIds:           make(map[string]string),
+		pending:           make(map[string]chan any),
+		replicas:          make(map[string]map[string]*replica),
+		rejected:          make(map[string]*rejection),
+		storing:           make(map[string]map[string]time.Time),
+		capacities:        make(map[string]PeerCapacity),
+		compressions:      make(map[string][]string),
+		challengeCount:    opts.Challenges,
+		streams:           make(map[string]*sync.Mutex),
+		buckets:           make(map[string]BucketConfig),
+	}
+	for _, ns := range opts.Versioning {
+		s.store.SetVersioning(ns, true)
+	}
+	if err := s.loadKeyring(); err != nil {
+		log.Printf("server (%v) %v\n", s.store.Root, err)
 	}
+	if err := s.loadBuckets(); err != nil {
+		log.Printf("server (%v) %v\n", s.store.Root, err)
+	}
+	s.countChunks()
+	s.watchDisks()
+	return s, nil
 }
 
 func (s *Server) Start() error {
@@ -59,91 +286,357 @@ func (s *Server) Start() error {
 		return err
 	}
 	go s.process()
+	if s.scrubInterval > 0 {
+		go s.every(s.scrubInterval, s.scrub)
+	}
+	if s.reapInterval > 0 {
+		go s.every(s.reapInterval, s.reap)
+	}
+	if s.repairInterval > 0 {
+		go s.every(s.repairInterval, s.repairShards)
+	}
+	if s.capacityInterval > 0 {
+		go s.every(s.capacityInterval, func() { s.advertiseCapacity(s.peerList()...) })
+	}
+	if len(s.store.Lifecycle) > 0 && s.lifecycleInterval > 0 {
+		go s.every(s.lifecycleInterval, s.applyLifecycle)
+	}
 	return s.dial()
 }
 
 func (s *Server) Delete(key string) error {
-	if !s.store.Has(s.id, key) {
+	meta, err := s.store.Stat(s.id, key)
+	if err != nil {
 		return fmt.Errorf("%+v does not exists", key)
 	}
-	
-	err := s.store.Delete(s.id, key)
+	m, err := s.manifest(key)
+	if err != nil {
+		return err
+	}
+	if s.keepsChunks(meta) {
+		m = nil
+	}
+
+	err = s.store.Delete(s.id, key)
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	if !s.keepsChunks(meta) {
+		// the object is gone for good
+		delete(s.contentKeys, key)
+	}
+	delete(s.replicas, key)
+	s.mu.Unlock()
 
+	bucket, remote := peerKey(key)
 	msg := &Message{
 		Payload: MessageDeleteKey{
-			Key: cryto.Hash(key),
-			Id: s.id,
+			Key:    remote,
+			Id:     s.id,
+			Bucket: bucket,
 		},
 	}
-	return s.broadcast(msg)
+	if err := s.broadcast(msg); err != nil {
+		return err
+	}
+	if m != nil {
+		return s.releaseChunks(m)
+	}
+	return nil
 }
 
-func (s *Server) Read(key string) (io.Reader, error) {
+// Read returns the content of key, the caller closes the reader
+// to stop the fetches of a chunked object it does not read to the end
+func (s *Server) Read(key string) (io.ReadCloser, error) {
+	m, err := s.manifest(key)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		log.Printf("Getting the %v chunks of key (%v)", len(m.Chunks), key)
+		r, err := s.readObject(m)
+		if err != nil {
+			return nil, err
+		}
+		if s.contentAddressed {
+			return struct {
+				io.Reader
+				io.Closer
+			}{cryto.NewVerifyingReader(key, r), r}, nil
+		}
+		return r, nil
+	}
 	if s.store.Has(s.id, key) {
 		log.Printf("Getting key (%v) from local storage", key)
-		return s.store.Read(s.id, key)
+		r, err := s.readVerified(key)
+		if !errors.Is(err, cryto.ErrDigestMismatch) {
+			return closer(r), err
+		}
+		// the local copy is corrupted, get it back from the peers
+		s.store.Discard(s.id, key)
 	}
-	msg := &Message{
-		Payload: MessageGetFile{
-			Key: cryto.Hash(key),
-			Id: s.id,
-		},
+	for _, peer := range s.peerList() {
+		if err := s.fetchFrom(peer, key); err != nil {
+			log.Printf("server (%v) fetch %v from %v failed: %v", s.store.Root, key, peer.RemoteAddr(), err)
+			continue
+		}
+		log.Printf("Getting key (%v) from remote storage", key)
+		r, err := s.readVerified(key)
+		if errors.Is(err, cryto.ErrDigestMismatch) {
+			// try the next peer for an intact copy
+			s.store.Discard(s.id, key)
+			continue
+		}
+		return closer(r), err
 	}
-	if err := s.broadcast(msg); err != nil {
+	return nil, fmt.Errorf("%w: %v", store.ErrNotFound, key)
+}
+
+// readObject returns the content of the object listed by m
+func (s *Server) readObject(m *Manifest) (io.ReadCloser, error) {
+	if m.DataShards == 0 {
+		return s.readChunks(m), nil
+	}
+	r, err := s.readErasure(m)
+	if err != nil {
 		return nil, err
 	}
+	return io.NopCloser(r), nil
+}
 
-	s.mu.RLock()
-	for _, peer := range s.peers {
-		// Get the fileSize
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
-		if _, err := s.store.WriteDecrypt(s.encryptKey, s.id, key, io.LimitReader(peer, fileSize)); err != nil {
-			return nil, err
-		}
-		log.Printf("Getting key (%v) from remote storage", key)
-		peer.Done()
+// closer returns r with a Close doing nothing, nil when r is nil
+func closer(r io.Reader) io.ReadCloser {
+	if r == nil {
+		return nil
 	}
-	s.mu.RUnlock()
+	return io.NopCloser(r)
+}
+
+// fetchFrom copies key back from peer into the local store
+func (s *Server) fetchFrom(peer p2p.Peer, key string) error {
+	bucket, remote := peerKey(key)
+	msg := MessageGetFile{Key: remote, Id: s.id, Bucket: bucket}
+	return s.fetch(peer, msg, func(r io.Reader, encoding string) error {
+		_, err := s.writeFromPeer(key, store.Metadata{Name: key}, r, encoding)
+		return err
+	})
+}
+
+// fetch streams the object asked by m from peer to write,
+// with the ContentEncoding of the replica
+func (s *Server) fetch(peer p2p.Peer, m MessageGetFile, write func(io.Reader, string) error) error {
+	lock := s.streamLock(peer)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := s.sendTo([]p2p.Peer{peer}, &Message{Payload: m}); err != nil {
+		return err
+	}
+	if err := peer.WaitStream(streamTimeout); err != nil {
+		return err
+	}
+	defer peer.Done()
+	// Get the fileSize
+	fileSize, encoding, err := readStreamHeader(peer)
+	if err != nil {
+		return err
+	}
+	if fileSize < 0 {
+		return store.ErrNotFound
+	}
+	return write(newExactReader(peer, fileSize), encoding)
+}
+
+// DeleteWith deletes key owned by another node from the peers,
+// c must be a Capability for ActionDelete granted to this server.
+func (s *Server) DeleteWith(c Capability, key string) error {
+	bucket, remote := peerKey(key)
+	msg := &Message{
+		Payload: MessageDeleteKey{
+			Key:    remote,
+			Id:     c.Owner,
+			Bucket: bucket,
+		},
+		Capability: &c,
+	}
+	return s.broadcast(msg)
+}
 
-	return s.store.Read(s.id, key)
+// PutOptions are the optional attributes of a stored object
+type PutOptions struct {
+	ContentType string
+	// Headers are user-defined attributes, e.g. the original filename
+	Headers map[string]string
+	// StorageClass overrides ServerOpts.StorageClass for the object
+	StorageClass string
+	// TTL is how long the object is kept, forever when zero.
+	// Expires sets the time it is deleted instead.
+	TTL     time.Duration
+	Expires time.Time
+	// Namespace counts the object in the quota of the namespace
+	Namespace string
+	// Compression overrides ServerOpts.Compression for the object
+	Compression string
 }
 
 // Store the content to the server and also the peers's server
 // will return the amount of success store inclusive of the
 // success store in the own server.
 func (s *Server) Store(key string, data io.Reader) (int64, error) {
-	succWrite := int64(0)
-	dataBuff := new(bytes.Buffer)
-	tee := io.TeeReader(data, dataBuff)
-	n, err := s.store.Write(s.id, key, tee)
+	return s.StoreWithOptions(key, data, PutOptions{})
+}
+
+// StoreWithOptions works like Store and keeps the attributes
+// in opts in the object metadata, see Stat.
+func (s *Server) StoreWithOptions(key string, data io.Reader, opts PutOptions) (int64, error) {
+	if s.contentAddressed {
+		return 0, ErrContentAddressed
+	}
+	if strings.Contains(key, "\x00") {
+		// reserved for the keys of the buckets, see Bucket
+		return 0, fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	if strings.Contains(opts.Namespace, "\x00") {
+		// reserved for the buckets too, see bucketNamespace
+		return 0, fmt.Errorf("%w: %q", ErrInvalidNamespace, opts.Namespace)
+	}
+	return s.storeObject(key, data, opts.metadata(key))
+}
+
+func (opts PutOptions) metadata(key string) store.Metadata {
+	var expires *time.Time
+	if opts.TTL > 0 {
+		t := time.Now().Add(opts.TTL)
+		expires = &t
+	} else if !opts.Expires.IsZero() {
+		expires = &opts.Expires
+	}
+	return store.Metadata{
+		Name:         key,
+		ContentType:  opts.ContentType,
+		Headers:      opts.Headers,
+		StorageClass: opts.StorageClass,
+		Expires:      expires,
+		Namespace:    opts.Namespace,
+		Compression:  opts.Compression,
+	}
+}
+
+// storeObject stores data under key according to its storage class,
+// split in chunks when the server has a ChunkSize.
+func (s *Server) storeObject(key string, data io.Reader, meta store.Metadata) (int64, error) {
+	if len(meta.StorageClass) == 0 {
+		meta.StorageClass = s.storageClass
+	}
+	if len(meta.Compression) == 0 {
+		meta.Compression = s.compressionOf(key)
+	}
+	switch meta.StorageClass {
+	case StorageErasure:
+		return s.storeErasure(key, data, meta)
+	case StorageReplicated:
+	default:
+		return 0, fmt.Errorf("unknown storage class %q", meta.StorageClass)
+	}
+	if s.chunkSize > 0 {
+		return s.storeChunked(key, data, meta)
+	}
+	return s.writeObject(key, data, meta)
+}
+
+// writeObject stores data under key as one object and replicates it
+func (s *Server) writeObject(key string, data io.Reader, meta store.Metadata) (int64, error) {
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return 0, err
+	}
+	// the content key is kept with the object to read the
+	// replicas back after a restart
+	encryptKey, err := s.replicaKey(key, content)
 	if err != nil {
 		return 0, err
 	}
-	succWrite++
+	meta.ContentKey = s.wrappedKey(key)
+	n, err := s.store.WriteMeta(s.id, key, meta, bytes.NewReader(content))
+	if err != nil {
+		return 0, err
+	}
+	return s.replicate(s.replicaPeers(key, s.replicaSize(key, n)), key, encryptKey, bytes.NewReader(content), n)
+}
 
+// replicate sends the n bytes of r stored under key to peers, compressed
+// like the local object, and keeps challenges to verify the replicas.
+func (s *Server) replicate(peers []p2p.Peer, key string, encryptKey []byte, r io.ReadSeeker, n int64) (int64, error) {
+	meta, err := s.replicaMeta(key)
+	if err != nil {
+		return 0, err
+	}
+	content, encoded, encoding, err := s.encode(peers, meta.ContentEncoding, r, n)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+	meta.ContentEncoding = encoding
+	if len(encoding) > 0 {
+		meta.ContentSize = n
+	}
+	size := s.replicaSize(key, encoded)
+	bucket, remote := peerKey(key)
 	msg := &Message{
 		Payload: MessageStoreFile{
-			Id: s.id,
-			Key:  cryto.Hash(key),
-			Size: n + 16,
+			Id:     s.id,
+			Key:    remote,
+			Bucket: bucket,
+			Size:   size,
+			Meta:   meta,
 		},
 	}
-	if err := s.broadcast(msg); err != nil {
-		return succWrite, err
+	s.expectRejections(remote, peers)
+	if err := s.sendTo(peers, msg); err != nil {
+		return 0, err
+	}
+	proofs := newChallengeWriter(size, s.challengeCount*len(peers))
+	written, err := s.writeStream(peers, key, encryptKey, content, proofs)
+	if err != nil {
+		return written, err
 	}
-	time.Sleep(500 * time.Millisecond)
-	return s.writeStream(dataBuff)
+	s.trackReplicas(key, peers, proofs.challenges())
+	return written, nil
 }
 
-func (s *Server) writeStream(r io.Reader) (int64, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// replicaMeta is the metadata of key sent to the peers, without
+// what the peer computes itself and with the name and the
+// attributes sealed.
+func (s *Server) replicaMeta(key string) (store.Metadata, error) {
+	meta, err := s.store.Stat(s.id, key)
+	if errors.Is(err, store.ErrNotFound) {
+		// shards are only kept by the peers
+		meta, err = store.Metadata{}, nil
+	}
+	if err != nil {
+		return store.Metadata{}, err
+	}
+	// unnamed objects like chunks are not listed, keep them that way
+	if len(meta.Name) > 0 {
+		meta.SealedName, err = cryto.Encrypt(s.nodeKey(), []byte(key))
+		if err != nil {
+			return store.Metadata{}, err
+		}
+	}
+	if err := s.sealAttributes(&meta); err != nil {
+		return store.Metadata{}, err
+	}
+	meta.Id, meta.Key, meta.Name, meta.Size, meta.Checksum = "", "", "", 0, ""
+	meta.ContentKey = nil
+	// sent compressed like it is stored when the peers support it,
+	// the peers keep the encrypted stream as it is
+	meta.ContentEncoding, meta.Compression, meta.StoredSize = meta.Compression, "", 0
+	return meta, nil
+}
+
+func (s *Server) writeStream(peers []p2p.Peer, key string, encryptKey []byte, r io.Reader, proofs io.Writer) (int64, error) {
 	peerList := []io.Writer{}
-	for _, p := range s.peers {
+	for _, p := range peers {
 		peerList = append(peerList, p)
 	}
 	mw := io.MultiWriter(peerList...)
@@ -151,42 +644,168 @@ func (s *Server) writeStream(r io.Reader) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	n, err := cryto.CopyEncrypt(s.encryptKey, r, mw)
+	mw = io.MultiWriter(mw, proofs)
+	switch s.encryption(key) {
+	case EncryptionClient:
+		return io.Copy(mw, r)
+	case EncryptionConvergent:
+		n, err := cryto.CopyEncryptConvergent(encryptKey, r, mw)
+		return int64(n), err
+	}
+	n, err := cryto.CopyEncrypt(encryptKey, r, mw)
 	return int64(n), err
 }
 
-func (s *Server) broadcast(m *Message) error {
+// replicaKey returns the key used to encrypt the replicas of key.
+// In convergent mode it is derived from data and kept wrapped
+// with the server's own key.
+func (s *Server) replicaKey(key string, data []byte) ([]byte, error) {
+	if s.encryption(key) != EncryptionConvergent {
+		return s.nodeKey(), nil
+	}
+	contentKey, err := cryto.ConvergentKey(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := cryto.WrapKey(s.nodeKey(), contentKey)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.contentKeys[key] = wrapped
+	s.mu.Unlock()
+	return contentKey, nil
+}
+
+// wrappedKey returns the wrapped convergent key of key, nil
+// when it is not known
+func (s *Server) wrappedKey(key string) []byte {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	return s.contentKeys[key]
+}
 
-	buff := new(bytes.Buffer)
-	if err := gob.NewEncoder(buff).Encode(m); err != nil {
-		return err
+// decryptKey returns the key to decrypt the replicas of key, the
+// convergent keys not known since the start are read from the index
+func (s *Server) decryptKey(key string) ([]byte, error) {
+	if s.encryption(key) != EncryptionConvergent {
+		return s.nodeKey(), nil
 	}
-	for addr, peer := range s.peers {
-		if _, err := peer.Write([]byte{p2p.IncomingMessage}); err != nil {
-			fmt.Printf("Write to %v failed: %v\n", addr, err)
-			continue
+	wrapped := s.wrappedKey(key)
+	if wrapped == nil {
+		meta, err := s.store.Stat(s.id, key)
+		if err != nil || len(meta.ContentKey) == 0 {
+			return nil, fmt.Errorf("server (%v) has no content key for %v", s.store.Root, key)
 		}
-		if _, err := peer.Write(buff.Bytes()); err != nil {
-			fmt.Printf("Write to %v failed: %v\n", addr, err)
+		wrapped = meta.ContentKey
+		s.mu.Lock()
+		s.contentKeys[key] = wrapped
+		s.mu.Unlock()
+	}
+	return cryto.UnwrapKey(s.nodeKey(), wrapped)
+}
+
+// writeFromPeer stores the replica fetched back from a peer with meta,
+// decrypting it unless the data was already encrypted by the client
+// and decompressing it when it was sent with an encoding. An older
+// version is written back among the versions of key.
+func (s *Server) writeFromPeer(key string, meta store.Metadata, r io.Reader, encoding string) (int64, error) {
+	content, err := s.decodeReplica(key, encoding, r)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+	if len(meta.Compression) == 0 {
+		meta.Compression = encoding
+	}
+	if !meta.Archived.IsZero() {
+		return s.store.WriteVersion(s.id, key, meta, content)
+	}
+	return s.store.WriteMeta(s.id, key, meta, content)
+}
+
+// replicaSize is the size of the stream sent to the peers
+// for a n bytes object of key, encryption adds the 16 bytes IV.
+func (s *Server) replicaSize(key string, n int64) int64 {
+	if s.encryption(key) == EncryptionClient {
+		return n
+	}
+	return n + 16
+}
+
+func (s *Server) broadcast(m *Message) error {
+	return s.sendTo(s.peerList(), m)
+}
+
+func (s *Server) sendTo(peers []p2p.Peer, m *Message) error {
+	payload, err := s.seal(m)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if err := p2p.WriteMessage(peer, payload); err != nil {
+			fmt.Printf("Write to %v failed: %v\n", peer.RemoteAddr(), err)
 			continue
 		}
 	}
 	return nil
 }
 
+// request sends m to peer and waits for the payload passed to
+// resolve with the same id, id must be set in m beforehand.
+func (s *Server) request(peer p2p.Peer, id string, m *Message, timeout time.Duration) (any, error) {
+	ch := make(chan any, 1)
+	s.mu.Lock()
+	s.pending[id] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+	}()
+
+	payload, err := s.seal(m)
+	if err != nil {
+		return nil, err
+	}
+	if err := p2p.WriteMessage(peer, payload); err != nil {
+		return nil, err
+	}
+	select {
+	case payload := <-ch:
+		return payload, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("server (%v) request %v to %v timed out", s.store.Root, id, peer.RemoteAddr())
+	}
+}
+
+// resolve hands a response payload to the pending request id
+func (s *Server) resolve(id string, payload any) error {
+	s.mu.RLock()
+	ch, ok := s.pending[id]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("server (%v) got response for unknown request %v", s.store.Root, id)
+	}
+	select {
+	case ch <- payload:
+	default:
+	}
+	return nil
+}
+
 func (s *Server) process() {
 	defer s.cleanUp()
 	for {
 		select {
 		case rpc := <-s.transport.Consume():
-			var msg Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Printf("Server (%v) decode error: %v\n", s.store.Root, err)
+			msg, sender, err := s.open(rpc.Payload)
+			if err != nil {
+				log.Printf("Server (%v) rejected message from %v: %v\n", s.store.Root, rpc.From, err)
 				continue
 			}
-			if err := s.handleMessage(msg, rpc.From); err != nil {
+			s.setPeerId(rpc.From, sender)
+			if err := s.handleMessage(msg, rpc.From, sender); err != nil {
 				log.Printf("Server (%v) handleMessage error: %v\n", s.store.Root, err)
 				continue
 			}
@@ -196,64 +815,189 @@ func (s *Server) process() {
 	}
 }
 
-func (s *Server) handleMessage(m Message, from string) error {
+// every calls fn every interval until the server is closed
+func (s *Server) every(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fn()
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// handleMessage dispatches m received from the peer at
+// address from, sender is the id of the node that signed it.
+func (s *Server) handleMessage(m Message, from, sender string) error {
 	switch payload := m.Payload.(type) {
 	case MessageStoreFile:
-		return s.handleMessageStoreFile(payload, from)
+		return s.handleMessageStoreFile(payload, from, sender, m.Capability)
 	case MessageGetFile:
 		return s.handleMessageGetFile(payload, from)
 	case MessageDeleteKey:
-		return s.handleMessageDelete(payload)
+		return s.handleMessageDelete(payload, sender, m.Capability)
+	case MessageChallenge:
+		return s.handleMessageChallenge(payload, from)
+	case MessageChallengeResponse:
+		return s.handleMessageChallengeResponse(payload)
+	case MessageHello:
+		return s.handleMessageHello(payload, from)
+	case MessageKeyShare:
+		return s.handleMessageKeyShare(payload, sender)
+	case MessageRecoverKey:
+		return s.handleMessageRecoverKey(payload, from, sender)
+	case MessageKeyShareResponse:
+		return s.handleMessageKeyShareResponse(payload)
+	case MessageListKeys:
+		return s.handleMessageListKeys(payload, from, sender)
+	case MessageListKeysResponse:
+		return s.handleMessageListKeysResponse(payload)
+	case MessageStatKey:
+		return s.handleMessageStatKey(payload, from, sender)
+	case MessageStatKeyResponse:
+		return s.handleMessageStatKeyResponse(payload)
+	case MessageStoreRejected:
+		return s.handleMessageStoreRejected(payload, from)
+	case MessageCapacity:
+		return s.handleMessageCapacity(payload, from)
+	case MessagePruneVersions:
+		return s.handleMessagePruneVersions(payload, sender, m.Capability)
+	case MessageUndelete:
+		return s.handleMessageUndelete(payload, sender, m.Capability)
 	default:
 		log.Println("No suitable Payload type")
 		return nil
 	}
 }
 
-func (s *Server) handleMessageDelete(m MessageDeleteKey) error {
-	if !s.store.Has(m.Id, m.Key) {
+func (s *Server) handleMessageDelete(m MessageDeleteKey, sender string, c *Capability) error {
+	if err := s.authorize(sender, m.Id, ActionDelete, m.Key, c); err != nil {
+		return err
+	}
+	key, err := peerBucketKey(m.Bucket, m.Key)
+	if err != nil {
+		return err
+	}
+	if !s.store.Has(m.Id, key) {
 		return fmt.Errorf("server (%v) do not have key: %v", s.store.Root, m.Key)
 	}
 	fmt.Println("Id:", m.Id)
 	fmt.Println("Key:", m.Key)
-	return s.store.Delete(m.Id, m.Key)
+	return s.store.Delete(m.Id, key)
 }
 
 func (s *Server) handleMessageGetFile(m MessageGetFile, from string) error {
-	if !s.store.Has(m.Id, m.Key) {
-		return fmt.Errorf("server (%v) do not have key: %v", s.store.Root, m.Key)
-	}
-
 	p, err := s.getPeer(from)
 	if err != nil {
 		return err
 	}
 
-	size, err := s.store.FileSize(m.Id, m.Key)
+	key, err := peerBucketKey(m.Bucket, m.Key)
 	if err != nil {
 		return err
 	}
+	if len(m.VersionId) > 0 {
+		return s.sendVersion(p, m.Id, key, m.VersionId)
+	}
+	meta, err := s.store.Stat(m.Id, key)
+	if err != nil {
+		// a negative size tells the requester to stop waiting for the stream
+		p.Write([]byte{p2p.IncomingStream})
+		writeStreamHeader(p, -1, "")
+		return fmt.Errorf("server (%v) do not have key: %v", s.store.Root, m.Key)
+	}
 
+	size := meta.Size
+	if m.Length == 0 {
+		p.Write([]byte{p2p.IncomingStream})
+		// Sending the fileSize first after opening up the stream
+		writeStreamHeader(p, size, meta.ContentEncoding)
+		_, err = s.store.CopyRead(m.Id, key, p)
+		return err
+	}
+
+	prefix := min(max(m.Prefix, 0), size)
+	offset := min(max(m.Offset, prefix), size)
+	length := min(max(m.Length, 0), size-offset)
 	p.Write([]byte{p2p.IncomingStream})
-	// Sending the fileSize first after opening up the stream
-	binary.Write(p, binary.LittleEndian, size)
-	_, err = s.store.CopyRead(m.Id, m.Key, p)
+	// the offsets of a compressed replica are the ones of its stored
+	// bytes and not of its content, the encoding tells the requester
+	writeStreamHeader(p, prefix+length, meta.ContentEncoding)
+	for _, r := range [][2]int64{{0, prefix}, {offset, length}} {
+		if err := s.copyRange(p, m.Id, key, r[0], r[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) copyRange(w io.Writer, id, key string, offset, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	r, err := s.store.ReadRange(id, key, offset, length)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer r.Close()
+	_, err = io.CopyN(w, r, length)
+	return err
 }
 
-func (s *Server) handleMessageStoreFile(m MessageStoreFile, from string) error {
+func (s *Server) handleMessageStoreFile(m MessageStoreFile, from, sender string, c *Capability) error {
 	peer, err := s.getPeer(from)
 	if err != nil {
 		return err
 	}
+	// the stream is read aside so that the messages of the
+	// other peers are not held back while it comes
+	go func() {
+		if err := s.receiveFile(peer, m, sender, c); err != nil {
+			log.Printf("Server (%v) handleMessage error: %v\n", s.store.Root, err)
+		}
+	}()
+	return nil
+}
+
+// receiveFile writes the replica streamed after m by peer
+func (s *Server) receiveFile(peer p2p.Peer, m MessageStoreFile, sender string, c *Capability) error {
+	if err := peer.WaitStream(streamTimeout); err != nil {
+		return fmt.Errorf("server (%v) no stream for %v: %w", s.store.Root, m.Key, err)
+	}
 	defer peer.Done()
+	if err := s.authorize(sender, m.Id, ActionWrite, m.Key, c); err != nil {
+		// the stream is still coming, drop it
+		io.Copy(io.Discard, io.LimitReader(peer, m.Size))
+		return err
+	}
+	key, err := peerBucketKey(m.Bucket, m.Key)
+	if err != nil {
+		io.Copy(io.Discard, io.LimitReader(peer, m.Size))
+		return err
+	}
+	// refuse before accepting any data
+	err = s.store.CheckQuota(m.Id, key, m.Meta.Namespace, m.Size)
+	if err == nil {
+		err = s.store.CheckSpace(m.Size)
+	}
+	if err != nil {
+		io.Copy(io.Discard, io.LimitReader(peer, m.Size))
+		s.reject(peer, m, err)
+		return fmt.Errorf("server (%v) rejected %v: %w", s.store.Root, m.Key, err)
+	}
 	fmt.Printf("peer: %v, size: %+v\n", peer.LocalAddr(), m.Size)
-	n, err := s.store.Write(m.Id, m.Key, io.LimitReader(peer, m.Size))
+	r := newExactReader(peer, m.Size)
+	n, err := s.store.WriteMeta(m.Id, key, m.Meta, r)
 	fmt.Println("Done")
 	if err != nil {
+		// drain what is left of the stream
+		io.Copy(io.Discard, r)
+		if errors.Is(err, store.ErrQuotaExceeded) || spaceError(err) {
+			s.reject(peer, m, err)
+		}
 		return fmt.Errorf("server (%v) write failed %v", s.store.Root, err)
 	}
 	log.Printf("server (%v) success store %v bytes\n", s.store.Root, n)
@@ -270,6 +1014,48 @@ func (s *Server) getPeer(from string) (p2p.Peer, error) {
 	return peer, nil
 }
 
+// streamTimeout is how long a stream can take to start
+// after the message announcing it
+const streamTimeout = 30 * time.Second
+
+// exactReader reads exactly n bytes of a peer stream, a stream
+// ending early fails with io.ErrUnexpectedEOF instead of io.EOF
+// so the store does not commit a truncated object.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func newExactReader(r io.Reader, n int64) *exactReader {
+	return &exactReader{r: r, n: n}
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// peerList returns a snapshot of the connected peers
+func (s *Server) peerList() []p2p.Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
 func (s *Server) Close() {
 	close(s.quitCh)
 }
@@ -290,6 +1076,13 @@ func (s *Server) OnPeer(p p2p.Peer) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.peers[p.RemoteAddr().String()] = p
+	go func() {
+		if err := s.sendTo([]p2p.Peer{p}, &Message{Payload: MessageHello{Compressions: store.Compressions()}}); err != nil {
+			log.Printf("server (%v) hello to %v failed: %v\n", s.store.Root, p.RemoteAddr(), err)
+			return
+		}
+		s.advertiseCapacity(p)
+	}()
 	return nil
 }
 
@@ -310,4 +1103,18 @@ func init() {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
 	gob.Register(MessageDeleteKey{})
+	gob.Register(MessageChallenge{})
+	gob.Register(MessageChallengeResponse{})
+	gob.Register(MessageHello{})
+	gob.Register(MessageCapacity{})
+	gob.Register(MessageKeyShare{})
+	gob.Register(MessageRecoverKey{})
+	gob.Register(MessageKeyShareResponse{})
+	gob.Register(MessageListKeys{})
+	gob.Register(MessageListKeysResponse{})
+	gob.Register(MessageStatKey{})
+	gob.Register(MessageStatKeyResponse{})
+	gob.Register(MessageStoreRejected{})
+	gob.Register(MessagePruneVersions{})
+	gob.Register(MessageUndelete{})
 }
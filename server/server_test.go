@@ -1,18 +1,28 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/jun-hf/distributedstorage/cryto"
 	"github.com/jun-hf/distributedstorage/p2p"
 	"github.com/jun-hf/distributedstorage/store"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestServer(t *testing.T) {
-	server8080 := CreateServer(":8080", "8080-dir", []string{})
+	server8080 := CreateServer(":8080", t.TempDir(), []string{})
 	assert.Nil(t, server8080.Start())
 
-	server3030 := CreateServer(":3030", "3030-dir", []string{":8080"})
+	server3030 := CreateServer(":3030", t.TempDir(), []string{":8080"})
 	assert.Nil(t, server3030.Start())
 }
 
@@ -28,7 +38,1266 @@ func CreateServer(listenAddr, root string, outboundServer []string) *Server {
 		OutboundServer:    outboundServer,
 		TransformPathFunc: store.SHA1PathTransformFunc,
 	}
-	s1 := New(serverOpts)
+	s1, err := New(serverOpts)
+	if err != nil {
+		panic(err)
+	}
 	transport.OnPeer = s1.OnPeer
+	transport.OnPeerClose = s1.OnPeerClose
 	return s1
 }
+
+func newServer(t *testing.T, opts ServerOpts) *Server {
+	t.Helper()
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestServerConvergentReplicaKey(t *testing.T) {
+	s := newServer(t, ServerOpts{Root: t.TempDir(), Convergent: true})
+	data := []byte("same content")
+	key, err := s.replicaKey("a", data)
+	assert.Nil(t, err)
+	other, err := s.replicaKey("b", data)
+	assert.Nil(t, err)
+	assert.Equal(t, key, other)
+
+	decryptKey, err := s.decryptKey("a")
+	assert.Nil(t, err)
+	assert.Equal(t, key, decryptKey)
+
+	_, err = s.decryptKey("missing")
+	assert.NotNil(t, err)
+
+	// the content keys are kept in the index across a restart
+	root := t.TempDir()
+	s = newServer(t, ServerOpts{Root: root, Convergent: true})
+	_, err = s.Store("c", bytes.NewReader(data))
+	assert.Nil(t, err)
+	key, err = s.decryptKey("c")
+	assert.Nil(t, err)
+	assert.Nil(t, s.store.Close())
+	restarted := newServer(t, ServerOpts{Root: root, Convergent: true, PrivateKey: s.privateKey})
+	restarted.encryptKey = s.encryptKey
+	decryptKey, err = restarted.decryptKey("c")
+	assert.Nil(t, err)
+	assert.Equal(t, key, decryptKey)
+	meta, err := restarted.replicaMeta("c")
+	assert.Nil(t, err)
+	assert.Nil(t, meta.ContentKey)
+}
+
+func TestServerSignedMessages(t *testing.T) {
+	owner := newServer(t, ServerOpts{Root: t.TempDir()})
+	peerRoot := t.TempDir()
+	peer := newServer(t, ServerOpts{Root: peerRoot})
+	other := newServer(t, ServerOpts{Root: t.TempDir()})
+
+	payload, err := owner.seal(&Message{Payload: MessageDeleteKey{Id: owner.id, Key: "key"}})
+	assert.Nil(t, err)
+	msg, sender, err := peer.open(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, owner.id, sender)
+	assert.Equal(t, MessageDeleteKey{Id: owner.id, Key: "key"}, msg.Payload)
+
+	_, _, err = peer.open(payload)
+	assert.ErrorIs(t, err, ErrReplayedMessage)
+
+	tampered := bytes.Replace(payload, []byte(owner.id), []byte(other.id), 1)
+	_, _, err = peer.open(tampered)
+	assert.NotNil(t, err)
+
+	// other cannot delete the owner's key without a capability
+	assert.ErrorIs(t, peer.authorize(other.id, owner.id, ActionDelete, "key", nil), ErrNotAuthorized)
+	c := owner.Delegate(other.id, ActionDelete, "", time.Minute)
+	assert.Nil(t, peer.authorize(other.id, owner.id, ActionDelete, "key", &c))
+	assert.ErrorIs(t, peer.authorize(other.id, owner.id, ActionWrite, "key", &c), ErrNotAuthorized)
+
+	c.Grantee = peer.id
+	assert.ErrorIs(t, peer.authorize(peer.id, owner.id, ActionDelete, "key", &c), ErrNotAuthorized)
+
+	// a node signing with its own key cannot claim the id of another,
+	// even one the peer has not seen yet
+	spoofer := newServer(t, ServerOpts{Root: t.TempDir()})
+	for _, id := range []string{owner.id, newServer(t, ServerOpts{Root: t.TempDir()}).id} {
+		spoofer.id = id
+		payload, err = spoofer.seal(&Message{Payload: MessageDeleteKey{Id: id, Key: "key"}})
+		assert.Nil(t, err)
+		_, _, err = peer.open(payload)
+		assert.ErrorIs(t, err, ErrUnknownSender)
+	}
+
+	// the pinned keys are kept across a restart
+	restarted := newServer(t, ServerOpts{Root: peerRoot, PrivateKey: peer.privateKey})
+	assert.Equal(t, owner.PublicKey(), restarted.keyring[owner.id])
+	assert.NotEmpty(t, restarted.exchangeKeys[owner.id])
+	c = owner.Delegate(other.id, ActionDelete, "", time.Minute)
+	assert.Nil(t, restarted.authorize(other.id, owner.id, ActionDelete, "key", &c))
+}
+
+func TestServerListPages(t *testing.T) {
+	s := newServer(t, ServerOpts{Root: t.TempDir()})
+	defer func(size int) { listPageBytes = size }(listPageBytes)
+	listPageBytes = 250
+	for i := range 5 {
+		sealed := bytes.Repeat([]byte{byte(i)}, 100)
+		_, err := s.store.WriteMeta("owner", fmt.Sprintf("key%v", i), store.Metadata{SealedName: sealed}, strings.NewReader("data"))
+		assert.Nil(t, err)
+	}
+	pages := [][][]byte{}
+	cursor := ""
+	for {
+		names, next := s.sealedNames("owner", cursor)
+		pages = append(pages, names)
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, 3, len(pages))
+	assert.Equal(t, 2, len(pages[0]))
+	assert.Equal(t, []byte{4}, pages[2][0][:1])
+}
+
+func TestChallengeWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("replica data "), 1000)
+	w := newChallengeWriter(int64(len(data)), 4)
+	// written in small pieces like the encrypted stream
+	for i := 0; i < len(data); i += 100 {
+		w.Write(data[i:min(i+100, len(data))])
+	}
+	challenges := w.challenges()
+	assert.Equal(t, 4, len(challenges))
+	for _, c := range challenges {
+		digest, err := proofDigest(c.Nonce, bytes.NewReader(data[c.Offset:c.Offset+c.Length]))
+		assert.Nil(t, err)
+		assert.Equal(t, c.Digest, digest)
+	}
+}
+
+func TestServerVerifyReplicas(t *testing.T) {
+	origin := CreateServer(":4101", t.TempDir(), []string{})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer := CreateServer(":4102", t.TempDir(), []string{":4101"})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	opts := PutOptions{
+		ContentType: "text/plain",
+		Headers:     map[string]string{"filename": "a.txt"},
+	}
+	_, err := origin.StoreWithOptions("key", bytes.NewReader(bytes.Repeat([]byte("a"), 10000)), opts)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	// the peer only knows the name sealed by the owner
+	meta, err := peer.store.Stat(origin.id, cryto.Hash("key"))
+	assert.Nil(t, err)
+	assert.Empty(t, meta.Name)
+	name, err := cryto.Decrypt(origin.encryptKey, meta.SealedName)
+	assert.Nil(t, err)
+	assert.Equal(t, "key", string(name))
+
+	// and so are its attributes
+	assert.Empty(t, meta.ContentType)
+	assert.Empty(t, meta.Headers)
+	assert.NotEmpty(t, meta.SealedAttributes)
+	local, err := origin.Stat("key")
+	assert.Nil(t, err)
+
+	// keys only left on the peers are still listed
+	assert.Nil(t, origin.store.Delete(origin.id, "key"))
+	remote, err := origin.Stat("key")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10000), remote.Size)
+	assert.Equal(t, local.ContentChecksum, remote.ContentChecksum)
+	assert.Equal(t, "a.txt", remote.Headers["filename"])
+	assert.Equal(t, "text/plain", remote.ContentType)
+	assert.True(t, local.Created.Equal(remote.Created))
+	keys, _, err := origin.List("", "", 10)
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+	keys, _, err = origin.ListCluster("k", "", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"key"}, keys)
+	_, err = origin.Store("key", bytes.NewReader(bytes.Repeat([]byte("a"), 10000)))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	lost, err := origin.Verify("key")
+	assert.Nil(t, err)
+	assert.Empty(t, lost)
+
+	assert.Nil(t, peer.store.Delete(origin.id, cryto.Hash("key")))
+	lost, err = origin.Verify("key")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(lost))
+	assert.Equal(t, lost, origin.LostReplicas("key"))
+
+	_, err = origin.Repair("key")
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, origin.LostReplicas("key"))
+	lost, err = origin.Verify("key")
+	assert.Nil(t, err)
+	assert.Empty(t, lost)
+
+	// a replica is not reported healthy once its challenges are used up
+	for range DefaultChallenges - 1 {
+		_, err = origin.Verify("key")
+		assert.Nil(t, err)
+	}
+	_, err = origin.Verify("key")
+	assert.ErrorIs(t, err, ErrNoChallenges)
+	n, err := origin.Repair("key")
+	assert.Nil(t, err)
+	assert.Greater(t, n, int64(0))
+	time.Sleep(100 * time.Millisecond)
+	lost, err = origin.Verify("key")
+	assert.Nil(t, err)
+	assert.Empty(t, lost)
+}
+
+func TestServerReadRange(t *testing.T) {
+	origin := CreateServer(":4121", t.TempDir(), []string{})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer := CreateServer(":4122", t.TempDir(), []string{":4121"})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	_, err := origin.Store("video", bytes.NewReader(data))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	r, err := origin.ReadRange("video", 100, 50)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, data[100:150], b)
+
+	// served from the encrypted replica without fetching the object
+	assert.Nil(t, origin.store.Delete(origin.id, "video"))
+	r, err = origin.ReadRange("video", 4099, 1000)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(r)
+	assert.Equal(t, data[4099:5099], b)
+	r, err = origin.ReadRange("video", 10, 0)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(r)
+	assert.Empty(t, b)
+	assert.False(t, origin.store.Has(origin.id, "video"))
+
+	f, err := origin.Open("video")
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.Seek(-17, io.SeekEnd)
+	assert.Nil(t, err)
+	b, err = io.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, data[len(data)-17:], b)
+
+	_, err = origin.ReadRange("missing", 0, 10)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestServerBackupKey(t *testing.T) {
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	holder1 := CreateServer(":4111", t.TempDir(), []string{})
+	assert.Nil(t, holder1.Start())
+	defer holder1.Close()
+	holder2 := CreateServer(":4112", t.TempDir(), []string{})
+	assert.Nil(t, holder2.Start())
+	defer holder2.Close()
+
+	origin := createServerWithKey(":4113", t.TempDir(), []string{":4111", ":4112"}, privateKey)
+	assert.Nil(t, origin.Start())
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, origin.BackupKey(2))
+	time.Sleep(100 * time.Millisecond)
+	origin.Close()
+
+	// same identity on a fresh disk
+	restored := createServerWithKey(":4114", t.TempDir(), []string{":4111", ":4112"}, privateKey)
+	assert.Nil(t, restored.Start())
+	defer restored.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.NotEqual(t, origin.encryptKey, restored.encryptKey)
+	assert.Nil(t, restored.RecoverKey())
+	assert.Equal(t, origin.encryptKey, restored.encryptKey)
+
+	// only the owner gets the shares back
+	_, err := holder1.keyShareFor(origin.id, holder2.id)
+	assert.ErrorIs(t, err, ErrNotAuthorized)
+}
+
+func createServerWithKey(listenAddr, root string, outboundServer []string, privateKey ed25519.PrivateKey) *Server {
+	return createServerWithOpts(listenAddr, ServerOpts{
+		Root:           root,
+		OutboundServer: outboundServer,
+		PrivateKey:     privateKey,
+	})
+}
+
+func createServerWithOpts(listenAddr string, opts ServerOpts) *Server {
+	transport := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    listenAddr,
+		HandshakeFunc: p2p.NoHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	opts.Transport = transport
+	opts.TransformPathFunc = store.SHA1PathTransformFunc
+	s, err := New(opts)
+	if err != nil {
+		panic(err)
+	}
+	transport.OnPeer = s.OnPeer
+	transport.OnPeerClose = s.OnPeerClose
+	return s
+}
+
+func TestServerContentAddressed(t *testing.T) {
+	origin := createServerWithOpts(":4131", ServerOpts{Root: t.TempDir(), ContentAddressed: true})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer := createServerWithOpts(":4132", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4131"}})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := origin.Store("key", strings.NewReader("data"))
+	assert.ErrorIs(t, err, ErrContentAddressed)
+	_, err = origin.PutWithOptions(strings.NewReader("data"), PutOptions{Namespace: bucketNamespace("team-a")})
+	assert.ErrorIs(t, err, ErrInvalidNamespace)
+
+	cid, err := origin.Put(strings.NewReader("immutable data"))
+	assert.Nil(t, err)
+	assert.True(t, cryto.IsCID(cid))
+	time.Sleep(100 * time.Millisecond)
+	created, err := origin.Stat(cid)
+	assert.Nil(t, err)
+	again, err := origin.Put(strings.NewReader("immutable data"))
+	assert.Nil(t, err)
+	assert.Equal(t, cid, again)
+	stat, err := origin.Stat(cid)
+	assert.Nil(t, err)
+	assert.True(t, created.Modified.Equal(stat.Modified))
+
+	// a corrupted local copy is detected and read back from the peer
+	_, err = origin.store.Write(origin.id, cid, strings.NewReader("tampered data!"))
+	assert.Nil(t, err)
+	r, err := origin.Read(cid)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, "immutable data", string(b))
+}
+
+func TestServerChunked(t *testing.T) {
+	origin := createServerWithOpts(":4141", ServerOpts{Root: t.TempDir(), ChunkSize: 4096})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer1 := createServerWithOpts(":4142", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4141"}})
+	assert.Nil(t, peer1.Start())
+	defer peer1.Close()
+	peer2 := createServerWithOpts(":4143", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4141"}})
+	assert.Nil(t, peer2.Start())
+	defer peer2.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	_, err := origin.Store("big", bytes.NewReader(data))
+	assert.Nil(t, err)
+	r, err := origin.Read("big")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	// a reader closed before its end stops fetching the chunks
+	r, err = origin.Read("big")
+	assert.Nil(t, err)
+	_, err = io.ReadFull(r, make([]byte, 10))
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	_, err = r.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// chunks are not listed and the size is the size of the content
+	keys, _, err := origin.List("", "", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"big"}, keys)
+	meta, err := origin.Stat("big")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10000), meta.Size)
+
+	// chunks are shared and only deleted with their last manifest
+	_, err = origin.Store("copy", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(origin.store.Objects(origin.id)))
+	assert.Nil(t, origin.Delete("copy"))
+	assert.Equal(t, 4, len(origin.store.Objects(origin.id)))
+	time.Sleep(100 * time.Millisecond)
+
+	// the chunks are read back from both peers
+	assert.Nil(t, origin.store.ClearAll())
+	r, err = origin.Read("big")
+	assert.Nil(t, err)
+	b, err = io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+
+	rr, err := origin.ReadRange("big", 4000, 200)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(rr)
+	assert.Equal(t, data[4000:4200], b)
+
+	f, err := origin.Open("big")
+	assert.Nil(t, err)
+	_, err = f.Seek(-10, io.SeekEnd)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(f)
+	assert.Equal(t, data[len(data)-10:], b)
+}
+
+func TestServerErasure(t *testing.T) {
+	origin := createServerWithOpts(":4151", ServerOpts{
+		Root:         t.TempDir(),
+		StorageClass: StorageErasure,
+		DataShards:   2,
+		ParityShards: 1,
+		// repaired by hand below to count the shards
+		RepairInterval: -1,
+	})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peers := []*Server{}
+	for _, addr := range []string{":4152", ":4153", ":4154"} {
+		peer := createServerWithOpts(addr, ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4151"}})
+		assert.Nil(t, peer.Start())
+		defer peer.Close()
+		peers = append(peers, peer)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	data := make([]byte, 10001)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	_, err := origin.Store("coded", bytes.NewReader(data))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	// only the manifest is kept locally
+	assert.Equal(t, 1, len(origin.store.Objects(origin.id)))
+	meta, err := origin.Stat("coded")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10001), meta.Size)
+	assert.Equal(t, StorageErasure, meta.StorageClass)
+
+	m, err := origin.manifest("coded")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(m.Chunks))
+	holder := func(cid string) *Server {
+		for _, p := range peers {
+			if p.store.Has(origin.id, cryto.Hash(cid)) {
+				return p
+			}
+		}
+		return nil
+	}
+	for _, c := range m.Chunks {
+		assert.NotNil(t, holder(c.Key))
+	}
+
+	// a lost data shard is rebuilt from the parity shard
+	lost := holder(m.Chunks[0].Key)
+	assert.Nil(t, lost.store.Delete(origin.id, cryto.Hash(m.Chunks[0].Key)))
+	r, err := origin.Read("coded")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+
+	// and restored on a peer in the background
+	for i := 0; i < 20 && holder(m.Chunks[0].Key) == nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.NotNil(t, holder(m.Chunks[0].Key))
+	n, err := origin.RepairShards("coded")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// the shards of a whole peer are lost
+	dropped := 0
+	gone := holder(m.Chunks[1].Key)
+	for _, c := range m.Chunks {
+		if gone.store.Has(origin.id, cryto.Hash(c.Key)) {
+			assert.Nil(t, gone.store.Delete(origin.id, cryto.Hash(c.Key)))
+			dropped++
+		}
+	}
+	n, err = origin.RepairShards("coded")
+	assert.Nil(t, err)
+	assert.Equal(t, dropped, n)
+	time.Sleep(100 * time.Millisecond)
+	for _, c := range m.Chunks {
+		assert.NotNil(t, holder(c.Key))
+	}
+	rr, err := origin.ReadRange("coded", 9000, 1001)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(rr)
+	assert.Equal(t, data[9000:], b)
+	r, err = origin.Read("coded")
+	assert.Nil(t, err)
+	b, err = io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+
+	// the background repair restores the shards without a read
+	assert.Nil(t, holder(m.Chunks[0].Key).store.Delete(origin.id, cryto.Hash(m.Chunks[0].Key)))
+	go origin.every(50*time.Millisecond, origin.repairShards)
+	for i := 0; i < 20 && holder(m.Chunks[0].Key) == nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.NotNil(t, holder(m.Chunks[0].Key))
+
+	// the peers only know the origin
+	_, err = peers[0].StoreWithOptions("other", bytes.NewReader(data), PutOptions{StorageClass: StorageErasure})
+	assert.ErrorIs(t, err, ErrNotEnoughPeers)
+}
+
+func TestServerScrub(t *testing.T) {
+	origin := createServerWithOpts(":4161", ServerOpts{Root: t.TempDir()})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer1 := createServerWithOpts(":4162", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4161"}})
+	assert.Nil(t, peer1.Start())
+	defer peer1.Close()
+	peer2 := createServerWithOpts(":4163", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4161", ":4162"}})
+	assert.Nil(t, peer2.Start())
+	defer peer2.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	data := []byte("data that rots on disk")
+	_, err := origin.StoreWithOptions("key", bytes.NewReader(data), PutOptions{ContentType: "text/plain"})
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	rot := func(s *Server, id, key string) {
+		p := path.Join(id, store.SHA1PathTransformFunc(key).FilePath())
+		_, err := s.store.Backend.Put(p, strings.NewReader("rotten"))
+		assert.Nil(t, err)
+	}
+
+	// the local copy is fetched back from a peer with its metadata
+	rot(origin, origin.id, "key")
+	report, err := origin.Scrub()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"key"}, report.Repaired)
+	r, err := origin.Read("key")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, data, b)
+	meta, err := origin.Stat("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain", meta.ContentType)
+
+	// a replica is fetched back from another peer as it was
+	replica, err := peer1.store.Stat(origin.id, cryto.Hash("key"))
+	assert.Nil(t, err)
+	rot(peer1, origin.id, cryto.Hash("key"))
+	report, err = peer1.Scrub()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{cryto.Hash("key")}, report.Repaired)
+	restored, err := peer1.store.Stat(origin.id, cryto.Hash("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, replica.Checksum, restored.Checksum)
+	assert.Equal(t, replica.SealedName, restored.SealedName)
+
+	metrics := peer1.ScrubMetrics()
+	assert.Equal(t, int64(1), metrics.Runs)
+	assert.Equal(t, int64(1), metrics.Repaired)
+	assert.Equal(t, report.Finished, peer1.LastScrub().Finished)
+}
+
+func TestServerExpiry(t *testing.T) {
+	origin := createServerWithOpts(":4171", ServerOpts{Root: t.TempDir(), ReapInterval: -1})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer := createServerWithOpts(":4172", ServerOpts{
+		Root:           t.TempDir(),
+		OutboundServer: []string{":4171"},
+		ReapInterval:   50 * time.Millisecond,
+	})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := origin.StoreWithOptions("cache", strings.NewReader("artifact"), PutOptions{TTL: 200 * time.Millisecond})
+	assert.Nil(t, err)
+	_, err = origin.Store("keep", strings.NewReader("data"))
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	meta, err := origin.Stat("cache")
+	assert.Nil(t, err)
+	assert.NotNil(t, meta.Expires)
+	replica, err := peer.store.Stat(origin.id, cryto.Hash("cache"))
+	assert.Nil(t, err)
+	assert.True(t, meta.Expires.Equal(*replica.Expires))
+
+	time.Sleep(250 * time.Millisecond)
+	_, err = origin.Read("cache")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	keys, _, err := origin.List("", "", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"keep"}, keys)
+
+	// the peer deleted its replica on its own
+	assert.Empty(t, peer.store.Expired(time.Now()))
+	assert.Equal(t, 1, len(peer.store.Objects(origin.id)))
+	n, err := origin.Reap()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestServerReapAfterRestart(t *testing.T) {
+	root := t.TempDir()
+	s := newServer(t, ServerOpts{Root: root, ChunkSize: 4096, ReapInterval: -1})
+	_, err := s.StoreWithOptions("short", strings.NewReader("shared content"), PutOptions{TTL: 100 * time.Millisecond})
+	assert.Nil(t, err)
+	_, err = s.Store("long", strings.NewReader("shared content"))
+	assert.Nil(t, err)
+	assert.Nil(t, s.store.Close())
+	time.Sleep(150 * time.Millisecond)
+
+	// the expired manifest not reaped yet still counts for its chunks
+	restarted := newServer(t, ServerOpts{Root: root, ChunkSize: 4096, ReapInterval: -1, PrivateKey: s.privateKey})
+	restarted.encryptKey = s.encryptKey
+	n, err := restarted.Reap()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	r, err := restarted.Read("long")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "shared content", string(data))
+}
+
+func TestServerQuota(t *testing.T) {
+	origin := createServerWithOpts(":4181", ServerOpts{Root: t.TempDir()})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	// room for one replica of 10 bytes and its IV
+	peer := createServerWithOpts(":4182", ServerOpts{
+		Root:           t.TempDir(),
+		OutboundServer: []string{":4181"},
+		OwnerQuota:     store.Quota{Bytes: 40},
+	})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := origin.Store("a", strings.NewReader("0123456789"))
+	assert.Nil(t, err)
+	_, err = origin.Store("b", strings.NewReader("0123456789"))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, store.Usage{Bytes: 26, Objects: 1}, peer.Usage(origin.id))
+	assert.Empty(t, origin.Rejected("a"))
+	rejected := origin.Rejected("b")
+	assert.Equal(t, 1, len(rejected))
+	for _, reason := range rejected {
+		assert.Contains(t, reason, "quota exceeded")
+	}
+	assert.Empty(t, origin.LostReplicas("b"))
+
+	// the stream of the rejected replica did not break the next ones
+	peer.SetQuota(origin.id, store.Quota{})
+	_, err = origin.Store("c", strings.NewReader("0123456789"))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, peer.store.Has(origin.id, cryto.Hash("c")))
+	assert.Empty(t, origin.Rejected("c"))
+
+	// a rejection of a replica that was never sent is ignored
+	reject := &Message{Payload: MessageStoreRejected{Id: origin.id, Key: cryto.Hash("never"), Err: "quota exceeded"}}
+	assert.Nil(t, peer.sendTo(peer.peerList(), reject))
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, origin.Rejected("never"))
+
+	origin.SetNamespaceQuota("tmp", store.Quota{Objects: 1})
+	_, err = origin.StoreWithOptions("d", strings.NewReader("data"), PutOptions{Namespace: "tmp"})
+	assert.Nil(t, err)
+	_, err = origin.StoreWithOptions("e", strings.NewReader("data"), PutOptions{Namespace: "tmp"})
+	assert.ErrorIs(t, err, store.ErrQuotaExceeded)
+	assert.Equal(t, store.Usage{Bytes: 4, Objects: 1}, origin.NamespaceUsage("tmp"))
+}
+
+func TestServerBucket(t *testing.T) {
+	root := t.TempDir()
+	origin := createServerWithOpts(":4191", ServerOpts{Root: root})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peers := []*Server{}
+	for _, addr := range []string{":4192", ":4193"} {
+		peer := createServerWithOpts(addr, ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4191"}})
+		assert.Nil(t, peer.Start())
+		defer peer.Close()
+		peers = append(peers, peer)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.ErrorIs(t, origin.CreateBucket("Team_A", BucketConfig{}), ErrInvalidBucketName)
+	assert.ErrorIs(t, origin.CreateBucket("team-a", BucketConfig{Encryption: "none"}), ErrInvalidBucketValue)
+	assert.Nil(t, origin.CreateBucket("team-a", BucketConfig{Replicas: 1, TTL: time.Hour, Quota: store.Quota{Objects: 2}}))
+	assert.Nil(t, origin.CreateBucket("team-b", BucketConfig{Encryption: EncryptionConvergent}))
+	assert.ErrorIs(t, origin.CreateBucket("team-b", BucketConfig{}), ErrBucketExists)
+	assert.Equal(t, []string{"team-a", "team-b"}, origin.ListBuckets())
+	_, err := origin.Bucket("team-c")
+	assert.ErrorIs(t, err, ErrNoSuchBucket)
+
+	a, err := origin.Bucket("team-a")
+	assert.Nil(t, err)
+	b, err := origin.Bucket("team-b")
+	assert.Nil(t, err)
+	_, err = origin.Store("k", strings.NewReader("flat"))
+	assert.Nil(t, err)
+	_, err = a.Store("k", strings.NewReader("team a"))
+	assert.Nil(t, err)
+	_, err = b.Store("k", strings.NewReader("team b"))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	// the same key in each bucket is its own object
+	for key, want := range map[string]string{"k": "flat", a.key("k"): "team a", b.key("k"): "team b"} {
+		got, err := origin.Read(key)
+		assert.Nil(t, err)
+		data, _ := io.ReadAll(got)
+		assert.Equal(t, want, string(data))
+	}
+	keys, _, err := origin.List("", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"k"}, keys)
+	keys, _, err = a.List("", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"k"}, keys)
+
+	// team-a keeps a single replica and expires its objects
+	bucket, remote := peerKey(a.key("k"))
+	held := 0
+	for _, peer := range peers {
+		if peer.store.Has(origin.id, store.BucketKey(bucket, remote)) {
+			held++
+		}
+	}
+	assert.Equal(t, 1, held)
+	meta, err := a.Stat("k")
+	assert.Nil(t, err)
+	assert.Equal(t, "k", meta.Name)
+	assert.NotNil(t, meta.Expires)
+	_, err = a.Store("l", strings.NewReader("l"))
+	assert.Nil(t, err)
+	_, err = a.Store("m", strings.NewReader("m"))
+	assert.ErrorIs(t, err, store.ErrQuotaExceeded)
+	// a namespace named after the bucket has a quota of its own
+	_, err = origin.StoreWithOptions("m", strings.NewReader("m"), PutOptions{Namespace: "team-a"})
+	assert.Nil(t, err)
+	assert.Nil(t, origin.Delete("m"))
+	_, err = origin.StoreWithOptions("m", strings.NewReader("m"), PutOptions{Namespace: bucketNamespace("team-a")})
+	assert.ErrorIs(t, err, ErrInvalidNamespace)
+
+	// read back from the peers through the bucket messages
+	assert.Nil(t, origin.store.Delete(origin.id, b.key("k")))
+	got, err := b.Read("k")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(got)
+	assert.Equal(t, "team b", string(data))
+
+	assert.ErrorIs(t, origin.DeleteBucket("team-a"), ErrBucketNotEmpty)
+	assert.Nil(t, a.Delete("k"))
+	assert.Nil(t, a.Delete("l"))
+	assert.Nil(t, origin.DeleteBucket("team-a"))
+	assert.Equal(t, []string{"team-b"}, origin.ListBuckets())
+
+	// the buckets are kept with the objects
+	reopened := newServer(t, ServerOpts{Root: root, TransformPathFunc: store.SHA1PathTransformFunc})
+	assert.Equal(t, []string{"team-b"}, reopened.ListBuckets())
+
+	// the quota went with the bucket
+	assert.Nil(t, origin.CreateBucket("team-a", BucketConfig{}))
+	for _, key := range []string{"k", "l", "m"} {
+		_, err = a.Store(key, strings.NewReader(key))
+		assert.Nil(t, err)
+	}
+
+	// a peer cannot name a bucket outside of the store
+	err = origin.handleMessageUndelete(MessageUndelete{Id: origin.id, Bucket: "../..", Key: "k"}, origin.id, nil)
+	assert.ErrorIs(t, err, ErrInvalidBucketName)
+}
+
+func TestServerCapacity(t *testing.T) {
+	origin := createServerWithOpts(":4201", ServerOpts{Root: t.TempDir()})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	// room for two replicas of 60 bytes and their IV, minus the reserve
+	backend := store.NewMemoryBackend()
+	backend.Limit = 200
+	full := createServerWithOpts(":4202", ServerOpts{Backend: backend, Reserve: 50, OutboundServer: []string{":4201"}})
+	assert.Nil(t, full.Start())
+	peer := createServerWithOpts(":4203", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4201"}})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	capacities := origin.PeerCapacities()
+	assert.Equal(t, 2, len(capacities))
+	fullAddr := ""
+	for addr, c := range capacities {
+		if c.Available == 150 {
+			fullAddr = addr
+		}
+	}
+	assert.NotEmpty(t, fullAddr)
+
+	data := bytes.Repeat([]byte("x"), 60)
+	_, err := origin.Store("a", bytes.NewReader(data))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, full.store.Has(origin.id, cryto.Hash("a")))
+
+	// the full node refuses the replica and advertises what is left
+	_, err = origin.Store("b", bytes.NewReader(data))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Contains(t, origin.Rejected("b"), fullAddr)
+	assert.Equal(t, int64(74), origin.PeerCapacities()[fullAddr].Available)
+	assert.True(t, peer.store.Has(origin.id, cryto.Hash("b")))
+
+	// and is no longer chosen
+	_, err = origin.Store("c", bytes.NewReader(data))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, origin.Rejected("c"))
+	assert.False(t, full.store.Has(origin.id, cryto.Hash("c")))
+	assert.True(t, peer.store.Has(origin.id, cryto.Hash("c")))
+
+	// down to its reserve the node is read-only
+	assert.False(t, full.ReadOnly())
+	_, err = full.Store("d", bytes.NewReader(make([]byte, 74)))
+	assert.Nil(t, err)
+	assert.True(t, full.ReadOnly())
+	_, err = full.Store("e", strings.NewReader("e"))
+	assert.ErrorIs(t, err, store.ErrReadOnly)
+	r, err := full.Read("d")
+	assert.Nil(t, err)
+	got, _ := io.ReadAll(r)
+	assert.Equal(t, 74, len(got))
+
+	// what a peer advertised goes away with it
+	full.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.NotContains(t, origin.PeerCapacities(), fullAddr)
+	assert.Equal(t, 1, len(origin.PeerCapacities()))
+}
+
+func TestServerDisks(t *testing.T) {
+	multi := &store.MultiBackend{}
+	disk := store.NewMemoryBackend()
+	assert.Nil(t, multi.AddDisk("a", store.NewMemoryBackend()))
+	assert.Nil(t, multi.AddDisk("b", disk))
+	origin := createServerWithOpts(":4211", ServerOpts{Root: t.TempDir(), Backend: multi})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer := createServerWithOpts(":4212", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4211"}})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	keys := []string{}
+	for i := range 10 {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		_, err := origin.Store(key, strings.NewReader(key))
+		assert.Nil(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	lost := origin.Disks()[1].Objects
+	assert.True(t, lost > 0)
+
+	// the objects of the failed disk come back from the peer
+	disk.Fail("", errors.New("input/output error"))
+	assert.Equal(t, []string{"b"}, origin.CheckDisks())
+	time.Sleep(300 * time.Millisecond)
+	assert.NotNil(t, origin.Disks()[1].Failed)
+	assert.Equal(t, len(keys), origin.Disks()[0].Objects)
+	for _, key := range keys {
+		assert.True(t, origin.store.Has(origin.id, key), key)
+		r, err := origin.Read(key)
+		assert.Nil(t, err)
+		data, _ := io.ReadAll(r)
+		assert.Equal(t, key, string(data))
+	}
+
+	// the new disk takes its share, by the hash of the paths
+	moved, err := origin.AddDisk(t.TempDir())
+	assert.Nil(t, err)
+	disks := origin.Disks()
+	assert.Equal(t, moved, disks[2].Objects)
+	assert.Equal(t, len(keys), disks[0].Objects+disks[2].Objects)
+	_, err = peer.AddDisk(t.TempDir())
+	assert.ErrorIs(t, err, ErrSingleDisk)
+}
+
+func TestServerLifecycle(t *testing.T) {
+	origin := createServerWithOpts(":4221", ServerOpts{Root: t.TempDir()})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer := createServerWithOpts(":4222", ServerOpts{
+		Root:            t.TempDir(),
+		OutboundServer:  []string{":4221"},
+		ColdRoot:        t.TempDir(),
+		ColdCompression: store.CompressionFlate,
+		Lifecycle:       []store.LifecycleRule{{ColdAfter: time.Nanosecond}},
+	})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := origin.Store("k", strings.NewReader(strings.Repeat("log line\n", 100)))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = origin.ApplyLifecycle()
+	assert.ErrorIs(t, err, store.ErrNoColdTier)
+	report, err := peer.ApplyLifecycle()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Objects)
+	meta, err := peer.store.Stat(origin.id, cryto.Hash("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, store.TierCold, meta.Tier)
+
+	// a proof of the cold replica leaves it cold
+	lost, err := origin.Verify("k")
+	assert.Nil(t, err)
+	assert.Empty(t, lost)
+	meta, err = peer.store.Stat(origin.id, cryto.Hash("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, store.TierCold, meta.Tier)
+
+	// the cold replica is read back and moves to the hot tier
+	assert.Nil(t, origin.store.Delete(origin.id, "k"))
+	r, err := origin.Read("k")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, strings.Repeat("log line\n", 100), string(data))
+	meta, err = peer.store.Stat(origin.id, cryto.Hash("k"))
+	assert.Nil(t, err)
+	assert.Empty(t, meta.Tier)
+}
+
+func TestServerCompression(t *testing.T) {
+	origin := createServerWithOpts(":4231", ServerOpts{Root: t.TempDir(), Compression: store.CompressionGzip})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer := createServerWithOpts(":4232", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4231"}})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	logs := strings.Repeat(`{"level":"info","msg":"request served"}`+"\n", 5000)
+	_, err := origin.Store("logs", strings.NewReader(logs))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	meta, err := origin.Stat("logs")
+	assert.Nil(t, err)
+	assert.Equal(t, store.CompressionGzip, meta.Compression)
+	assert.True(t, meta.StoredSize < int64(len(logs))/10)
+	// the replica is sent and kept compressed
+	replica, err := peer.store.Stat(origin.id, cryto.Hash("logs"))
+	assert.Nil(t, err)
+	assert.Equal(t, store.CompressionGzip, replica.ContentEncoding)
+	assert.Equal(t, int64(len(logs)), replica.ContentSize)
+	assert.True(t, replica.Size < int64(len(logs))/10)
+
+	assert.Nil(t, origin.store.Delete(origin.id, "logs"))
+	meta, err = origin.Stat("logs")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(logs)), meta.Size)
+	r, err := origin.ReadRange("logs", 40, 39)
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, logs[40:79], string(data))
+	// the compressed replica is decoded as a stream, seeking forward
+	// skips its content and seeking backward starts over
+	f, err := origin.Open("logs")
+	assert.Nil(t, err)
+	line := make([]byte, 40)
+	for _, offset := range []int64{40 * 100, 40 * 3, 40 * 4999} {
+		_, err := f.Seek(offset, io.SeekStart)
+		assert.Nil(t, err)
+		_, err = io.ReadFull(f, line)
+		assert.Nil(t, err)
+		assert.Equal(t, logs[offset:offset+40], string(line))
+	}
+	_, err = f.Read(line)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, f.Close())
+	rr, err := origin.Read("logs")
+	assert.Nil(t, err)
+	data, _ = io.ReadAll(rr)
+	assert.Equal(t, logs, string(data))
+	meta, err = origin.store.Stat(origin.id, "logs")
+	assert.Nil(t, err)
+	assert.Equal(t, store.CompressionGzip, meta.Compression)
+
+	// per bucket and per object
+	assert.ErrorIs(t, origin.CreateBucket("bad", BucketConfig{Compression: "zstd"}), ErrInvalidBucketValue)
+	assert.Nil(t, origin.CreateBucket("events", BucketConfig{Compression: store.CompressionFlate}))
+	b, err := origin.Bucket("events")
+	assert.Nil(t, err)
+	_, err = b.Store("day", strings.NewReader(logs))
+	assert.Nil(t, err)
+	meta, err = b.Stat("day")
+	assert.Nil(t, err)
+	assert.Equal(t, store.CompressionFlate, meta.Compression)
+	_, err = origin.StoreWithOptions("plain", strings.NewReader(logs), PutOptions{Compression: store.CompressionFlate})
+	assert.Nil(t, err)
+	meta, err = origin.Stat("plain")
+	assert.Nil(t, err)
+	assert.Equal(t, store.CompressionFlate, meta.Compression)
+
+	// incompressible data is sent and stored as it is
+	random := make([]byte, 100<<10)
+	rand.Read(random)
+	_, err = origin.Store("random", bytes.NewReader(random))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	meta, err = origin.Stat("random")
+	assert.Nil(t, err)
+	assert.Empty(t, meta.Compression)
+	replica, err = peer.store.Stat(origin.id, cryto.Hash("random"))
+	assert.Nil(t, err)
+	assert.Empty(t, replica.ContentEncoding)
+}
+
+func TestServerVersions(t *testing.T) {
+	backend := store.NewMemoryBackend()
+	origin := createServerWithOpts(":4241", ServerOpts{Root: t.TempDir(), Backend: backend, Versioning: []string{"docs"}})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer := createServerWithOpts(":4242", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4241"}})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	for _, content := range []string{"v1", "v2", "v3"} {
+		_, err := origin.StoreWithOptions("report", strings.NewReader(content), PutOptions{Namespace: "docs"})
+		assert.Nil(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	versions := origin.Versions("report")
+	assert.Equal(t, 3, len(versions))
+	v1 := versions[2].VersionId
+	r, err := origin.ReadVersion("report", v1)
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "v1", string(data))
+	// the peer keeps the versions of its replica
+	replicas := peer.store.Versions(origin.id, cryto.Hash("report"))
+	assert.Equal(t, 3, len(replicas))
+	assert.Equal(t, versions[1].VersionId, replicas[1].VersionId)
+
+	// a lost older version is read from the peer
+	paths, _ := backend.List(".versions/")
+	for _, p := range paths {
+		if path.Base(p) == v1 {
+			assert.Nil(t, backend.Delete(p))
+		}
+	}
+	r, err = origin.ReadVersion("report", v1)
+	assert.Nil(t, err)
+	data, _ = io.ReadAll(r)
+	assert.Equal(t, "v1", string(data))
+
+	assert.Nil(t, origin.Delete("report"))
+	time.Sleep(100 * time.Millisecond)
+	_, err = origin.Read("report")
+	assert.NotNil(t, err)
+	versions = origin.Versions("report")
+	assert.True(t, versions[0].DeleteMarker)
+	_, err = origin.ReadVersion("report", versions[0].VersionId)
+	assert.ErrorIs(t, err, store.ErrDeleteMarker)
+	replicas = peer.store.Versions(origin.id, cryto.Hash("report"))
+	assert.Equal(t, 4, len(replicas))
+	assert.True(t, replicas[0].DeleteMarker)
+
+	_, err = origin.RestoreVersion("report", v1)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	r, err = origin.Read("report")
+	assert.Nil(t, err)
+	data, _ = io.ReadAll(r)
+	assert.Equal(t, "v1", string(data))
+	assert.Equal(t, 5, len(origin.Versions("report")))
+
+	n, err := origin.PruneVersions("report", 1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, len(origin.Versions("report")))
+	assert.Equal(t, 2, len(peer.store.Versions(origin.id, cryto.Hash("report"))))
+
+	// objects outside of the versioned namespaces are overwritten
+	_, err = origin.Store("plain", strings.NewReader("v1"))
+	assert.Nil(t, err)
+	_, err = origin.Store("plain", strings.NewReader("v2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(origin.Versions("plain")))
+
+	assert.Nil(t, origin.CreateBucket("notes", BucketConfig{Versioning: true}))
+	b, err := origin.Bucket("notes")
+	assert.Nil(t, err)
+	for _, content := range []string{"draft", "final"} {
+		_, err := b.Store("todo", strings.NewReader(content))
+		assert.Nil(t, err)
+	}
+	versions = b.Versions("todo")
+	assert.Equal(t, 2, len(versions))
+	r, err = b.ReadVersion("todo", versions[1].VersionId)
+	assert.Nil(t, err)
+	data, _ = io.ReadAll(r)
+	assert.Equal(t, "draft", string(data))
+}
+
+func TestServerVersionChunks(t *testing.T) {
+	backend := store.NewMemoryBackend()
+	origin := createServerWithOpts(":4261", ServerOpts{Root: t.TempDir(), Backend: backend, Versioning: []string{"docs"}, ChunkSize: 4})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer := createServerWithOpts(":4262", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4261"}})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	for _, content := range []string{"aaaabbbb", "aaaacccc"} {
+		_, err := origin.StoreWithOptions("report", strings.NewReader(content), PutOptions{Namespace: "docs"})
+		assert.Nil(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	versions := origin.Versions("report")
+	assert.Equal(t, 2, len(versions))
+	shared, _ := cryto.CID(strings.NewReader("aaaa"))
+	old, _ := cryto.CID(strings.NewReader("bbbb"))
+	// the manifests of the older versions hold their chunks on a restart
+	origin.countChunks()
+	assert.Equal(t, 2, origin.chunkRefs[shared])
+	assert.Equal(t, 1, origin.chunkRefs[old])
+
+	// a lost older manifest comes back from the peer
+	paths, _ := backend.List(".versions/")
+	for _, p := range paths {
+		assert.Nil(t, backend.Delete(p))
+	}
+	r, err := origin.ReadVersion("report", versions[1].VersionId)
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "aaaabbbb", string(data))
+
+	n, err := origin.PruneVersions("report", 0, time.Nanosecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.False(t, origin.store.Has(origin.id, old))
+	assert.True(t, origin.store.Has(origin.id, shared))
+	r, err = origin.Read("report")
+	assert.Nil(t, err)
+	data, _ = io.ReadAll(r)
+	assert.Equal(t, "aaaacccc", string(data))
+
+	// the owner and its peer give the delete marker the same id
+	assert.Nil(t, origin.Delete("report"))
+	time.Sleep(100 * time.Millisecond)
+	marker := origin.Versions("report")[0]
+	assert.True(t, marker.DeleteMarker)
+	assert.True(t, strings.HasSuffix(marker.VersionId, "-deleted"))
+	replicas := peer.store.Versions(origin.id, cryto.Hash("report"))
+	assert.Equal(t, marker.VersionId, replicas[0].VersionId)
+}
+
+func TestServerTrash(t *testing.T) {
+	origin := createServerWithOpts(":4251", ServerOpts{Root: t.TempDir(), TrashRetention: 500 * time.Millisecond, ChunkSize: 4})
+	assert.Nil(t, origin.Start())
+	defer origin.Close()
+	peer := createServerWithOpts(":4252", ServerOpts{Root: t.TempDir(), OutboundServer: []string{":4251"}, TrashRetention: time.Hour})
+	assert.Nil(t, peer.Start())
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	for _, key := range []string{"logs/a", "logs/b", "keep"} {
+		_, err := origin.Store(key, strings.NewReader("data of "+key))
+		assert.Nil(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, key := range []string{"logs/a", "logs/b"} {
+		assert.Nil(t, origin.Delete(key))
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, err := origin.Read("logs/a")
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, len(origin.Trash("logs/")))
+	assert.Equal(t, 2, len(peer.store.Trash(origin.id)))
+
+	// a wiped prefix comes back, with its chunks and replicas
+	restored, err := origin.UndeletePrefix("logs/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"logs/a", "logs/b"}, restored)
+	time.Sleep(100 * time.Millisecond)
+	r, err := origin.Read("logs/b")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "data of logs/b", string(data))
+	assert.Empty(t, peer.store.Trash(origin.id))
+	assert.True(t, peer.store.Has(origin.id, cryto.Hash("logs/b")))
+	// with the replicas tracked again
+	lost, err := origin.Verify("logs/b")
+	assert.Nil(t, err)
+	assert.Empty(t, lost)
+
+	assert.Nil(t, origin.Delete("logs/a"))
+	n, err := origin.PurgeTrash()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	time.Sleep(600 * time.Millisecond)
+	n, err = origin.PurgeTrash()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.ErrorIs(t, origin.Undelete("logs/a"), store.ErrNotFound)
+	// the chunks still used by the other objects stay
+	r, err = origin.Read("logs/b")
+	assert.Nil(t, err)
+	data, _ = io.ReadAll(r)
+	assert.Equal(t, "data of logs/b", string(data))
+
+	assert.Nil(t, origin.CreateBucket("docs", BucketConfig{}))
+	b, err := origin.Bucket("docs")
+	assert.Nil(t, err)
+	_, err = b.Store("readme", strings.NewReader("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, b.Delete("readme"))
+	trash := b.Trash("")
+	assert.Equal(t, 1, len(trash))
+	assert.Equal(t, "readme", trash[0].Name)
+	assert.Empty(t, origin.Trash(""))
+	assert.Nil(t, b.Undelete("readme"))
+	r, err = b.Read("readme")
+	assert.Nil(t, err)
+	data, _ = io.ReadAll(r)
+	assert.Equal(t, "hello", string(data))
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/cryto"
+	"github.com/jun-hf/distributedstorage/p2p"
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+const statTimeout = 5 * time.Second
+
+// Stat returns the metadata of key, from the peers
+// when the key is no longer stored locally.
+func (s *Server) Stat(key string) (store.Metadata, error) {
+	meta, err := s.stat(key)
+	if err != nil || !meta.Manifest {
+		return meta, err
+	}
+	// the size of the content, not of the manifest
+	m, err := s.loadManifest(key)
+	if err != nil {
+		return store.Metadata{}, err
+	}
+	meta.Size = m.Size
+	return meta, nil
+}
+
+func (s *Server) stat(key string) (store.Metadata, error) {
+	meta, err := s.store.Stat(s.id, key)
+	if err == nil || errors.Is(err, store.ErrExpired) {
+		return meta, err
+	}
+	for _, peer := range s.peerList() {
+		meta, err := s.statPeer(peer, key)
+		if err != nil {
+			continue
+		}
+		return meta, nil
+	}
+	return store.Metadata{}, fmt.Errorf("%w: %v", store.ErrNotFound, key)
+}
+
+func (s *Server) statPeer(peer p2p.Peer, key string) (store.Metadata, error) {
+	requestId := cryto.UUID()
+	bucket, remote := peerKey(key)
+	msg := &Message{
+		Payload: MessageStatKey{
+			Id:        s.id,
+			Key:       remote,
+			Bucket:    bucket,
+			RequestId: requestId,
+		},
+	}
+	payload, err := s.request(peer, requestId, msg, statTimeout)
+	if err != nil {
+		return store.Metadata{}, err
+	}
+	resp, ok := payload.(MessageStatKeyResponse)
+	if !ok {
+		return store.Metadata{}, fmt.Errorf("unexpected response %T", payload)
+	}
+	if len(resp.Err) > 0 {
+		return store.Metadata{}, fmt.Errorf("%v", resp.Err)
+	}
+	// present the replica as the original object
+	meta := resp.Meta
+	meta.Key, meta.Name, meta.SealedName = key, key, nil
+	meta.Size -= s.replicaSize(key, 0)
+	if len(meta.ContentEncoding) > 0 {
+		meta.Size = meta.ContentSize
+	}
+	meta.ContentEncoding, meta.ContentSize = "", 0
+	meta.Checksum = meta.ContentChecksum
+	if err := s.unsealAttributes(&meta); err != nil {
+		return store.Metadata{}, err
+	}
+	return meta, nil
+}
+
+// attributes are the attributes of an object sealed in
+// the metadata of its replicas
+type attributes struct {
+	ContentType string
+	Headers     map[string]string
+}
+
+// sealAttributes moves the ContentType and Headers of meta into its
+// SealedAttributes, only the owner can read them on the peers
+func (s *Server) sealAttributes(meta *store.Metadata) error {
+	if len(meta.ContentType) == 0 && len(meta.Headers) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(attributes{ContentType: meta.ContentType, Headers: meta.Headers})
+	if err != nil {
+		return err
+	}
+	if meta.SealedAttributes, err = cryto.Encrypt(s.nodeKey(), data); err != nil {
+		return err
+	}
+	meta.ContentType, meta.Headers = "", nil
+	return nil
+}
+
+// unsealAttributes restores the attributes sealed by sealAttributes
+func (s *Server) unsealAttributes(meta *store.Metadata) error {
+	if len(meta.SealedAttributes) == 0 {
+		return nil
+	}
+	data, err := cryto.Decrypt(s.nodeKey(), meta.SealedAttributes)
+	if err != nil {
+		return fmt.Errorf("failed to unseal the attributes: %w", err)
+	}
+	a := attributes{}
+	if err := json.Unmarshal(data, &a); err != nil {
+		return fmt.Errorf("failed to unseal the attributes: %w", err)
+	}
+	meta.ContentType, meta.Headers, meta.SealedAttributes = a.ContentType, a.Headers, nil
+	return nil
+}
+
+func (s *Server) handleMessageStatKey(m MessageStatKey, from, sender string) error {
+	peer, err := s.getPeer(from)
+	if err != nil {
+		return err
+	}
+	resp := MessageStatKeyResponse{RequestId: m.RequestId}
+	if m.Id != sender {
+		resp.Err = fmt.Sprintf("%v: %v cannot stat the keys of %v", ErrNotAuthorized, sender, m.Id)
+	} else {
+		key, err := peerBucketKey(m.Bucket, m.Key)
+		var meta store.Metadata
+		if err == nil {
+			meta, err = s.store.Stat(m.Id, key)
+		}
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		resp.Meta = meta
+	}
+	return s.sendTo([]p2p.Peer{peer}, &Message{Payload: resp})
+}
+
+func (s *Server) handleMessageStatKeyResponse(m MessageStatKeyResponse) error {
+	return s.resolve(m.RequestId, m)
+}
+
+// DedupStats returns the space saved by deduplication on this node
+func (s *Server) DedupStats() store.DedupStats {
+	return s.store.DedupStats()
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+// Trash returns the objects of this server starting with prefix that
+// were deleted and are kept in the trash, see ServerOpts.TrashRetention
+func (s *Server) Trash(prefix string) []store.Metadata {
+	return s.trash("", prefix)
+}
+
+func (s *Server) trash(bucket, prefix string) []store.Metadata {
+	trash := []store.Metadata{}
+	for _, meta := range s.store.Trash(s.id) {
+		if meta.Bucket == bucket && strings.HasPrefix(meta.Name, prefix) {
+			trash = append(trash, meta)
+		}
+	}
+	return trash
+}
+
+// Undelete moves key back from the trash, here and on the peers, and
+// replicates it again since its replicas were forgotten by Delete.
+// Once key is back here the failures of the peers are only logged.
+func (s *Server) Undelete(key string) error {
+	if err := s.store.Undelete(s.id, key); err != nil {
+		return err
+	}
+	bucket, remote := peerKey(key)
+	msg := &Message{
+		Payload: MessageUndelete{
+			Id:     s.id,
+			Key:    remote,
+			Bucket: bucket,
+		},
+	}
+	if err := s.broadcast(msg); err != nil {
+		log.Printf("server (%v) failed to undelete %v on the peers: %v\n", s.store.Root, key, err)
+	}
+	if _, err := s.replicateStored(key, s.peerList()); err != nil {
+		log.Printf("server (%v) failed to replicate %v again: %v\n", s.store.Root, key, err)
+	}
+	return nil
+}
+
+// UndeletePrefix moves back from the trash the objects starting
+// with prefix and returns their keys
+func (s *Server) UndeletePrefix(prefix string) ([]string, error) {
+	return s.undeletePrefix("", prefix)
+}
+
+func (s *Server) undeletePrefix(bucket, prefix string) ([]string, error) {
+	restored := []string{}
+	for _, meta := range s.trash(bucket, prefix) {
+		if err := s.Undelete(meta.Key); err != nil {
+			return restored, err
+		}
+		restored = append(restored, meta.Name)
+	}
+	return restored, nil
+}
+
+func (s *Server) handleMessageUndelete(m MessageUndelete, sender string, c *Capability) error {
+	if err := s.authorize(sender, m.Id, ActionWrite, m.Key, c); err != nil {
+		return err
+	}
+	key, err := peerBucketKey(m.Bucket, m.Key)
+	if err != nil {
+		return err
+	}
+	return s.store.Undelete(m.Id, key)
+}
+
+// PurgeTrash deletes for good the objects that stayed in the trash for
+// TrashRetention, with the chunks of the manifests of this server no
+// other object uses. It returns the number of objects purged.
+func (s *Server) PurgeTrash() (int, error) {
+	now := time.Now()
+	manifests := []*Manifest{}
+	for _, meta := range s.store.Trash(s.id) {
+		if !meta.Manifest || len(meta.VersionId) > 0 || now.Sub(meta.Deleted) < s.store.TrashRetention {
+			continue
+		}
+		m, err := s.trashedManifest(meta.Key)
+		if err != nil {
+			return 0, err
+		}
+		manifests = append(manifests, m)
+	}
+	purged, err := s.store.PurgeTrash(now)
+	s.mu.Lock()
+	for _, meta := range purged {
+		if meta.Id == s.id {
+			delete(s.contentKeys, meta.Key)
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return len(purged), err
+	}
+	for _, m := range manifests {
+		if err := s.releaseChunks(m); err != nil {
+			return len(purged), err
+		}
+	}
+	return len(purged), nil
+}
+
+// trashedManifest returns the manifest of key in the trash
+func (s *Server) trashedManifest(key string) (*Manifest, error) {
+	return readManifest(key, func() (io.ReadCloser, error) { return s.store.OpenTrash(s.id, key) })
+}
+
+// keepsChunks reports if the chunks and content key of the object
+// meta stay after it is deleted, for its older versions or while it
+// is in the trash
+func (s *Server) keepsChunks(meta store.Metadata) bool {
+	return len(meta.VersionId) > 0 || s.store.Trashed(meta)
+}
+
+func (s *Server) purgeTrash() {
+	if s.store.TrashRetention <= 0 {
+		return
+	}
+	n, err := s.PurgeTrash()
+	if err != nil {
+		log.Printf("server (%v) failed to purge the trash: %v\n", s.store.Root, err)
+	}
+	if n > 0 {
+		log.Printf("server (%v) purged %v objects from the trash\n", s.store.Root, n)
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jun-hf/distributedstorage/p2p"
+	"github.com/jun-hf/distributedstorage/store"
+)
+
+// SetVersioning turns the versioning of the namespace ns on or off,
+// see store.Store.SetVersioning. The buckets have their own, see
+// BucketConfig.Versioning.
+func (s *Server) SetVersioning(ns string, on bool) {
+	s.store.SetVersioning(ns, on)
+}
+
+// Versions returns the versions of key kept on this node, newest first,
+// see store.Store.Versions
+func (s *Server) Versions(key string) []store.Metadata {
+	return s.store.Versions(s.id, key)
+}
+
+// ReadVersion returns the content of the version versionId of key,
+// from the peers when it is no longer stored locally
+func (s *Server) ReadVersion(key, versionId string) (io.ReadCloser, error) {
+	meta, err := s.store.StatVersion(s.id, key, versionId)
+	if err != nil {
+		return nil, err
+	}
+	if meta.DeleteMarker {
+		return nil, fmt.Errorf("%w: %v of %v", store.ErrDeleteMarker, versionId, key)
+	}
+	if !meta.Manifest {
+		f, err := s.openVersion(meta)
+		if err != nil {
+			return nil, err
+		}
+		return &closingReader{f: f}, nil
+	}
+	m, err := readManifest(key, func() (io.ReadCloser, error) { return s.openVersion(meta) })
+	if err != nil {
+		return nil, err
+	}
+	s.loadContentKeys(m)
+	return s.readObject(m)
+}
+
+// openVersion opens the version meta of an object of the server, it
+// is fetched back from the peers and checked against its Checksum
+// when it is no longer stored locally, see restore
+func (s *Server) openVersion(meta store.Metadata) (io.ReadSeekCloser, error) {
+	f, err := s.store.OpenVersion(s.id, meta.Key, meta.VersionId)
+	if err == nil {
+		return f, nil
+	}
+	if err := s.restore(meta); err != nil {
+		return nil, fmt.Errorf("version %v of %v: %w", meta.VersionId, meta.Key, err)
+	}
+	return s.store.OpenVersion(s.id, meta.Key, meta.VersionId)
+}
+
+// closingReader closes its file once read to the end or to an error
+type closingReader struct {
+	f io.ReadCloser
+	// err is the error the file was closed on
+	err error
+}
+
+func (c *closingReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.f.Read(p)
+	if err != nil {
+		c.f.Close()
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *closingReader) Close() error {
+	if c.err != nil {
+		return nil
+	}
+	c.err = os.ErrClosed
+	return c.f.Close()
+}
+
+// RestoreVersion stores the content of the version versionId of key
+// as its new current version, replicated like any other write
+func (s *Server) RestoreVersion(key, versionId string) (int64, error) {
+	meta, err := s.store.StatVersion(s.id, key, versionId)
+	if err != nil {
+		return 0, err
+	}
+	r, err := s.ReadVersion(key, versionId)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return s.storeObject(key, r, store.Metadata{
+		Name:         meta.Name,
+		ContentType:  meta.ContentType,
+		Headers:      meta.Headers,
+		StorageClass: meta.StorageClass,
+		Namespace:    meta.Namespace,
+		Bucket:       meta.Bucket,
+		Compression:  meta.Compression,
+	})
+}
+
+// PruneVersions deletes the older versions of key past the keep newest
+// ones or archived more than maxAge ago, here and on the peers. It
+// returns the number of versions deleted on this node.
+func (s *Server) PruneVersions(key string, keep int, maxAge time.Duration) (int, error) {
+	pruned := 0
+	for _, meta := range s.store.PrunableVersions(s.id, key, keep, maxAge, time.Now()) {
+		// a manifest is read before it is deleted to release its chunks
+		var m *Manifest
+		if meta.Manifest && !meta.DeleteMarker {
+			var err error
+			m, err = readManifest(key, func() (io.ReadCloser, error) { return s.store.PeekVersion(s.id, key, meta.VersionId) })
+			if err != nil {
+				log.Printf("server (%v) cannot release the chunks of version %v of %v: %v\n", s.store.Root, meta.VersionId, key, err)
+			}
+		}
+		if err := s.store.DeleteVersion(s.id, key, meta.VersionId); err != nil {
+			return pruned, err
+		}
+		pruned++
+		if m != nil {
+			if err := s.releaseChunks(m); err != nil {
+				return pruned, err
+			}
+		}
+	}
+	bucket, remote := peerKey(key)
+	msg := &Message{
+		Payload: MessagePruneVersions{
+			Id:     s.id,
+			Key:    remote,
+			Bucket: bucket,
+			Keep:   keep,
+			MaxAge: maxAge,
+		},
+	}
+	return pruned, s.broadcast(msg)
+}
+
+func (s *Server) handleMessagePruneVersions(m MessagePruneVersions, sender string, c *Capability) error {
+	if err := s.authorize(sender, m.Id, ActionDelete, m.Key, c); err != nil {
+		return err
+	}
+	key, err := peerBucketKey(m.Bucket, m.Key)
+	if err != nil {
+		return err
+	}
+	_, err = s.store.PruneVersions(m.Id, key, m.Keep, m.MaxAge)
+	return err
+}
+
+// sendVersion streams the version versionId of key of id to peer
+// like handleMessageGetFile does with the current object
+func (s *Server) sendVersion(p p2p.Peer, id, key, versionId string) error {
+	meta, err := s.store.StatVersion(id, key, versionId)
+	if err == nil && meta.DeleteMarker {
+		err = fmt.Errorf("%w: %v", store.ErrDeleteMarker, versionId)
+	}
+	var f io.ReadSeekCloser
+	if err == nil {
+		f, err = s.store.OpenVersion(id, key, versionId)
+	}
+	p.Write([]byte{p2p.IncomingStream})
+	if err != nil {
+		writeStreamHeader(p, -1, "")
+		return fmt.Errorf("server (%v) do not have version %v of %v: %w", s.store.Root, versionId, key, err)
+	}
+	defer f.Close()
+	writeStreamHeader(p, meta.Size, meta.ContentEncoding)
+	_, err = io.Copy(p, f)
+	return err
+}
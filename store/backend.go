@@ -0,0 +1,91 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("object not found")
+	// ErrNoSpace is returned by the writes that do not fit in the free space
+	ErrNoSpace = errors.New("no space left")
+	// ErrCapacityUnknown is returned by the backends that cannot tell their free space
+	ErrCapacityUnknown = errors.New("capacity unknown")
+)
+
+// Backend is where the Store keeps the objects. Paths are
+// slash separated and relative to the root of the backend.
+type Backend interface {
+	// Put stores the content of r at path, replacing any existing object
+	Put(path string, r io.Reader) (int64, error)
+	// Get opens the object at path for reading
+	Get(path string) (io.ReadSeekCloser, error)
+	Stat(path string) (Info, error)
+	Delete(path string) error
+	// List returns the paths starting with prefix in lexical order
+	List(prefix string) ([]string, error)
+}
+
+// Info describes an object in a Backend
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Capacity is the space of a Backend in bytes
+type Capacity struct {
+	Total int64
+	Free  int64
+}
+
+// capacitor is implemented by the backends that know their free space
+type capacitor interface {
+	Capacity() (Capacity, error)
+}
+
+// syncer is implemented by the backends that can put several
+// objects without syncing each and sync them together afterwards
+type syncer interface {
+	// PutUnsynced is Put without the sync, the object may be
+	// lost or torn by a crash until Sync returns
+	PutUnsynced(path string, r io.Reader) (int64, error)
+	Sync(paths ...string) error
+}
+
+// renamer is implemented by the backends that can move an
+// object to another path without copying it
+type renamer interface {
+	// Rename moves the object at from to to, replacing the object there
+	Rename(from, to string) error
+}
+
+// rename moves the object at from to to in backend,
+// copying it when backend cannot rename
+func rename(backend Backend, from, to string) error {
+	if r, ok := backend.(renamer); ok {
+		return r.Rename(from, to)
+	}
+	f, err := backend.Get(from)
+	if err != nil {
+		return err
+	}
+	_, err = backend.Put(to, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return backend.Delete(from)
+}
+
+// clearer is implemented by the backends that can drop
+// everything faster than deleting the objects one by one
+type clearer interface {
+	Clear() error
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
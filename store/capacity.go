@@ -0,0 +1,101 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// ErrReadOnly is returned by the writes of a Store left with no more
+// free space than its Reserve, until objects are deleted
+var ErrReadOnly = errors.New("store is read-only")
+
+// Capacity returns the space of the Backend,
+// ErrCapacityUnknown when the Backend cannot tell
+func (s *Store) Capacity() (Capacity, error) {
+	c, ok := s.Backend.(capacitor)
+	if !ok {
+		return Capacity{}, ErrCapacityUnknown
+	}
+	return c.Capacity()
+}
+
+// Available returns the bytes that can still be written before
+// the Reserve, -1 when the capacity of the Backend is unknown
+func (s *Store) Available() int64 {
+	c, err := s.Capacity()
+	if err != nil {
+		return -1
+	}
+	return max(c.Free-s.Reserve, 0)
+}
+
+// ReadOnly reports if the Store refuses new writes for lack of space
+func (s *Store) ReadOnly() bool {
+	return s.Available() == 0
+}
+
+// unreserved returns the bytes Available leaves to a new write once the
+// writes in progress took what they reserved, and logs when the Store
+// turns read-only or writable again. spaceMu must be held.
+func (s *Store) unreserved() int64 {
+	available := s.Available()
+	if readOnly := available == 0; s.readOnly.Swap(readOnly) != readOnly {
+		if readOnly {
+			log.Printf("store (%v) is read-only, no more space than the reserve of %v\n", s.Root, s.Reserve)
+		} else {
+			log.Printf("store (%v) is writable again, %v bytes available\n", s.Root, available)
+		}
+	}
+	if available <= 0 {
+		return available
+	}
+	return max(available-s.spaceReserved, 0)
+}
+
+// CheckSpace returns ErrReadOnly when the Store is read-only and
+// ErrNoSpace when size bytes would eat into the Reserve, the writes
+// in progress included
+func (s *Store) CheckSpace(size int64) error {
+	s.spaceMu.Lock()
+	available := s.unreserved()
+	s.spaceMu.Unlock()
+	switch {
+	case available == 0 && s.readOnly.Load():
+		return ErrReadOnly
+	case available >= 0 && size > available:
+		return fmt.Errorf("%w: %v bytes for %v available", ErrNoSpace, size, available)
+	}
+	return nil
+}
+
+// limitSpace wraps r to stop the write before the Reserve. The bytes are
+// reserved as they are read, like with limitQuota, until release is called.
+func (s *Store) limitSpace(r io.Reader) (io.Reader, func(), error) {
+	s.spaceMu.Lock()
+	available := s.unreserved()
+	s.spaceMu.Unlock()
+	switch {
+	case available == 0 && s.readOnly.Load():
+		return nil, func() {}, ErrReadOnly
+	case available < 0:
+		return r, func() {}, nil
+	}
+	reserved := int64(0)
+	grant := func() (int64, error) {
+		s.spaceMu.Lock()
+		defer s.spaceMu.Unlock()
+		n := min(reserveGrant, max(s.unreserved(), 0))
+		s.spaceReserved += n
+		reserved += n
+		return n, nil
+	}
+	release := func() {
+		s.spaceMu.Lock()
+		defer s.spaceMu.Unlock()
+		s.spaceReserved -= reserved
+		reserved = 0
+	}
+	return &grantReader{r: r, grant: grant, err: ErrNoSpace}, release, nil
+}
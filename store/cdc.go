@@ -0,0 +1,120 @@
+package store
+
+import (
+	"io"
+	"math/bits"
+)
+
+// ChunkerOpts are the chunk sizes of a Chunker, a zero value uses
+// the default 2KB minimum, 8KB average and 64KB maximum.
+type ChunkerOpts struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+func (o ChunkerOpts) withDefaults() ChunkerOpts {
+	if o.AvgSize <= 0 {
+		o.AvgSize = 8 << 10
+	}
+	if o.MinSize <= 0 {
+		o.MinSize = o.AvgSize / 4
+	}
+	if o.MaxSize <= 0 {
+		o.MaxSize = o.AvgSize * 8
+	}
+	o.MinSize = min(o.MinSize, o.AvgSize)
+	o.MaxSize = max(o.MaxSize, o.AvgSize)
+	return o
+}
+
+// Chunker splits a stream at content-defined boundaries with the
+// FastCDC gear rolling hash, so an insertion in the middle of a
+// file only changes the chunks around it.
+type Chunker struct {
+	r            io.Reader
+	opts         ChunkerOpts
+	maskS, maskL uint64
+	buf          []byte
+	n            int
+	eof          bool
+}
+
+func NewChunker(r io.Reader, opts ChunkerOpts) *Chunker {
+	opts = opts.withDefaults()
+	b := bits.Len(uint(opts.AvgSize)) - 1
+	return &Chunker{
+		r:    r,
+		opts: opts,
+		// normalized chunking: harder to cut before the
+		// average size and easier after it
+		maskS: gearMask(b + 2),
+		maskL: gearMask(max(b-2, 1)),
+		buf:   make([]byte, opts.MaxSize),
+	}
+}
+
+// Next returns the next chunk, io.EOF after the last one
+func (c *Chunker) Next() ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		m, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += m
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+	cut := c.cutPoint(c.buf[:c.n])
+	chunk := append([]byte(nil), c.buf[:cut]...)
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	return chunk, nil
+}
+
+func (c *Chunker) cutPoint(data []byte) int {
+	if len(data) <= c.opts.MinSize {
+		return len(data)
+	}
+	normal := min(c.opts.AvgSize, len(data))
+	end := min(c.opts.MaxSize, len(data))
+	var fp uint64
+	i := c.opts.MinSize
+	for ; i < normal; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < end; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+// gearMask selects the high bits of the fingerprint,
+// they depend on the last 64 bytes
+func gearMask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// gear maps every byte to a random value, it is generated from a fixed
+// seed and must never change or the chunk boundaries would move.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
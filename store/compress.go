@@ -0,0 +1,276 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// CompressionFlate compresses the stored bytes with DEFLATE
+	CompressionFlate = "flate"
+	// CompressionGzip compresses the stored bytes with gzip
+	CompressionGzip = "gzip"
+)
+
+// compressSample is how much of an object is compressed to tell
+// if the rest is worth compressing
+const compressSample = 64 << 10
+
+// minCompressionGain is the percentage of its size data must shrink
+// by once compressed, less is not worth the cost of decompressing it
+// on every read
+const minCompressionGain = 10
+
+var ErrUnknownCompression = errors.New("unknown compression")
+
+// Compressions returns the compressions the store reads and writes
+func Compressions() []string {
+	return []string{CompressionGzip, CompressionFlate}
+}
+
+// ValidCompression checks that alg is a known compression or empty
+func ValidCompression(alg string) error {
+	switch alg {
+	case "", CompressionFlate, CompressionGzip:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownCompression, alg)
+}
+
+// compressor returns a writer compressing to w with alg
+func compressor(alg string, w io.Writer) (io.WriteCloser, error) {
+	switch alg {
+	case CompressionFlate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownCompression, alg)
+}
+
+// Decompress returns a reader of r decompressed with alg
+func Decompress(alg string, r io.Reader) (io.ReadCloser, error) {
+	switch alg {
+	case CompressionFlate:
+		return flate.NewReader(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownCompression, alg)
+}
+
+// Compress returns data compressed with alg
+func Compress(alg string, data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := compressor(alg, buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WorthCompressing reports if size bytes compressed to compressed
+// bytes shrink enough to be kept compressed, see minCompressionGain
+func WorthCompressing(size, compressed int64) bool {
+	return size > 0 && compressed*100 <= size*(100-minCompressionGain)
+}
+
+// compressible reports if sample is worth compressing with alg
+func compressible(alg string, sample []byte) (bool, error) {
+	compressed, err := Compress(alg, sample)
+	if err != nil {
+		return false, err
+	}
+	return WorthCompressing(int64(len(sample)), int64(len(compressed))), nil
+}
+
+// CompressedSize returns the size of r once compressed with alg
+func CompressedSize(alg string, r io.Reader) (int64, error) {
+	c := &countWriter{}
+	w, err := compressor(alg, c)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return c.n, nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// CompressStream returns r compressed with alg as it is read. The caller
+// closes the reader to stop the compression when it stops reading early.
+func CompressStream(alg string, r io.Reader) (io.ReadCloser, error) {
+	// fails early on an unknown alg
+	if _, err := compressor(alg, io.Discard); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := compressor(alg, pw)
+		if err == nil {
+			_, err = io.Copy(w, r)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// compressReader returns r compressed with alg and alg, or r as it is
+// and no compression when the start of r does not compress. The caller
+// closes the reader to stop the compression when it stops reading early.
+func compressReader(alg string, r io.Reader) (io.ReadCloser, string, error) {
+	if len(alg) == 0 {
+		return io.NopCloser(r), "", nil
+	}
+	sample := make([]byte, compressSample)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, "", err
+	}
+	sample = sample[:n]
+	r = io.MultiReader(bytes.NewReader(sample), r)
+	ok, err := compressible(alg, sample)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return io.NopCloser(r), "", nil
+	}
+	compressed, err := CompressStream(alg, r)
+	if err != nil {
+		return nil, "", err
+	}
+	return compressed, alg, nil
+}
+
+// decompressedReader reads the content of a compressed object as a
+// stream, seeking forward skips the bytes in between and seeking
+// backward decompresses again from the start
+type decompressedReader struct {
+	alg  string
+	size int64
+	// open opens the compressed bytes again
+	open func() (io.ReadCloser, error)
+	src  io.ReadCloser
+	r    io.ReadCloser
+	// pos is where r is in the content and off where the next Read starts
+	pos, off int64
+}
+
+// decompressStream returns the content of src decompressed with alg
+// as a seekable handle, size is the size of the content
+func decompressStream(alg string, size int64, src io.ReadCloser, open func() (io.ReadCloser, error)) *decompressedReader {
+	return &decompressedReader{alg: alg, size: size, open: open, src: src}
+}
+
+func (d *decompressedReader) Read(p []byte) (int, error) {
+	if d.r != nil && d.off < d.pos {
+		d.Close()
+	}
+	if d.r == nil {
+		if d.src == nil {
+			src, err := d.open()
+			if err != nil {
+				return 0, err
+			}
+			d.src = src
+		}
+		r, err := Decompress(d.alg, d.src)
+		if err != nil {
+			return 0, err
+		}
+		d.r, d.pos = r, 0
+	}
+	if d.off > d.pos {
+		n, err := io.CopyN(io.Discard, d.r, d.off-d.pos)
+		d.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := d.r.Read(p)
+	d.pos += int64(n)
+	d.off = d.pos
+	return n, err
+}
+
+func (d *decompressedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.off
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset %v", offset)
+	}
+	d.off = offset
+	return offset, nil
+}
+
+func (d *decompressedReader) Close() error {
+	var err error
+	if d.r != nil {
+		err = d.r.Close()
+	}
+	if d.src != nil {
+		err = errors.Join(err, d.src.Close())
+	}
+	d.r, d.src = nil, nil
+	return err
+}
+
+// CompressionStats describes how much space compression saves
+type CompressionStats struct {
+	Objects int
+	// LogicalSize is the total size of the compressed objects
+	LogicalSize int64
+	// StoredSize is what they take once compressed
+	StoredSize int64
+}
+
+// Ratio is the logical size over the stored size
+func (c CompressionStats) Ratio() float64 {
+	if c.StoredSize == 0 {
+		return 1
+	}
+	return float64(c.LogicalSize) / float64(c.StoredSize)
+}
+
+// CompressionStats returns the space used by the compressed objects
+func (s *Store) CompressionStats() CompressionStats {
+	stats := CompressionStats{}
+	for _, meta := range s.index.All() {
+		if len(meta.Compression) > 0 {
+			stats.Objects++
+			stats.LogicalSize += meta.Size
+			stats.StoredSize += meta.StoredSize
+		}
+	}
+	return stats
+}
@@ -0,0 +1,329 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+const chunksDirName = ".chunks"
+
+// recipe is stored in place of a deduplicated object,
+// the content is the concatenation of its chunks.
+type recipe struct {
+	Chunks []chunkRef
+}
+
+type chunkRef struct {
+	Hash string
+	Size int64
+}
+
+type chunkInfo struct {
+	refs int
+	size int64
+	// corrupt is set when the chunk was quarantined,
+	// the next object containing it writes it again
+	corrupt bool
+	// unsynced is set until the object that wrote the chunk
+	// synced it, the objects using it meanwhile sync it too
+	unsynced bool
+}
+
+// DedupStats describes how much space deduplication saves
+type DedupStats struct {
+	Objects int
+	// LogicalSize is the total size of the deduplicated objects
+	LogicalSize int64
+	// StoredSize is the total size of the chunks actually stored
+	StoredSize int64
+	Chunks     int
+}
+
+// Ratio is the logical size over the stored size
+func (d DedupStats) Ratio() float64 {
+	if d.StoredSize == 0 {
+		return 1
+	}
+	return float64(d.LogicalSize) / float64(d.StoredSize)
+}
+
+func chunkPath(hash string) string {
+	return path.Join(chunksDirName, hash[:2], hash)
+}
+
+// putDedup splits r in content-defined chunks, stores the new ones and
+// writes the recipe at p. It returns the size of the content. The
+// chunks are synced once, all together, before the recipe is written.
+func (s *Store) putDedup(p string, r io.Reader) (int64, error) {
+	rec := recipe{}
+	unsynced := []string{}
+	chunker := NewChunker(r, s.Chunker)
+	size := int64(0)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.release(rec.Chunks)
+			return size, err
+		}
+		sum := sha256.Sum256(chunk)
+		ref := chunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(chunk))}
+		synced, err := s.acquire(ref, chunk)
+		if err != nil {
+			s.release(rec.Chunks)
+			return size, err
+		}
+		if !synced {
+			unsynced = append(unsynced, chunkPath(ref.Hash))
+		}
+		rec.Chunks = append(rec.Chunks, ref)
+		size += ref.Size
+	}
+
+	err := s.syncChunks(unsynced)
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(rec)
+	}
+	if err == nil {
+		_, err = s.Backend.Put(p, bytes.NewReader(data))
+	}
+	if err != nil {
+		s.release(rec.Chunks)
+		return size, err
+	}
+	return size, nil
+}
+
+// acquire adds a reference to the chunk, storing it if it is new.
+// It reports if the chunk is already synced, see syncChunks.
+func (s *Store) acquire(ref chunkRef, chunk []byte) (bool, error) {
+	s.chunkMu.Lock()
+	defer s.chunkMu.Unlock()
+	if info, ok := s.chunks[ref.Hash]; ok && !info.corrupt {
+		info.refs++
+		return !info.unsynced, nil
+	}
+	put := s.Backend.Put
+	unsynced := false
+	if b, ok := s.Backend.(syncer); ok {
+		put, unsynced = b.PutUnsynced, true
+	}
+	if _, err := put(chunkPath(ref.Hash), bytes.NewReader(chunk)); err != nil {
+		return false, err
+	}
+	if info, ok := s.chunks[ref.Hash]; ok {
+		info.refs++
+		info.corrupt = false
+		info.unsynced = unsynced
+		return !unsynced, nil
+	}
+	s.chunks[ref.Hash] = &chunkInfo{refs: 1, size: ref.Size, unsynced: unsynced}
+	return !unsynced, nil
+}
+
+// syncChunks syncs the chunks at paths put by acquire
+func (s *Store) syncChunks(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if err := s.Backend.(syncer).Sync(paths...); err != nil {
+		return err
+	}
+	s.chunkMu.Lock()
+	defer s.chunkMu.Unlock()
+	for _, p := range paths {
+		if info, ok := s.chunks[path.Base(p)]; ok {
+			info.unsynced = false
+		}
+	}
+	return nil
+}
+
+// release drops a reference to each chunk and deletes
+// the chunks no object uses anymore
+func (s *Store) release(refs []chunkRef) error {
+	s.chunkMu.Lock()
+	defer s.chunkMu.Unlock()
+	var errs []error
+	for _, ref := range refs {
+		info, ok := s.chunks[ref.Hash]
+		if !ok {
+			continue
+		}
+		info.refs--
+		if info.refs > 0 {
+			continue
+		}
+		delete(s.chunks, ref.Hash)
+		if err := s.Backend.Delete(chunkPath(ref.Hash)); err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) readRecipe(p string) (recipe, error) {
+	f, err := s.Backend.Get(p)
+	if err != nil {
+		return recipe{}, err
+	}
+	defer f.Close()
+	rec := recipe{}
+	if err := json.NewDecoder(f).Decode(&rec); err != nil {
+		return recipe{}, fmt.Errorf("invalid recipe %v: %w", p, err)
+	}
+	return rec, nil
+}
+
+// loadChunks counts the references to the chunks from the recipes of
+// the index, then removes the chunks left behind by an interrupted write.
+func (s *Store) loadChunks() error {
+	s.chunkMu.Lock()
+	defer s.chunkMu.Unlock()
+	s.chunks = make(map[string]*chunkInfo)
+	for p, meta := range s.index.All() {
+		if !meta.Deduplicated {
+			continue
+		}
+		rec, err := s.readRecipe(p)
+		if err != nil {
+			return err
+		}
+		for _, ref := range rec.Chunks {
+			if info, ok := s.chunks[ref.Hash]; ok {
+				info.refs++
+				continue
+			}
+			s.chunks[ref.Hash] = &chunkInfo{refs: 1, size: ref.Size}
+		}
+	}
+	paths, err := s.Backend.List(chunksDirName + "/")
+	if err != nil {
+		return err
+	}
+	stored := map[string]bool{}
+	for _, p := range paths {
+		if _, ok := s.chunks[path.Base(p)]; !ok {
+			s.Backend.Delete(p)
+			continue
+		}
+		stored[path.Base(p)] = true
+	}
+	for hash, info := range s.chunks {
+		info.corrupt = !stored[hash]
+	}
+	return nil
+}
+
+// DedupStats returns the space used by the deduplicated objects
+func (s *Store) DedupStats() DedupStats {
+	stats := DedupStats{}
+	for _, meta := range s.index.All() {
+		if meta.Deduplicated {
+			stats.Objects++
+			stats.LogicalSize += meta.Size
+		}
+	}
+	s.chunkMu.Lock()
+	defer s.chunkMu.Unlock()
+	for _, info := range s.chunks {
+		if info.corrupt {
+			continue
+		}
+		stats.Chunks++
+		stats.StoredSize += info.size
+	}
+	return stats
+}
+
+// recipeReader reads the content of a recipe chunk by chunk, checking
+// the hash of each, the last chunk read is kept for the next reads.
+type recipeReader struct {
+	s       *Store
+	chunks  []chunkRef
+	offsets []int64
+	size    int64
+	pos     int64
+	index   int
+	data    []byte
+}
+
+func (s *Store) openRecipe(p string) (*recipeReader, error) {
+	rec, err := s.readRecipe(p)
+	if err != nil {
+		return nil, err
+	}
+	r := &recipeReader{s: s, chunks: rec.Chunks, index: -1}
+	for _, c := range rec.Chunks {
+		r.offsets = append(r.offsets, r.size)
+		r.size += c.Size
+	}
+	return r, nil
+}
+
+func (r *recipeReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > r.pos }) - 1
+	if i != r.index {
+		f, err := r.s.Backend.Get(chunkPath(r.chunks[i].Hash))
+		if err != nil {
+			return 0, fmt.Errorf("missing chunk %v: %w", r.chunks[i].Hash, err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != r.chunks[i].Size || hex.EncodeToString(sum[:]) != r.chunks[i].Hash {
+			return 0, fmt.Errorf("corrupted chunk %v", r.chunks[i].Hash)
+		}
+		r.index, r.data = i, data
+	}
+	n := copy(p, r.data[r.pos-r.offsets[i]:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *recipeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %v", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %v", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *recipeReader) Close() error {
+	r.data = nil
+	return nil
+}
+
+// hiddenPath reports if p is kept by the store itself, e.g. a chunk.
+// Every path of the store starting with a dot is, the chunks, versions,
+// trash and quarantine directories as well as the files of the server
+// like its buckets, and the listings and scrubs of the objects skip them.
+func hiddenPath(p string) bool {
+	return strings.HasPrefix(p, ".")
+}
@@ -0,0 +1,255 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tempPrefix starts the name of the files being written,
+// they are renamed to the object path once complete
+const tempPrefix = ".tmp-"
+
+// FSBackend keeps every object in its own file under Root
+type FSBackend struct {
+	Root string
+}
+
+// NewFSBackend returns a FSBackend under root and removes the
+// temp files left by writes interrupted by a crash.
+func NewFSBackend(root string) *FSBackend {
+	b := &FSBackend{Root: root}
+	if err := b.removeTempFiles(); err != nil {
+		log.Printf("store (%v) failed to remove temp files: %v\n", root, err)
+	}
+	return b
+}
+
+func (b *FSBackend) fullPath(p string) string {
+	return filepath.Join(b.Root, filepath.FromSlash(p))
+}
+
+// Put writes r to a temp file next to the object, syncs it and
+// renames it into place, so the object is either the old or the
+// new content even if the write fails or the node crashes.
+func (b *FSBackend) Put(p string, r io.Reader) (int64, error) {
+	return b.put(p, r, true)
+}
+
+// PutUnsynced is Put leaving the sync to Sync
+func (b *FSBackend) PutUnsynced(p string, r io.Reader) (int64, error) {
+	return b.put(p, r, false)
+}
+
+func (b *FSBackend) put(p string, r io.Reader, sync bool) (int64, error) {
+	fullPath := b.fullPath(p)
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return n, err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			return n, err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+	if err := os.Rename(f.Name(), fullPath); err != nil {
+		return n, err
+	}
+	committed = true
+	if !sync {
+		return n, nil
+	}
+	return n, syncDir(dir)
+}
+
+// Sync syncs the objects at paths and their directories
+func (b *FSBackend) Sync(paths ...string) error {
+	dirs := map[string]bool{}
+	for _, p := range paths {
+		fullPath := b.fullPath(p)
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+		dirs[filepath.Dir(fullPath)] = true
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Capacity returns the space of the file system holding Root
+func (b *FSBackend) Capacity() (Capacity, error) {
+	dir := b.Root
+	// Root is only created by the first Put
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return diskCapacity(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (b *FSBackend) removeTempFiles() error {
+	err := filepath.WalkDir(b.Root, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasPrefix(d.Name(), tempPrefix) {
+			return os.Remove(fullPath)
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *FSBackend) Get(p string) (io.ReadSeekCloser, error) {
+	f, err := os.Open(b.fullPath(p))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %v", ErrNotFound, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (b *FSBackend) Stat(p string) (Info, error) {
+	fi, err := os.Stat(b.fullPath(p))
+	if errors.Is(err, os.ErrNotExist) || (err == nil && fi.IsDir()) {
+		return Info{}, fmt.Errorf("%w: %v", ErrNotFound, p)
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Delete removes the file and the directories left empty by it
+func (b *FSBackend) Delete(p string) error {
+	fullPath := b.fullPath(p)
+	if err := os.Remove(fullPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %v", ErrNotFound, p)
+		}
+		return err
+	}
+	b.removeEmptyDirs(filepath.Dir(fullPath))
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents under Root until one is not empty
+func (b *FSBackend) removeEmptyDirs(dir string) {
+	root := filepath.Clean(b.Root)
+	for ; dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// fails once the directory is not empty
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+}
+
+// Rename moves the file at from to to and syncs both directories
+func (b *FSBackend) Rename(from, to string) error {
+	fromPath, toPath := b.fullPath(from), b.fullPath(to)
+	if _, err := os.Stat(fromPath); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %v", ErrNotFound, from)
+	}
+	dir := filepath.Dir(toPath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(fromPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	b.removeEmptyDirs(filepath.Dir(fromPath))
+	return nil
+}
+
+func (b *FSBackend) List(prefix string) ([]string, error) {
+	paths := []string{}
+	err := filepath.WalkDir(b.Root, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(b.Root, fullPath)
+		if err != nil {
+			return err
+		}
+		p := filepath.ToSlash(rel)
+		if d.IsDir() && fullPath != b.Root && strings.HasPrefix(d.Name(), ".") && !strings.HasPrefix(prefix, p+"/") {
+			// e.g. the store index, unless the prefix is inside it
+			return filepath.SkipDir
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		if strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	// the walk visits "a/b" before "a.b", the order of the
+	// directories and not the lexical order of the paths
+	sort.Strings(paths)
+	return paths, err
+}
+
+func (b *FSBackend) Clear() error {
+	return os.RemoveAll(b.Root)
+}
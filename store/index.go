@@ -0,0 +1,366 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	indexLogName      = "index.log"
+	indexSnapshotName = "index.snapshot"
+	// DefaultSnapshotEvery is the number of log records
+	// after which the Index writes a new snapshot
+	DefaultSnapshotEvery = 1000
+)
+
+// Metadata describes an object stored in the Store
+type Metadata struct {
+	Id string
+	// Key is the key the object is stored under
+	Key string
+	// Name is the original name of the key, on peers the key is
+	// a hash and the name is only known sealed by the owner
+	Name       string
+	SealedName []byte
+	// SealedAttributes are the ContentType and Headers of a
+	// replica, sealed by the owner like the name
+	SealedAttributes []byte `json:",omitempty"`
+	Size             int64
+	Created          time.Time
+	Modified         time.Time
+	// Checksum is the hex sha256 of the stored bytes
+	Checksum string
+	// ContentChecksum is the hex sha256 of the original content,
+	// the same as Checksum unless the object is a replica
+	ContentChecksum string
+	ContentType     string
+	// Headers are user-defined attributes of the object
+	Headers map[string]string
+	// Manifest is set when the object lists the chunks of the
+	// content instead of holding it
+	Manifest bool `json:",omitempty"`
+	// Deduplicated is set by the store when the object is kept
+	// as a list of chunks, see StoreOpts.Dedup
+	Deduplicated bool `json:",omitempty"`
+	// StorageClass is how the object is kept across the
+	// peers, replicated in full when empty
+	StorageClass string `json:",omitempty"`
+	// Expires is when the object is deleted, never when nil
+	Expires *time.Time `json:",omitempty"`
+	// Namespace groups objects under a common quota
+	Namespace string `json:",omitempty"`
+	// Bucket is the bucket of the object, Key is then made
+	// by BucketKey and Name is the key in the bucket
+	Bucket string `json:",omitempty"`
+	// Accessed is when the object was last read, within an hour
+	Accessed time.Time
+	// Tier is TierCold once the object moved to the cold tier
+	Tier string `json:",omitempty"`
+	// Compression is how the stored bytes are compressed, the
+	// size and checksums are the ones of the uncompressed bytes.
+	// It asks for a compression when writing, see Store.WriteMeta.
+	Compression string `json:",omitempty"`
+	// StoredSize is what a compressed object takes in its tier
+	StoredSize int64 `json:",omitempty"`
+	// ContentEncoding is set on a replica whose content was compressed
+	// with it before the encryption, ContentSize is then its size once
+	// decrypted and decompressed. The store keeps such replicas as sent.
+	ContentEncoding string `json:",omitempty"`
+	ContentSize     int64  `json:",omitempty"`
+	// VersionId is set on the objects of a versioned namespace, see
+	// Store.SetVersioning. Archived is when the version was replaced,
+	// zero for the current object, and DeleteMarker is set on the
+	// versions left by a delete, they have no content.
+	VersionId    string `json:",omitempty"`
+	Archived     time.Time
+	DeleteMarker bool `json:",omitempty"`
+	// Deleted is when the object was moved to the trash
+	Deleted time.Time
+	// ContentKey is the wrapped key the replicas of the object are
+	// encrypted with when it differs from the node's own key
+	ContentKey []byte `json:",omitempty"`
+}
+
+// Expired reports if the object expired at now
+func (m Metadata) Expired(now time.Time) bool {
+	// the records written before Expires was a pointer carry a zero time
+	return m.Expires != nil && !m.Expires.IsZero() && !now.Before(*m.Expires)
+}
+
+type indexRecord struct {
+	Delete bool `json:",omitempty"`
+	Path   string
+	Meta   Metadata
+}
+
+// Index maps the objects of a store to their Metadata. It is kept in
+// an append-only log under Dir with a snapshot written every
+// SnapshotEvery records, without a Dir it only lives in memory.
+type Index struct {
+	Dir           string
+	SnapshotEvery int
+
+	mu      sync.RWMutex
+	entries map[string]Metadata
+	log     *os.File
+	records int
+}
+
+// OpenIndex loads the index kept under dir, an empty
+// dir keeps the index in memory.
+func OpenIndex(dir string) (*Index, error) {
+	idx := &Index{
+		Dir:           dir,
+		SnapshotEvery: DefaultSnapshotEvery,
+		entries:       make(map[string]Metadata),
+	}
+	if len(dir) == 0 {
+		return idx, nil
+	}
+	if err := idx.load(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// openLog opens the log on the first write so an
+// unused index leaves nothing on disk
+func (idx *Index) openLog() error {
+	if idx.log != nil {
+		return nil
+	}
+	if err := os.MkdirAll(idx.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(idx.Dir, indexLogName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	idx.log = f
+	return nil
+}
+
+func (idx *Index) load() error {
+	data, err := os.ReadFile(filepath.Join(idx.Dir, indexSnapshotName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &idx.entries); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(idx.Dir, indexLogName), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// torn last record of a crash, the next append
+				// must not be glued to it
+				log.Printf("index (%v) dropping the torn record at %v\n", idx.Dir, offset)
+				return f.Truncate(offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec indexRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Printf("index (%v) skipping the corrupt record at %v: %v\n", idx.Dir, offset, err)
+		} else {
+			idx.apply(rec)
+			idx.records++
+		}
+		offset += int64(len(line))
+	}
+}
+
+func (idx *Index) apply(rec indexRecord) {
+	if rec.Delete {
+		delete(idx.entries, rec.Path)
+		return
+	}
+	idx.entries[rec.Path] = rec.Meta
+}
+
+// Empty reports if the index has no entries, e.g. when it
+// was just created over a store that already has objects.
+func (idx *Index) Empty() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.entries) == 0 && idx.records == 0
+}
+
+func (idx *Index) Get(path string) (Metadata, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	m, ok := idx.entries[path]
+	return m, ok
+}
+
+func (idx *Index) Put(path string, m Metadata) error {
+	return idx.append(indexRecord{Path: path, Meta: m})
+}
+
+func (idx *Index) Delete(path string) error {
+	return idx.append(indexRecord{Path: path, Delete: true})
+}
+
+// All returns the metadata of every object by path
+func (idx *Index) All() map[string]Metadata {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return maps.Clone(idx.entries)
+}
+
+// Usage sums the objects matching match
+func (idx *Index) Usage(match func(Metadata) bool) Usage {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	u := Usage{}
+	for _, m := range idx.entries {
+		if match(m) && !m.DeleteMarker {
+			u.Objects++
+			u.Bytes += m.Size
+		}
+	}
+	return u
+}
+
+// Entries returns the metadata of the objects of id sorted by Name,
+// the older versions of the objects are left out
+func (idx *Index) Entries(id string) []Metadata {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	entries := []Metadata{}
+	for p, m := range idx.entries {
+		if m.Id == id && !hiddenPath(p) {
+			entries = append(entries, m)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name == entries[j].Name {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+func (idx *Index) append(rec indexRecord) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if len(idx.Dir) > 0 {
+		if err := idx.openLog(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if _, err := idx.log.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		if err := idx.log.Sync(); err != nil {
+			return err
+		}
+	}
+	idx.apply(rec)
+	idx.records++
+	if idx.log != nil && idx.records >= idx.SnapshotEvery {
+		return idx.snapshot()
+	}
+	return nil
+}
+
+// Snapshot writes all the entries to the snapshot file and truncates the log
+func (idx *Index) Snapshot() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.log == nil {
+		return nil
+	}
+	return idx.snapshot()
+}
+
+func (idx *Index) snapshot() error {
+	data, err := json.Marshal(idx.entries)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(idx.Dir, tempPrefix+indexSnapshotName)
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(idx.Dir, indexSnapshotName)); err != nil {
+		return err
+	}
+	if err := syncDir(idx.Dir); err != nil {
+		return err
+	}
+	// the log is only truncated once the snapshot holds its records
+	if err := idx.log.Truncate(0); err != nil {
+		return err
+	}
+	idx.records = 0
+	return nil
+}
+
+// Clear drops every entry and removes the index files
+func (idx *Index) Clear() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.entries = make(map[string]Metadata)
+	idx.records = 0
+	if len(idx.Dir) == 0 {
+		return nil
+	}
+	if err := idx.close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(idx.Dir)
+}
+
+func (idx *Index) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.close()
+}
+
+func (idx *Index) close() error {
+	if idx.log == nil {
+		return nil
+	}
+	err := idx.log.Close()
+	idx.log = nil
+	return err
+}
@@ -0,0 +1,280 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logOpPut    = byte(1)
+	logOpDelete = byte(2)
+	// op | mod time | path length
+	logHeaderSize = 1 + 8 + 2
+	// uncommitted is the size of a put record still being written
+	uncommitted = int64(-1)
+)
+
+// LogBackend keeps every object in a single append-only file.
+// Each put or delete appends a record, the latest record of a
+// path wins. Compact drops the records that were overwritten.
+//
+// A record is op | mod time | path length | path | size | data,
+// the size is written last so a torn write is dropped on open.
+type LogBackend struct {
+	mu    sync.RWMutex
+	path  string
+	f     *os.File
+	end   int64
+	index map[string]logEntry
+}
+
+type logEntry struct {
+	offset  int64
+	size    int64
+	modTime time.Time
+}
+
+// OpenLogBackend opens or creates the log file at path
+// and rebuilds the index from its records.
+func OpenLogBackend(path string) (*LogBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// the spooled puts of a crash, see Put
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(path), tempPrefix+filepath.Base(path)+"-*"))
+	for _, tmp := range leftovers {
+		os.Remove(tmp)
+	}
+	b := &LogBackend{path: path, f: f, index: make(map[string]logEntry)}
+	if err := b.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *LogBackend) replay() error {
+	r := bufio.NewReader(io.NewSectionReader(b.f, 0, 1<<62))
+	offset := int64(0)
+	for {
+		op, p, modTime, size, err := readLogRecord(r)
+		if err != nil || (op == logOpPut && size == uncommitted) {
+			// EOF or the torn tail of an interrupted write
+			break
+		}
+		dataOffset := offset + logHeaderSize + int64(len(p)) + 8
+		if op == logOpDelete {
+			delete(b.index, p)
+			offset = dataOffset
+			continue
+		}
+		if op != logOpPut {
+			return fmt.Errorf("invalid log record %v at %v", op, offset)
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			break
+		}
+		b.index[p] = logEntry{offset: dataOffset, size: size, modTime: modTime}
+		offset = dataOffset + size
+	}
+	b.end = offset
+	return b.f.Truncate(offset)
+}
+
+func readLogRecord(r io.Reader) (byte, string, time.Time, int64, error) {
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", time.Time{}, 0, err
+	}
+	p := make([]byte, binary.LittleEndian.Uint16(header[9:]))
+	if _, err := io.ReadFull(r, p); err != nil {
+		return 0, "", time.Time{}, 0, io.ErrUnexpectedEOF
+	}
+	var size int64
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return 0, "", time.Time{}, 0, io.ErrUnexpectedEOF
+	}
+	modTime := time.Unix(0, int64(binary.LittleEndian.Uint64(header[1:])))
+	return header[0], string(p), modTime, size, nil
+}
+
+func (b *LogBackend) appendHeader(op byte, p string, modTime time.Time, size int64) (int64, error) {
+	if len(p) > 1<<16-1 {
+		return 0, fmt.Errorf("path too long: %v", p)
+	}
+	buf := make([]byte, 0, logHeaderSize+len(p)+8)
+	buf = append(buf, op)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(modTime.UnixNano()))
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(p)))
+	buf = append(buf, p...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(size))
+	if _, err := b.f.WriteAt(buf, b.end); err != nil {
+		return 0, err
+	}
+	return b.end + int64(len(buf)), nil
+}
+
+// Put spools r to a temp file next to the log first, so a slow
+// reader does not hold back the other writes while it streams
+func (b *LogBackend) Put(p string, r io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), tempPrefix+filepath.Base(b.path)+"-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return n, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.put(p, io.LimitReader(tmp, n), time.Now())
+}
+
+func (b *LogBackend) put(p string, r io.Reader, modTime time.Time) (int64, error) {
+	dataOffset, err := b.appendHeader(logOpPut, p, modTime, uncommitted)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.NewOffsetWriter(b.f, dataOffset), r)
+	if err == nil {
+		err = b.f.Sync()
+	}
+	if err == nil {
+		// commit the record by writing its size
+		_, err = b.f.WriteAt(binary.LittleEndian.AppendUint64(nil, uint64(n)), dataOffset-8)
+	}
+	if err == nil {
+		err = b.f.Sync()
+	}
+	if err != nil {
+		b.f.Truncate(b.end)
+		return n, err
+	}
+	b.end = dataOffset + n
+	b.index[p] = logEntry{offset: dataOffset, size: n, modTime: modTime}
+	return n, nil
+}
+
+func (b *LogBackend) Get(p string) (io.ReadSeekCloser, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	e, ok := b.index[p]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrNotFound, p)
+	}
+	return nopSeekCloser{io.NewSectionReader(b.f, e.offset, e.size)}, nil
+}
+
+func (b *LogBackend) Stat(p string) (Info, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	e, ok := b.index[p]
+	if !ok {
+		return Info{}, fmt.Errorf("%w: %v", ErrNotFound, p)
+	}
+	return Info{Size: e.size, ModTime: e.modTime}, nil
+}
+
+func (b *LogBackend) Delete(p string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.index[p]; !ok {
+		return fmt.Errorf("%w: %v", ErrNotFound, p)
+	}
+	end, err := b.appendHeader(logOpDelete, p, time.Now(), 0)
+	if err == nil {
+		// the object would come back after a crash otherwise
+		err = b.f.Sync()
+	}
+	if err != nil {
+		b.f.Truncate(b.end)
+		return err
+	}
+	b.end = end
+	delete(b.index, p)
+	return nil
+}
+
+func (b *LogBackend) List(prefix string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	paths := []string{}
+	for p := range b.index {
+		if strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Compact rewrites the log with only the live objects. Readers
+// returned by Get before the compaction must not be used after it.
+func (b *LogBackend) Compact() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// a leftover of a compaction that did not finish
+	os.Remove(b.path + ".compact")
+	tmp, err := OpenLogBackend(b.path + ".compact")
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(b.index))
+	for p := range b.index {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		e := b.index[p]
+		if _, err := tmp.put(p, io.NewSectionReader(b.f, e.offset, e.size), e.modTime); err != nil {
+			tmp.Close()
+			os.Remove(tmp.path)
+			return err
+		}
+	}
+	if err := tmp.f.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.path, b.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	b.f.Close()
+	b.f, b.end, b.index = tmp.f, tmp.end, tmp.index
+	// the rename itself is only durable once the directory is synced
+	return syncDir(filepath.Dir(b.path))
+}
+
+func (b *LogBackend) Clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.f.Truncate(0); err != nil {
+		return err
+	}
+	b.end = 0
+	b.index = make(map[string]logEntry)
+	return nil
+}
+
+func (b *LogBackend) Close() error {
+	return b.f.Close()
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps the objects in memory, it is meant
+// for tests and for nodes running on tmpfs-like budgets.
+type MemoryBackend struct {
+	// Limit is the most bytes kept, no limit when zero
+	Limit int64
+
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+	used    int64
+	// failPrefix and failErr are set by Fail
+	failPrefix string
+	failErr    error
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{objects: make(map[string]memoryObject)}
+}
+
+// Fail makes the operations on the paths starting with prefix fail
+// with err, every path failing like a dead disk with an empty prefix.
+// A nil err makes them succeed again.
+func (b *MemoryBackend) Fail(prefix string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failPrefix, b.failErr = prefix, err
+}
+
+// failed returns the error set by Fail for p, b.mu must be held
+func (b *MemoryBackend) failed(p string) error {
+	if b.failErr != nil && strings.HasPrefix(p, b.failPrefix) {
+		return b.failErr
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Put(p string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.failed(p); err != nil {
+		return 0, err
+	}
+	used := b.used - int64(len(b.objects[p].data)) + int64(len(data))
+	if b.Limit > 0 && used > b.Limit {
+		return 0, fmt.Errorf("%w: %v bytes over the limit", ErrNoSpace, used-b.Limit)
+	}
+	b.objects[p] = memoryObject{data: data, modTime: time.Now()}
+	b.used = used
+	return int64(len(data)), nil
+}
+
+func (b *MemoryBackend) Get(p string) (io.ReadSeekCloser, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.failed(p); err != nil {
+		return nil, err
+	}
+	obj, ok := b.objects[p]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrNotFound, p)
+	}
+	// the data is never modified in place, Put replaces it
+	return nopSeekCloser{bytes.NewReader(obj.data)}, nil
+}
+
+func (b *MemoryBackend) Stat(p string) (Info, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.failed(p); err != nil {
+		return Info{}, err
+	}
+	obj, ok := b.objects[p]
+	if !ok {
+		return Info{}, fmt.Errorf("%w: %v", ErrNotFound, p)
+	}
+	return Info{Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (b *MemoryBackend) Delete(p string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.failed(p); err != nil {
+		return err
+	}
+	obj, ok := b.objects[p]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrNotFound, p)
+	}
+	delete(b.objects, p)
+	b.used -= int64(len(obj.data))
+	return nil
+}
+
+func (b *MemoryBackend) Rename(from, to string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, p := range []string{from, to} {
+		if err := b.failed(p); err != nil {
+			return err
+		}
+	}
+	obj, ok := b.objects[from]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrNotFound, from)
+	}
+	if from == to {
+		return nil
+	}
+	b.used -= int64(len(b.objects[to].data))
+	b.objects[to] = obj
+	delete(b.objects, from)
+	return nil
+}
+
+func (b *MemoryBackend) List(prefix string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	paths := []string{}
+	for p := range b.objects {
+		if strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (b *MemoryBackend) Clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects = make(map[string]memoryObject)
+	b.used = 0
+	return nil
+}
+
+// Capacity returns the space left under Limit
+func (b *MemoryBackend) Capacity() (Capacity, error) {
+	if b.Limit <= 0 {
+		return Capacity{}, ErrCapacityUnknown
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return Capacity{Total: b.Limit, Free: b.Limit - b.used}, nil
+}
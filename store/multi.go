@@ -0,0 +1,653 @@
+package store
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// PlaceHash puts each object on the disk picked by rendezvous
+	// hashing of its path, adding a disk only moves the objects it wins
+	PlaceHash = "hash"
+	// PlaceFreeSpace puts each object on the disk with the most room
+	PlaceFreeSpace = "free"
+)
+
+// probePath is written and read back by Check on every disk
+const probePath = ".probe"
+
+var (
+	ErrNoDisk     = errors.New("no healthy disk")
+	ErrDiskExists = errors.New("disk already exists")
+)
+
+// MultiBackend spreads the objects over several disks (JBOD), each
+// object is kept whole on one of them. A disk that fails an operation
+// and then its probe is marked failed and its objects are dropped,
+// OnFail tells the owner of the store to bring them back from
+// elsewhere. A failed disk can be added back once replaced.
+type MultiBackend struct {
+	// Placement is PlaceHash or PlaceFreeSpace, PlaceHash when empty
+	Placement string
+	// OnFail is called with the name of a disk once it is marked failed
+	OnFail func(disk string)
+
+	mu    sync.RWMutex
+	disks []*disk
+	// locations holds where each path is
+	locations map[string]location
+	// paths holds the locks of the paths being written or moved
+	paths map[string]*pathLock
+}
+
+// pathLock is held while a path is written, moved or deleted
+type pathLock struct {
+	sync.Mutex
+	holders int
+}
+
+type disk struct {
+	name    string
+	backend Backend
+	// used is the size of the objects on the disk
+	used   int64
+	failed error
+}
+
+type location struct {
+	disk *disk
+	size int64
+}
+
+// DiskStatus describes a disk of a MultiBackend
+type DiskStatus struct {
+	Name    string
+	Objects int
+	Used    int64
+	// Capacity is the space of the disk when it can tell
+	Capacity *Capacity
+	// Failed is why the disk was marked failed, nil while healthy
+	Failed error
+}
+
+// NewMultiBackend returns a MultiBackend over the FSBackends of roots,
+// each root is expected on its own disk
+func NewMultiBackend(placement string, roots ...string) (*MultiBackend, error) {
+	b := &MultiBackend{Placement: placement, locations: make(map[string]location)}
+	for _, root := range roots {
+		if err := b.AddDisk(root, NewFSBackend(root)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// AddDisk adds the disk name kept by backend and indexes the objects
+// already on it, see Rebalance to move objects onto a new disk. It
+// replaces the disk of the same name if that one failed.
+func (b *MultiBackend) AddDisk(name string, backend Backend) error {
+	paths, err := listAll(backend)
+	if err != nil {
+		return err
+	}
+	d := &disk{name: name, backend: backend}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.locations == nil {
+		b.locations = make(map[string]location)
+	}
+	replaced := -1
+	for i, other := range b.disks {
+		if other.name != name {
+			continue
+		}
+		if other.failed == nil {
+			return fmt.Errorf("%w: %v", ErrDiskExists, name)
+		}
+		replaced = i
+	}
+	for _, p := range paths {
+		info, err := backend.Stat(p)
+		if err != nil {
+			continue
+		}
+		if old, ok := b.locations[p]; ok {
+			// left behind by an interrupted move, or by a write made while
+			// the disk was failed, the copy in use is kept
+			log.Printf("multi backend: %v is on %v and %v\n", p, old.disk.name, name)
+			continue
+		}
+		b.locations[p] = location{disk: d, size: info.Size}
+		d.used += info.Size
+	}
+	if replaced >= 0 {
+		b.disks[replaced] = d
+		return nil
+	}
+	b.disks = append(b.disks, d)
+	return nil
+}
+
+// listAll returns the paths of backend, the ones kept by the
+// store in its hidden directories included
+func listAll(backend Backend) ([]string, error) {
+	seen := map[string]bool{probePath: true}
+	paths := []string{}
+	for _, prefix := range []string{"", chunksDirName + "/", quarantineDirName + "/", versionsDirName + "/", trashDirName + "/"} {
+		found, err := backend.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range found {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// Disks returns the status of every disk
+func (b *MultiBackend) Disks() []DiskStatus {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	status := make([]DiskStatus, len(b.disks))
+	for i, d := range b.disks {
+		status[i] = DiskStatus{Name: d.name, Used: d.used, Failed: d.failed}
+		if c, err := capacityOf(d.backend); err == nil {
+			status[i].Capacity = &c
+		}
+	}
+	for _, l := range b.locations {
+		for i := range b.disks {
+			if b.disks[i] == l.disk {
+				status[i].Objects++
+			}
+		}
+	}
+	return status
+}
+
+// Check writes and reads back a probe on every healthy disk
+// and marks failed the ones that cannot, it returns them.
+func (b *MultiBackend) Check() []string {
+	failed := []string{}
+	for _, d := range b.healthy() {
+		err := probe(d.backend)
+		if err != nil {
+			b.fail(d, err)
+			failed = append(failed, d.name)
+		}
+	}
+	return failed
+}
+
+func probe(backend Backend) error {
+	data := []byte("probe")
+	if _, err := backend.Put(probePath, strings.NewReader(string(data))); err != nil {
+		return err
+	}
+	f, err := backend.Get(probePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if string(got) != string(data) {
+		return fmt.Errorf("probe read back %q", got)
+	}
+	return nil
+}
+
+func (b *MultiBackend) healthy() []*disk {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	disks := []*disk{}
+	for _, d := range b.disks {
+		if d.failed == nil {
+			disks = append(disks, d)
+		}
+	}
+	return disks
+}
+
+// suspect probes d after an operation failed with err and marks it
+// failed if the probe fails too, the errors about a single object
+// leave the disk healthy
+func (b *MultiBackend) suspect(d *disk, err error) {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrNoSpace) {
+		return
+	}
+	if probeErr := probe(d.backend); probeErr != nil {
+		b.fail(d, fmt.Errorf("%w, then the probe: %w", err, probeErr))
+		return
+	}
+	log.Printf("multi backend: disk %v passed its probe after an error: %v\n", d.name, err)
+}
+
+// fail marks d failed after err and forgets the objects on it
+func (b *MultiBackend) fail(d *disk, err error) {
+	b.mu.Lock()
+	if d.failed != nil {
+		b.mu.Unlock()
+		return
+	}
+	d.failed = err
+	lost := 0
+	for p, l := range b.locations {
+		if l.disk == d {
+			delete(b.locations, p)
+			lost++
+		}
+	}
+	d.used = 0
+	onFail := b.OnFail
+	b.mu.Unlock()
+	log.Printf("multi backend: disk %v failed, %v objects lost: %v\n", d.name, lost, err)
+	if onFail != nil {
+		onFail(d.name)
+	}
+}
+
+// lock locks p against the other writes, moves and deletes of p
+// and returns the func unlocking it
+func (b *MultiBackend) lock(p string) func() {
+	b.mu.Lock()
+	if b.paths == nil {
+		b.paths = make(map[string]*pathLock)
+	}
+	l, ok := b.paths[p]
+	if !ok {
+		l = &pathLock{}
+		b.paths[p] = l
+	}
+	l.holders++
+	b.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if l.holders--; l.holders == 0 {
+			delete(b.paths, p)
+		}
+	}
+}
+
+// place returns the disk to write p to
+func (b *MultiBackend) place(p string) (*disk, error) {
+	disks := b.healthy()
+	if len(disks) == 0 {
+		return nil, ErrNoDisk
+	}
+	if b.Placement == PlaceFreeSpace {
+		return b.roomiest(disks), nil
+	}
+	return rendezvous(p, disks), nil
+}
+
+// rendezvous returns the disk of disks with the highest weight for p
+func rendezvous(p string, disks []*disk) *disk {
+	var best *disk
+	var bestWeight string
+	for _, d := range disks {
+		sum := sha256.Sum256([]byte(d.name + "/" + p))
+		if w := string(sum[:]); best == nil || w > bestWeight {
+			best, bestWeight = d, w
+		}
+	}
+	return best
+}
+
+// room is the free space of d, or the opposite of its use for
+// the disks that cannot tell their free space
+func (b *MultiBackend) room(d *disk) int64 {
+	if c, err := capacityOf(d.backend); err == nil {
+		return c.Free
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return -d.used
+}
+
+func (b *MultiBackend) roomiest(disks []*disk) *disk {
+	best, bestRoom := disks[0], b.room(disks[0])
+	for _, d := range disks[1:] {
+		if r := b.room(d); r > bestRoom {
+			best, bestRoom = d, r
+		}
+	}
+	return best
+}
+
+func capacityOf(backend Backend) (Capacity, error) {
+	c, ok := backend.(capacitor)
+	if !ok {
+		return Capacity{}, ErrCapacityUnknown
+	}
+	return c.Capacity()
+}
+
+func (b *MultiBackend) locate(p string) (*disk, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	l, ok := b.locations[p]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrNotFound, p)
+	}
+	return l.disk, nil
+}
+
+func (b *MultiBackend) Put(p string, r io.Reader) (int64, error) {
+	return b.put(p, r, false)
+}
+
+// PutUnsynced is Put leaving the sync to Sync on the disks that can
+func (b *MultiBackend) PutUnsynced(p string, r io.Reader) (int64, error) {
+	return b.put(p, r, true)
+}
+
+func (b *MultiBackend) put(p string, r io.Reader, unsynced bool) (int64, error) {
+	defer b.lock(p)()
+	d, err := b.place(p)
+	if err != nil {
+		return 0, err
+	}
+	src := &sourceReader{r: r}
+	put := d.backend.Put
+	if s, ok := d.backend.(syncer); ok && unsynced {
+		put = s.PutUnsynced
+	}
+	n, err := put(p, src)
+	if err != nil {
+		if src.err == nil || src.err == io.EOF {
+			// not the reader, the disk
+			b.suspect(d, err)
+		}
+		return n, err
+	}
+	b.moved(p, d, n)
+	return n, nil
+}
+
+// sourceReader keeps the last error of r to tell the errors
+// of the data written apart from the errors of the disk
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.err = err
+	return n, err
+}
+
+// moved records that p of n bytes is now on d and deletes
+// the copy left on the disk it was on before
+func (b *MultiBackend) moved(p string, d *disk, n int64) {
+	b.mu.Lock()
+	old, ok := b.locations[p]
+	if ok {
+		old.disk.used -= old.size
+	}
+	b.locations[p] = location{disk: d, size: n}
+	d.used += n
+	b.mu.Unlock()
+	if ok && old.disk != d {
+		if err := old.disk.backend.Delete(p); err != nil {
+			b.suspect(old.disk, err)
+		}
+	}
+}
+
+// Sync syncs the objects at paths on the disks they are on
+func (b *MultiBackend) Sync(paths ...string) error {
+	byDisk := map[*disk][]string{}
+	for _, p := range paths {
+		d, err := b.locate(p)
+		if err != nil {
+			return err
+		}
+		byDisk[d] = append(byDisk[d], p)
+	}
+	for d, paths := range byDisk {
+		s, ok := d.backend.(syncer)
+		if !ok {
+			continue
+		}
+		if err := s.Sync(paths...); err != nil {
+			b.suspect(d, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *MultiBackend) Get(p string) (io.ReadSeekCloser, error) {
+	d, err := b.locate(p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.backend.Get(p)
+	if err != nil {
+		b.suspect(d, err)
+		return nil, err
+	}
+	return f, nil
+}
+
+func (b *MultiBackend) Stat(p string) (Info, error) {
+	d, err := b.locate(p)
+	if err != nil {
+		return Info{}, err
+	}
+	info, err := d.backend.Stat(p)
+	if err != nil {
+		b.suspect(d, err)
+	}
+	return info, err
+}
+
+func (b *MultiBackend) Delete(p string) error {
+	defer b.lock(p)()
+	d, err := b.locate(p)
+	if err != nil {
+		return err
+	}
+	if err := d.backend.Delete(p); err != nil {
+		b.suspect(d, err)
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if l, ok := b.locations[p]; ok && l.disk == d {
+		delete(b.locations, p)
+		d.used -= l.size
+	}
+	return nil
+}
+
+// Rename moves the object at from to to on the disk it is on
+func (b *MultiBackend) Rename(from, to string) error {
+	if from == to {
+		_, err := b.locate(from)
+		return err
+	}
+	// in order, against a rename the other way
+	first, second := from, to
+	if second < first {
+		first, second = second, first
+	}
+	defer b.lock(first)()
+	defer b.lock(second)()
+	d, err := b.locate(from)
+	if err != nil {
+		return err
+	}
+	if err := rename(d.backend, from, to); err != nil {
+		b.suspect(d, err)
+		return err
+	}
+	b.mu.Lock()
+	l := b.locations[from]
+	delete(b.locations, from)
+	old, ok := b.locations[to]
+	if ok {
+		old.disk.used -= old.size
+	}
+	b.locations[to] = location{disk: d, size: l.size}
+	b.mu.Unlock()
+	if ok && old.disk != d {
+		if err := old.disk.backend.Delete(to); err != nil {
+			b.suspect(old.disk, err)
+		}
+	}
+	return nil
+}
+
+func (b *MultiBackend) List(prefix string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	paths := []string{}
+	for p := range b.locations {
+		if strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Capacity returns the total of the healthy disks that can tell it
+func (b *MultiBackend) Capacity() (Capacity, error) {
+	total := Capacity{}
+	known := false
+	for _, d := range b.healthy() {
+		c, err := capacityOf(d.backend)
+		if err != nil {
+			continue
+		}
+		total.Total += c.Total
+		total.Free += c.Free
+		known = true
+	}
+	if !known {
+		return Capacity{}, ErrCapacityUnknown
+	}
+	return total, nil
+}
+
+// Rebalance moves the objects to the disk the Placement picks for them,
+// onto a newly added disk for instance. With PlaceFreeSpace objects
+// move from the fullest disk to the roomiest one while it evens them
+// out. It returns the number of objects moved.
+func (b *MultiBackend) Rebalance() (int, error) {
+	paths, _ := b.List("")
+	moved := 0
+	for _, p := range paths {
+		ok, err := b.rebalance(p)
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// rebalance moves p to the disk the Placement picks for it, p is
+// locked so a write of p cannot be lost under the move
+func (b *MultiBackend) rebalance(p string) (bool, error) {
+	defer b.lock(p)()
+	from, err := b.locate(p)
+	if err != nil {
+		// deleted since listed
+		return false, nil
+	}
+	to, err := b.rebalanceTarget(p, from)
+	if err != nil || to == nil || to == from {
+		return false, err
+	}
+	return true, b.move(p, from, to)
+}
+
+// rebalanceTarget returns the disk p should move to, nil to keep it
+func (b *MultiBackend) rebalanceTarget(p string, from *disk) (*disk, error) {
+	disks := b.healthy()
+	if len(disks) == 0 {
+		return nil, ErrNoDisk
+	}
+	if b.Placement != PlaceFreeSpace {
+		return rendezvous(p, disks), nil
+	}
+	b.mu.RLock()
+	size := b.locations[p].size
+	b.mu.RUnlock()
+	to := b.roomiest(disks)
+	// only when the disks end up closer than they were
+	if b.room(to)-b.room(from) <= size {
+		return nil, nil
+	}
+	return to, nil
+}
+
+// move copies p from one disk to another, p must be locked
+func (b *MultiBackend) move(p string, from, to *disk) error {
+	f, err := from.backend.Get(p)
+	if err != nil {
+		b.suspect(from, err)
+		return err
+	}
+	defer f.Close()
+	src := &sourceReader{r: f}
+	n, err := to.backend.Put(p, src)
+	if err != nil {
+		if src.err == nil || src.err == io.EOF {
+			b.suspect(to, err)
+		} else {
+			b.suspect(from, src.err)
+		}
+		return err
+	}
+	b.moved(p, to, n)
+	return nil
+}
+
+func (b *MultiBackend) Clear() error {
+	for _, d := range b.healthy() {
+		if c, ok := d.backend.(clearer); ok {
+			if err := c.Clear(); err != nil {
+				return err
+			}
+			continue
+		}
+		paths, err := listAll(d.backend)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			if err := d.backend.Delete(p); err != nil {
+				return err
+			}
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.locations = make(map[string]location)
+	for _, d := range b.disks {
+		d.used = 0
+	}
+	return nil
+}
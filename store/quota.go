@@ -0,0 +1,249 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrQuotaExceeded is returned when a write does not fit in a quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits what an owner or a namespace stores, zero is no limit
+type Quota struct {
+	Bytes   int64
+	Objects int
+}
+
+// Usage is what an owner or a namespace stores
+type Usage struct {
+	Bytes   int64
+	Objects int
+}
+
+// SetQuota sets the quota of the owner id, in place of StoreOpts.OwnerQuota
+func (s *Store) SetQuota(id string, q Quota) {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	s.ownerQuotas[id] = q
+}
+
+// SetNamespaceQuota sets the quota of the namespace ns,
+// in place of StoreOpts.NamespaceQuota
+func (s *Store) SetNamespaceQuota(ns string, q Quota) {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	s.namespaceQuotas[ns] = q
+}
+
+// RemoveNamespaceQuota drops the quota set by SetNamespaceQuota,
+// the namespace ns is back to StoreOpts.NamespaceQuota
+func (s *Store) RemoveNamespaceQuota(ns string) {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	delete(s.namespaceQuotas, ns)
+}
+
+// quotas returns the quotas of the owner id and the namespace ns,
+// quotaMu must be held
+func (s *Store) quotas(id, ns string) (Quota, Quota) {
+	owner, ok := s.ownerQuotas[id]
+	if !ok {
+		owner = s.OwnerQuota
+	}
+	namespace, ok := s.namespaceQuotas[ns]
+	if !ok && len(ns) > 0 {
+		namespace = s.NamespaceQuota
+	}
+	return owner, namespace
+}
+
+// Usage returns what the owner id stores, replicas included
+func (s *Store) Usage(id string) Usage {
+	return s.index.Usage(func(m Metadata) bool { return m.Id == id })
+}
+
+// NamespaceUsage returns what the namespace ns stores, across owners
+func (s *Store) NamespaceUsage(ns string) Usage {
+	return s.index.Usage(func(m Metadata) bool { return m.Namespace == ns })
+}
+
+// CheckQuota returns ErrQuotaExceeded when size bytes written under key
+// would not fit in the quota of id or of the namespace ns.
+func (s *Store) CheckQuota(id, key, ns string, size int64) error {
+	s.quotaMu.RLock()
+	defer s.quotaMu.RUnlock()
+	left, err := s.quotaLeft(s.objectPath(id, key), id, ns, Usage{})
+	if err != nil {
+		return err
+	}
+	if left >= 0 && size > left {
+		return fmt.Errorf("%w: %v bytes for %v left", ErrQuotaExceeded, size, left)
+	}
+	return nil
+}
+
+// quotaLeft returns how many bytes can be written at p, -1 when there is
+// no limit. The object replaced at p does not count in the usage, the
+// writes in progress do with what they reserved but own, the reservation
+// of the write asking. quotaMu must be held.
+func (s *Store) quotaLeft(p, id, ns string, own Usage) (int64, error) {
+	ownerQuota, namespaceQuota := s.quotas(id, ns)
+	if ownerQuota == (Quota{}) && namespaceQuota == (Quota{}) {
+		return -1, nil
+	}
+	old, replacing := s.index.Get(p)
+	left := int64(-1)
+	check := func(name string, q Quota, u Usage, replaced bool) error {
+		if replaced {
+			u.Objects--
+			u.Bytes -= old.Size
+		}
+		u.Objects += s.reserved[name].Objects - own.Objects
+		u.Bytes += s.reserved[name].Bytes - own.Bytes
+		if q.Objects > 0 && u.Objects >= q.Objects {
+			return fmt.Errorf("%w: %v already has %v objects", ErrQuotaExceeded, name, u.Objects)
+		}
+		if q.Bytes > 0 {
+			l := max(q.Bytes-u.Bytes, 0)
+			if left < 0 || l < left {
+				left = l
+			}
+		}
+		return nil
+	}
+	if ownerQuota != (Quota{}) {
+		if err := check("owner "+id, ownerQuota, s.Usage(id), replacing && old.Id == id); err != nil {
+			return 0, err
+		}
+	}
+	if namespaceQuota != (Quota{}) {
+		if err := check("namespace "+ns, namespaceQuota, s.NamespaceUsage(ns), replacing && old.Namespace == ns); err != nil {
+			return 0, err
+		}
+	}
+	return left, nil
+}
+
+// reserveGrant is how many bytes a write reserves against the
+// quotas or the free space at once, see grantReader
+const reserveGrant = 1 << 20
+
+// grantReader reads r within the bytes reserved by grant, which returns
+// how many more it reserved, none when there is no room left. Reading
+// past them fails with err.
+type grantReader struct {
+	r       io.Reader
+	grant   func() (int64, error)
+	err     error
+	granted int64
+}
+
+func (g *grantReader) Read(p []byte) (int, error) {
+	if g.granted == 0 {
+		n, err := g.grant()
+		if err != nil {
+			return 0, err
+		}
+		g.granted = n
+	}
+	if g.granted == 0 {
+		// no room left, fine only if r is done
+		var b [1]byte
+		if _, err := io.ReadAtLeast(g.r, b[:], 1); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%w: object too large", g.err)
+	}
+	if int64(len(p)) > g.granted {
+		p = p[:g.granted]
+	}
+	n, err := g.r.Read(p)
+	g.granted -= int64(n)
+	return n, err
+}
+
+// limitQuota wraps r to stop the write at p past the quotas. The object
+// and its bytes are reserved as they are read, so that concurrent writes
+// cannot both fit in the same room, until release is called once the
+// write is recorded in the index or failed.
+func (s *Store) limitQuota(p, id, ns string, r io.Reader) (io.Reader, func(), error) {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	left, err := s.quotaLeft(p, id, ns, Usage{})
+	if err != nil || left < 0 {
+		return r, func() {}, err
+	}
+	q := &quotaReservation{s: s, p: p, id: id, ns: ns}
+	if _, replacing := s.index.Get(p); !replacing {
+		q.reserve(Usage{Objects: 1})
+	}
+	return &grantReader{r: r, grant: q.grant, err: ErrQuotaExceeded}, q.release, nil
+}
+
+// quotaReservation is what the write at p holds against the quotas,
+// see limitQuota
+type quotaReservation struct {
+	s         *Store
+	p, id, ns string
+	own       Usage
+	released  bool
+}
+
+// grant reserves up to reserveGrant more bytes, less when there is no room
+func (q *quotaReservation) grant() (int64, error) {
+	q.s.quotaMu.Lock()
+	defer q.s.quotaMu.Unlock()
+	left, err := q.s.quotaLeft(q.p, q.id, q.ns, q.own)
+	if err != nil {
+		return 0, err
+	}
+	if left < 0 {
+		// the quotas were lifted
+		left = q.own.Bytes + reserveGrant
+	}
+	n := min(reserveGrant, max(left-q.own.Bytes, 0))
+	q.reserve(Usage{Bytes: n})
+	return n, nil
+}
+
+// reserve adds u to the reservation of the write, quotaMu must be held
+func (q *quotaReservation) reserve(u Usage) {
+	q.own.Bytes += u.Bytes
+	q.own.Objects += u.Objects
+	for _, name := range q.names() {
+		r := q.s.reserved[name]
+		r.Bytes += u.Bytes
+		r.Objects += u.Objects
+		q.s.reserved[name] = r
+	}
+}
+
+// names are the quotas the write counts in, as named by quotaLeft
+func (q *quotaReservation) names() []string {
+	names := []string{"owner " + q.id}
+	if len(q.ns) > 0 {
+		names = append(names, "namespace "+q.ns)
+	}
+	return names
+}
+
+// release gives back what the write reserved
+func (q *quotaReservation) release() {
+	q.s.quotaMu.Lock()
+	defer q.s.quotaMu.Unlock()
+	if q.released {
+		return
+	}
+	q.released = true
+	for _, name := range q.names() {
+		r := q.s.reserved[name]
+		r.Bytes -= q.own.Bytes
+		r.Objects -= q.own.Objects
+		if r == (Usage{}) {
+			delete(q.s.reserved, name)
+			continue
+		}
+		q.s.reserved[name] = r
+	}
+}
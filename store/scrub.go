@@ -0,0 +1,243 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"time"
+)
+
+const quarantineDirName = ".quarantine"
+
+// ErrScrubStopped is returned by Scrub when it was stopped before
+// checking every object
+var ErrScrubStopped = errors.New("scrub stopped")
+
+// ScrubReport is the outcome of a Scrub
+type ScrubReport struct {
+	Started  time.Time
+	Finished time.Time
+	// Objects and Bytes are what was read and checked
+	Objects int
+	Bytes   int64
+	// Skipped are the objects without a checksum to check against
+	Skipped int
+	// Corrupt are the objects that did not match their checksum,
+	// they were moved to the quarantine and removed from the index
+	Corrupt []Metadata
+}
+
+// Scrub reads every object back, at most bytesPerSecond bytes per
+// second or as fast as possible when zero, and checks it against
+// its checksum to catch silent corruption. It returns early with
+// ErrScrubStopped when stop is closed.
+func (s *Store) Scrub(bytesPerSecond int64, stop <-chan struct{}) (report ScrubReport, err error) {
+	report.Started = time.Now()
+	defer func() { report.Finished = time.Now() }()
+	entries := s.index.All()
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	limit := &limiter{rate: bytesPerSecond, start: report.Started, stop: stop}
+	for _, p := range paths {
+		meta := entries[p]
+		if len(meta.Checksum) == 0 {
+			report.Skipped++
+			continue
+		}
+		sum, n, err := s.checksum(p, limit)
+		report.Bytes += n
+		if errors.Is(err, ErrScrubStopped) {
+			return report, err
+		}
+		report.Objects++
+		if err == nil && sum == meta.Checksum {
+			continue
+		}
+		if current, ok := s.index.Get(p); !ok || current.Checksum != meta.Checksum {
+			// written or deleted while it was read
+			continue
+		}
+		log.Printf("store (%v) object %v is corrupt: %v\n", s.Root, p, describeMismatch(err, sum, meta.Checksum))
+		if err := s.quarantine(p, meta); err != nil {
+			return report, err
+		}
+		report.Corrupt = append(report.Corrupt, meta)
+	}
+	return report, nil
+}
+
+func describeMismatch(err error, sum, want string) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("checksum %v instead of %v", sum, want)
+}
+
+// checksum returns the hex sha256 of the content at p read through limit
+func (s *Store) checksum(p string, limit *limiter) (string, int64, error) {
+	f, err := s.open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, &limitedReader{f, limit})
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// quarantine moves the object at p under the quarantine directory
+// and drops it from the index. The corrupt chunks of a deduplicated
+// object are quarantined as well and written again by the next
+// object that contains them.
+func (s *Store) quarantine(p string, meta Metadata) error {
+	if meta.Deduplicated {
+		if rec, err := s.readRecipe(p); err == nil {
+			s.quarantineChunks(rec.Chunks)
+		}
+	}
+	if f, err := s.Backend.Get(p); err == nil {
+		_, err = s.Backend.Put(path.Join(quarantineDirName, p), f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to quarantine %v: %w", p, err)
+		}
+	}
+	return s.remove(p)
+}
+
+func (s *Store) quarantineChunks(refs []chunkRef) {
+	s.chunkMu.Lock()
+	defer s.chunkMu.Unlock()
+	for _, ref := range refs {
+		info, ok := s.chunks[ref.Hash]
+		if !ok || info.corrupt {
+			continue
+		}
+		p := chunkPath(ref.Hash)
+		f, err := s.Backend.Get(p)
+		if err != nil {
+			info.corrupt = true
+			continue
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		if err == nil && hex.EncodeToString(h.Sum(nil)) == ref.Hash {
+			f.Close()
+			continue
+		}
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			s.Backend.Put(path.Join(quarantineDirName, p), f)
+		}
+		f.Close()
+		s.Backend.Delete(p)
+		info.corrupt = true
+	}
+}
+
+// Missing drops from the index the objects no longer in the Backend,
+// e.g. the ones on a failed disk of a MultiBackend, and returns them.
+// The deduplicated objects missing a chunk are missing as well.
+func (s *Store) Missing() ([]Metadata, error) {
+	entries := s.index.All()
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	missing := []Metadata{}
+	for _, p := range paths {
+		meta := entries[p]
+		if meta.DeleteMarker || s.present(p, meta) {
+			continue
+		}
+		log.Printf("store (%v) object %v is missing\n", s.Root, p)
+		if err := s.quarantine(p, meta); err != nil {
+			return missing, err
+		}
+		missing = append(missing, meta)
+	}
+	return missing, nil
+}
+
+// present reports if the object at p and all its chunks are in the Backend
+func (s *Store) present(p string, meta Metadata) bool {
+	if _, err := s.Backend.Stat(p); err != nil {
+		return false
+	}
+	if !meta.Deduplicated {
+		return true
+	}
+	rec, err := s.readRecipe(p)
+	if err != nil {
+		return false
+	}
+	for _, ref := range rec.Chunks {
+		if _, err := s.Backend.Stat(chunkPath(ref.Hash)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Quarantined returns the paths of the objects moved to the quarantine
+func (s *Store) Quarantined() ([]string, error) {
+	return s.Backend.List(quarantineDirName + "/")
+}
+
+// limiter spreads the reads of a scrub to rate bytes per second
+type limiter struct {
+	rate  int64
+	start time.Time
+	n     int64
+	stop  <-chan struct{}
+}
+
+func (l *limiter) wait(n int) error {
+	l.n += int64(n)
+	delay := time.Duration(0)
+	if l.rate > 0 {
+		due := l.start.Add(time.Duration(float64(l.n) / float64(l.rate) * float64(time.Second)))
+		delay = time.Until(due)
+	}
+	if delay <= 0 {
+		select {
+		case <-l.stop:
+			return ErrScrubStopped
+		default:
+			return nil
+		}
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-l.stop:
+		return ErrScrubStopped
+	case <-t.C:
+		return nil
+	}
+}
+
+type limitedReader struct {
+	r     io.Reader
+	limit *limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if werr := r.limit.wait(n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
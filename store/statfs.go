@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package store
+
+import "syscall"
+
+// diskCapacity returns the space of the file system holding dir,
+// Free is what unprivileged users can still write
+func diskCapacity(dir string) (Capacity, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return Capacity{}, err
+	}
+	return Capacity{
+		Total: int64(st.Blocks) * int64(st.Bsize),
+		Free:  int64(st.Bavail) * int64(st.Bsize),
+	}, nil
+}
@@ -0,0 +1,7 @@
+//go:build !(linux || darwin || freebsd)
+
+package store
+
+func diskCapacity(dir string) (Capacity, error) {
+	return Capacity{}, ErrCapacityUnknown
+}
@@ -3,17 +3,27 @@ package store
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"os"
+	"log"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jun-hf/distributedstorage/cryto"
 )
 
+// ErrExpired is returned for the objects past their expiry,
+// they are not found until the next Expired removes them
+var ErrExpired = fmt.Errorf("%w: expired", ErrNotFound)
+
 type KeyPath struct {
 	PathName, FileName string
 }
@@ -25,20 +35,142 @@ func (k KeyPath) FilePath() string {
 type StoreOpts struct {
 	TransformPathFunc TransformPathFunc
 	Root              string
+	// Backend keeps the objects, a FSBackend under Root when nil
+	Backend Backend
+	// Roots spreads the objects over several directories, each on its
+	// own disk, with a MultiBackend when Backend is nil. Placement is
+	// its PlaceHash or PlaceFreeSpace policy and the index stays in Root.
+	Roots     []string
+	Placement string
+	// IndexDir is where the metadata index is kept, by default
+	// the .index directory of a FSBackend and memory otherwise
+	IndexDir string
+	// Dedup splits the objects in content-defined chunks stored once
+	// in the Backend however many objects contain them
+	Dedup   bool
+	Chunker ChunkerOpts
+	// OwnerQuota and NamespaceQuota are the quotas of the owners and
+	// namespaces without their own, see SetQuota and SetNamespaceQuota
+	OwnerQuota     Quota
+	NamespaceQuota Quota
+	// Reserve is the free space in bytes kept on the Backend, the
+	// Store turns read-only when there is no more, see Available
+	Reserve int64
+	// ColdBackend is the slow tier the Lifecycle rules move the
+	// objects not read for a while to, a FSBackend under ColdRoot
+	// when nil. ColdCompression compresses them on the way there.
+	ColdBackend     Backend
+	ColdRoot        string
+	ColdCompression string
+	Lifecycle       []LifecycleRule
+	// Compression is how the objects written without their own
+	// Compression are compressed, CompressionGzip or CompressionFlate.
+	// Deduplicated objects are not compressed.
+	Compression string
+	// TrashRetention keeps the deleted objects in the trash for that
+	// long, see Undelete and PurgeTrash. Zero deletes them at once.
+	TrashRetention time.Duration
 }
 
 type Store struct {
 	StoreOpts
+	index *Index
+
+	chunkMu sync.Mutex
+	// chunks holds the reference count of every stored chunk
+	chunks map[string]*chunkInfo
+
+	quotaMu         sync.RWMutex
+	ownerQuotas     map[string]Quota
+	namespaceQuotas map[string]Quota
+	// reserved is what the writes in progress take from each quota,
+	// by the name quotaLeft gives it
+	reserved map[string]Usage
+
+	// readOnly is the last state seen by a write, see unreserved
+	readOnly atomic.Bool
+	// spaceReserved is what the writes in progress took from the
+	// free space, see limitSpace
+	spaceMu       sync.Mutex
+	spaceReserved int64
+
+	versioning versioning
 }
 
-func New(opts StoreOpts) *Store {
+// New opens the store described by opts, it fails when
+// the disks of Roots cannot be opened.
+func New(opts StoreOpts) (*Store, error) {
 	if len(opts.Root) == 0 {
 		opts.Root = defaultRoot
 	}
 	if opts.TransformPathFunc == nil {
 		opts.TransformPathFunc = DefaultPathTransformFunc
 	}
-	return &Store{StoreOpts: opts}
+	if opts.Backend == nil && len(opts.Roots) > 0 {
+		multi, err := NewMultiBackend(opts.Placement, opts.Roots...)
+		if err != nil {
+			return nil, fmt.Errorf("store (%v) failed to open its disks: %w", opts.Root, err)
+		}
+		opts.Backend = multi
+		if len(opts.IndexDir) == 0 {
+			opts.IndexDir = filepath.Join(opts.Root, indexDirName)
+		}
+	}
+	if opts.Backend == nil {
+		opts.Backend = NewFSBackend(opts.Root)
+	}
+	if fs, ok := opts.Backend.(*FSBackend); ok && len(opts.IndexDir) == 0 {
+		opts.IndexDir = filepath.Join(fs.Root, indexDirName)
+	}
+	if opts.ColdBackend == nil && len(opts.ColdRoot) > 0 {
+		opts.ColdBackend = NewFSBackend(opts.ColdRoot)
+	}
+	index, err := OpenIndex(opts.IndexDir)
+	if err != nil {
+		log.Printf("store (%v) failed to open index, keeping it in memory: %v\n", opts.Root, err)
+		index, _ = OpenIndex("")
+	}
+	s := &Store{
+		StoreOpts:       opts,
+		index:           index,
+		ownerQuotas:     make(map[string]Quota),
+		namespaceQuotas: make(map[string]Quota),
+		reserved:        make(map[string]Usage),
+	}
+	if index.Empty() {
+		if err := s.Reindex(); err != nil {
+			log.Printf("store (%v) failed to index existing objects: %v\n", opts.Root, err)
+		}
+	}
+	if err := s.loadChunks(); err != nil {
+		log.Printf("store (%v) failed to count chunk references: %v\n", opts.Root, err)
+	}
+	return s, nil
+}
+
+// Reindex adds the objects of the Backend missing from the index,
+// the original key names of those objects are unknown.
+func (s *Store) Reindex() error {
+	paths, err := s.Backend.List("")
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if _, ok := s.index.Get(p); ok || hiddenPath(p) {
+			continue
+		}
+		info, err := s.Backend.Stat(p)
+		if err != nil {
+			continue
+		}
+		dir, _, _ := strings.Cut(p, "/")
+		id, bucket, _ := strings.Cut(dir, "@")
+		meta := Metadata{Id: id, Bucket: bucket, Size: info.Size, Created: info.ModTime}
+		if err := s.index.Put(p, meta); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Store) Path(id string, p KeyPath) string {
@@ -49,18 +181,128 @@ func (s *Store) FilePath(id string, p KeyPath) string {
 	return filepath.Join(s.Root, id, p.FilePath())
 }
 
+// objectPath is the path of key in the Backend, the objects
+// of a bucket are kept apart from the other objects of id
+func (s *Store) objectPath(id, key string) string {
+	if bucket, name := SplitBucketKey(key); len(bucket) > 0 {
+		return path.Join(id+"@"+bucket, s.TransformPathFunc(name).FilePath())
+	}
+	return path.Join(id, s.TransformPathFunc(key).FilePath())
+}
+
+// BucketKey is the key of the object key in bucket, key itself
+// when bucket is empty
+func BucketKey(bucket, key string) string {
+	if len(bucket) == 0 {
+		return key
+	}
+	return bucket + bucketSeparator + key
+}
+
+// SplitBucketKey splits a key made by BucketKey
+func SplitBucketKey(k string) (bucket, key string) {
+	if bucket, key, ok := strings.Cut(k, bucketSeparator); ok {
+		return bucket, key
+	}
+	return "", k
+}
+
+// bucketSeparator cannot be part of a bucket name
+const bucketSeparator = "\x00"
+
+// Has reports if key is stored and not expired
 func (s *Store) Has(id, key string) bool {
-	pathKey := s.TransformPathFunc(key)
-	fileP := s.FilePath(id, pathKey)
+	meta, ok := s.index.Get(s.objectPath(id, key))
+	return ok && !meta.Expired(time.Now())
+}
 
-	_, err := os.Stat(fileP)
-	return !errors.Is(err, os.ErrNotExist)
+// Stat returns the metadata of key from the index
+func (s *Store) Stat(id, key string) (Metadata, error) {
+	meta, ok := s.index.Get(s.objectPath(id, key))
+	if !ok {
+		return Metadata{}, fmt.Errorf("%w: %v", ErrNotFound, key)
+	}
+	if meta.Expired(time.Now()) {
+		return Metadata{}, fmt.Errorf("%w: %v", ErrExpired, key)
+	}
+	return meta, nil
+}
+
+// List returns up to limit names of id starting with prefix, in lexical
+// order after cursor. The returned cursor is empty on the last page.
+// The objects in buckets are not listed, see ListBucket.
+func (s *Store) List(id, prefix, cursor string, limit int) ([]string, string, error) {
+	return s.ListBucket(id, "", prefix, cursor, limit)
+}
+
+// ListBucket works like List for the objects of id in bucket
+func (s *Store) ListBucket(id, bucket, prefix, cursor string, limit int) ([]string, string, error) {
+	names := []string{}
+	for _, meta := range s.Objects(id) {
+		if len(meta.Name) > 0 && meta.Bucket == bucket {
+			names = append(names, meta.Name)
+		}
+	}
+	page, next := Page(names, prefix, cursor, limit)
+	return page, next, nil
+}
+
+// Page picks the page of the sorted names starting with prefix after
+// cursor, it returns the cursor of the next page if there is one.
+func Page(names []string, prefix, cursor string, limit int) ([]string, string) {
+	page := []string{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || name <= cursor {
+			continue
+		}
+		if limit > 0 && len(page) == limit {
+			return page, page[len(page)-1]
+		}
+		page = append(page, name)
+	}
+	return page, ""
+}
+
+// Objects returns the metadata of every object of id
+// sorted by name, without the expired ones
+func (s *Store) Objects(id string) []Metadata {
+	now := time.Now()
+	objects := []Metadata{}
+	for _, meta := range s.index.Entries(id) {
+		if !meta.Expired(now) {
+			objects = append(objects, meta)
+		}
+	}
+	return objects
+}
+
+// Entries is Objects with the expired objects not deleted yet
+func (s *Store) Entries(id string) []Metadata {
+	return s.index.Entries(id)
+}
+
+// Expired returns the metadata of the objects expired at now, they
+// can still be read until they are removed with Delete.
+func (s *Store) Expired(now time.Time) []Metadata {
+	expired := []Metadata{}
+	for p, meta := range s.index.All() {
+		// the older versions stay until they are pruned
+		if !hiddenPath(p) && meta.Expired(now) {
+			expired = append(expired, meta)
+		}
+	}
+	return expired
 }
 
 func (s *Store) Read(id, key string) (io.Reader, error) {
-	pathKey := s.TransformPathFunc(key)
-	fileP := s.FilePath(id, pathKey)
-	data, err := os.ReadFile(fileP)
+	p := s.objectPath(id, key)
+	s.access(p)
+	f, err := s.open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
 	if err != nil {
 		return nil, err
 	}
@@ -68,94 +310,305 @@ func (s *Store) Read(id, key string) (io.Reader, error) {
 }
 
 func (s *Store) CopyRead(id, key string, dst io.Writer) (int64, error) {
-	pathKey := s.TransformPathFunc(key)
-	fileP := s.FilePath(id, pathKey)
-
-	if !s.Has(id, key) {
-		return 0, fmt.Errorf("key %v does not exists", key)
-	}
-	f, err := os.Open(fileP)
+	p := s.objectPath(id, key)
+	s.access(p)
+	f, err := s.open(p)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("key %v does not exists: %w", key, err)
 	}
 	defer f.Close()
 	return io.Copy(dst, f)
 }
 
+// Open returns a seekable handle on key, the caller must close it
+func (s *Store) Open(id, key string) (io.ReadSeekCloser, error) {
+	p := s.objectPath(id, key)
+	s.access(p)
+	return s.open(p)
+}
+
+// Peek is Open for the reads that are not reads of the object by its
+// owner, e.g. proofs and repairs: the object stays in its tier and its
+// Accessed is left as it is
+func (s *Store) Peek(id, key string) (io.ReadSeekCloser, error) {
+	return s.open(s.objectPath(id, key))
+}
+
+// open returns the content at p, put back together from its chunks
+// when it was deduplicated, from the cold tier or decompressed
+func (s *Store) open(p string) (io.ReadSeekCloser, error) {
+	meta, ok := s.index.Get(p)
+	switch {
+	case ok && meta.Tier == TierCold:
+		return s.openCold(p, meta)
+	case ok && meta.Deduplicated:
+		return s.openRecipe(p)
+	}
+	f, err := s.Backend.Get(p)
+	if err != nil || !ok || len(meta.Compression) == 0 {
+		return f, err
+	}
+	return decompressStream(meta.Compression, meta.Size, f, func() (io.ReadCloser, error) {
+		return s.Backend.Get(p)
+	}), nil
+}
+
+// ReadRange returns length bytes of key starting at offset
+func (s *Store) ReadRange(id, key string, offset, length int64) (io.ReadCloser, error) {
+	p := s.objectPath(id, key)
+	s.access(p)
+	return s.readRange(p, offset, length)
+}
+
+// PeekRange is ReadRange leaving the tier of key as it is, see Peek
+func (s *Store) PeekRange(id, key string, offset, length int64) (io.ReadCloser, error) {
+	return s.readRange(s.objectPath(id, key), offset, length)
+}
+
+func (s *Store) readRange(p string, offset, length int64) (io.ReadCloser, error) {
+	f, err := s.open(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// Delete deletes key, a versioned object is kept as an older version
+// behind a delete marker, see SetVersioning, and the others are moved
+// to the trash when the Store has a TrashRetention
 func (s *Store) Delete(id, key string) error {
-	pathKey := s.TransformPathFunc(key)
-	fileP := s.FilePath(id, pathKey)
-	return s.deleteFullPath(id, fileP)
+	p := s.objectPath(id, key)
+	meta, ok := s.index.Get(p)
+	switch {
+	case ok && s.versioned(meta):
+		return s.deleteCurrent(p, meta)
+	case ok && s.Trashed(meta):
+		return s.trash(p, meta)
+	}
+	return s.remove(p)
+}
+
+// remove deletes the object at p and releases its chunks
+func (s *Store) remove(p string) error {
+	var chunks []chunkRef
+	if meta, ok := s.index.Get(p); ok && meta.Deduplicated {
+		if rec, err := s.readRecipe(p); err == nil {
+			chunks = rec.Chunks
+		}
+	}
+	err := s.Backend.Delete(p)
+	if meta, ok := s.index.Get(p); ok && meta.Tier == TierCold && s.ColdBackend != nil {
+		err = s.ColdBackend.Delete(p)
+	}
+	if _, ok := s.index.Get(p); ok {
+		// drop the entry even if the object was already gone
+		if err := s.index.Delete(p); err != nil {
+			return err
+		}
+		if err := s.release(chunks); err != nil {
+			return err
+		}
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+	}
+	return err
 }
 
 func (s *Store) ClearAll() error {
-	return os.RemoveAll(s.Root)
+	if err := s.index.Clear(); err != nil {
+		return err
+	}
+	s.chunkMu.Lock()
+	s.chunks = make(map[string]*chunkInfo)
+	s.chunkMu.Unlock()
+	if c, ok := s.Backend.(clearer); ok {
+		return c.Clear()
+	}
+	paths, err := s.Backend.List("")
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := s.Backend.Delete(p); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Store) Write(id, key string, r io.Reader) (int64, error) {
-	return s.writeStream(id, key, r)
+	return s.WriteMeta(id, key, Metadata{Name: key}, r)
 }
 
-func (s *Store) WriteDecrypt(encryptKey []byte, id, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileToWrite(id, key)
+// WriteMeta writes r under key and records meta in the index,
+// the size, checksum and creation time are filled in by the Store.
+func (s *Store) WriteMeta(id, key string, meta Metadata, r io.Reader) (int64, error) {
+	p := s.objectPath(id, key)
+	r, release, err := s.limitQuota(p, id, meta.Namespace, r)
 	if err != nil {
 		return 0, err
 	}
-	defer f.Close()
-	n, err := cryto.CopyDecrypt(encryptKey, r, f)
-	return int64(n), err
+	defer release()
+	r, releaseSpace, err := s.limitSpace(r)
+	if err != nil {
+		return 0, err
+	}
+	defer releaseSpace()
+	return s.writeCurrent(p, id, key, meta, r)
 }
 
-func (s *Store) writeStream(id, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileToWrite(id, key)
+// write puts r at p, compressed with the Compression of meta or of
+// the Store unless it does not compress, and records meta.
+func (s *Store) write(p, id, key string, meta Metadata, r io.Reader) (int64, error) {
+	h := sha256.New()
+	content := &countReader{r: io.TeeReader(r, h)}
+	stored, alg, err := s.putCompressed(p, meta.Compression, content)
 	if err != nil {
-	  return 0, err
+		return content.n, err
 	}
-	defer f.Close()
-	return io.Copy(f, r)
+	meta.Deduplicated = s.Dedup
+	meta.Compression, meta.StoredSize = alg, 0
+	if len(alg) > 0 {
+		meta.StoredSize = stored
+	}
+	return content.n, s.record(p, id, key, meta, content.n, h)
 }
 
-func (s *Store) openFileToWrite(id, key string) (*os.File, error) {
-	keyPath := s.TransformPathFunc(key)
-	path := s.Path(id, keyPath)
-	if err := os.MkdirAll(path, os.ModePerm); err != nil {
-		return nil, err
+// putCompressed works like put and compresses r with alg, the Store's
+// Compression when empty. It returns the bytes stored and the
+// compression applied, none when r does not compress.
+func (s *Store) putCompressed(p, alg string, r io.Reader) (int64, string, error) {
+	if len(alg) == 0 {
+		alg = s.Compression
 	}
-	fileP := s.FilePath(id, keyPath)
-	return os.Create(fileP)
+	if s.Dedup {
+		// the chunks are shared between objects, they are kept as they are
+		alg = ""
+	}
+	body, alg, err := compressReader(alg, r)
+	if err != nil {
+		return 0, "", err
+	}
+	// stops the compression if put returns early
+	defer body.Close()
+	n, err := s.put(p, body)
+	return n, alg, err
 }
 
-func (s *Store) FileSize(id, key string) (int64, error) {
-	if !s.Has(id, key) {
-		return 0, fmt.Errorf("key %v does not exist", key)
+// countReader counts the bytes read from r
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// put writes r at p, replacing the object there
+// and releasing its chunks if it had any
+func (s *Store) put(p string, r io.Reader) (int64, error) {
+	var old []chunkRef
+	meta, ok := s.index.Get(p)
+	if ok && meta.Deduplicated {
+		if rec, err := s.readRecipe(p); err == nil {
+			old = rec.Chunks
+		}
+	}
+	var n int64
+	var err error
+	if s.Dedup {
+		n, err = s.putDedup(p, r)
+	} else {
+		n, err = s.Backend.Put(p, r)
+	}
+	if err != nil {
+		return n, err
+	}
+	if ok && meta.Tier == TierCold && s.ColdBackend != nil {
+		// the new content is hot
+		s.ColdBackend.Delete(p)
+	}
+	return n, s.release(old)
+}
+
+func (s *Store) WriteDecrypt(encryptKey []byte, id, key string, r io.Reader) (int64, error) {
+	return s.WriteDecryptMeta(encryptKey, id, key, Metadata{Name: key}, r)
+}
+
+// WriteDecryptMeta works like WriteDecrypt and records meta like WriteMeta
+func (s *Store) WriteDecryptMeta(encryptKey []byte, id, key string, meta Metadata, r io.Reader) (int64, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := cryto.CopyDecrypt(encryptKey, r, pw)
+		pw.CloseWithError(err)
+	}()
+	p := s.objectPath(id, key)
+	limited, release, err := s.limitQuota(p, id, meta.Namespace, pr)
+	if err == nil {
+		defer release()
+		var releaseSpace func()
+		limited, releaseSpace, err = s.limitSpace(limited)
+		defer releaseSpace()
 	}
-	keyPath := s.TransformPathFunc(key)
-	f, err := os.Stat(s.FilePath(id, keyPath))
 	if err != nil {
+		pr.CloseWithError(err)
 		return 0, err
 	}
-	return f.Size(), nil
+	n, err := s.writeCurrent(p, id, key, meta, limited)
+	// unblock the decryption if Put stopped early
+	pr.CloseWithError(err)
+	return n, err
 }
 
-func (s *Store) deleteFullPath(id, fileP string) error {
-	if string(fileP[0]) == "/" {
-		fileP = fileP[1:]
+// record indexes the object written at p, the timestamps of meta
+// are kept when set, e.g. for a replica written by its owner.
+func (s *Store) record(p, id, key string, meta Metadata, n int64, h hash.Hash) error {
+	now := time.Now()
+	meta.Id, meta.Key, meta.Size = id, key, n
+	meta.Checksum = hex.EncodeToString(h.Sum(nil))
+	// written in the hot tier
+	meta.Tier, meta.Accessed = "", now
+	if len(meta.ContentChecksum) == 0 {
+		meta.ContentChecksum = meta.Checksum
 	}
-	stoppingDir := fmt.Sprintf("%v/%+v", s.Root, id)
-	for {
-		if fileP == stoppingDir {
-			return nil
-		}
-		if _, err := os.Stat(fileP); err != nil {
-			return err
-		}
-		if err := os.RemoveAll(fileP); err != nil {
-			return err
+	if meta.Created.IsZero() {
+		meta.Created = now
+		if old, ok := s.index.Get(p); ok && !old.Created.IsZero() {
+			meta.Created = old.Created
 		}
-		fileP = filepath.Dir(fileP)
 	}
+	if meta.Modified.IsZero() {
+		meta.Modified = now
+	}
+	return s.index.Put(p, meta)
 }
 
+func (s *Store) FileSize(id, key string) (int64, error) {
+	meta, err := s.Stat(id, key)
+	if err != nil {
+		return 0, fmt.Errorf("key %v does not exist: %w", key, err)
+	}
+	return meta.Size, nil
+}
+
+// Close releases the files held by the index
+func (s *Store) Close() error {
+	return s.index.Close()
+}
+
+const indexDirName = ".index"
+
 var (
 	defaultRoot              = "storeDir"
 	DefaultPathTransformFunc = func(key string) KeyPath {
@@ -1,10 +1,19 @@
 package store
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -27,13 +36,22 @@ func TestSHA1PathTransformFunc(t *testing.T) {
 	assert.Equal(t, "8515cead959aa81b171ec2004ca878418b01b55a", keyPath.FileName)
 }
 
+func newStore(t *testing.T, opts StoreOpts) *Store {
+	t.Helper()
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
 func TestStore(t *testing.T) {
 	id := "id"
 	opts := StoreOpts{
 		TransformPathFunc: SHA1PathTransformFunc,
 		Root:              "testStore",
 	}
-	store := New(opts)
+	store := newStore(t, opts)
 	keyPath := store.TransformPathFunc("hello")
 	assert.Equal(t, "testStore/id/aaf4c/61ddc/c5e8a/2dabe/de0f3/b482c/d9aea/9434d", store.Path(id, keyPath))
 	assert.Equal(t, "testStore/id/aaf4c/61ddc/c5e8a/2dabe/de0f3/b482c/d9aea/9434d/aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", store.FilePath(id, keyPath))
@@ -75,3 +93,1017 @@ func TestStore(t *testing.T) {
 		t.Fatal("ClearAll failed", err)
 	}
 }
+
+func TestBackends(t *testing.T) {
+	logBackend, err := OpenLogBackend(filepath.Join(t.TempDir(), "store.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logBackend.Close()
+	multi := &MultiBackend{}
+	for _, name := range []string{"a", "b"} {
+		assert.Nil(t, multi.AddDisk(name, NewMemoryBackend()))
+	}
+	backends := map[string]Backend{
+		"fs":     NewFSBackend(t.TempDir()),
+		"memory": NewMemoryBackend(),
+		"log":    logBackend,
+		"multi":  multi,
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t, StoreOpts{TransformPathFunc: SHA1PathTransformFunc, Backend: backend})
+			for i := range 10 {
+				key := fmt.Sprintf("file%v", i)
+				_, err := store.Write("id", key, strings.NewReader(key))
+				assert.Nil(t, err)
+			}
+			_, err := store.Write("id", "file0", strings.NewReader("overwritten"))
+			assert.Nil(t, err)
+
+			r, err := store.Read("id", "file0")
+			assert.Nil(t, err)
+			b, _ := io.ReadAll(r)
+			assert.Equal(t, "overwritten", string(b))
+
+			size, err := store.FileSize("id", "file1")
+			assert.Nil(t, err)
+			assert.Equal(t, int64(len("file1")), size)
+
+			rr, err := store.ReadRange("id", "file0", 4, 5)
+			assert.Nil(t, err)
+			b, _ = io.ReadAll(rr)
+			rr.Close()
+			assert.Equal(t, "writt", string(b))
+
+			f, err := store.Open("id", "file0")
+			assert.Nil(t, err)
+			_, err = f.Seek(-3, io.SeekEnd)
+			assert.Nil(t, err)
+			b, _ = io.ReadAll(f)
+			f.Close()
+			assert.Equal(t, "ten", string(b))
+
+			paths, err := backend.List("id/")
+			assert.Nil(t, err)
+			assert.Equal(t, 10, len(paths))
+			assert.True(t, slices.IsSorted(paths))
+
+			// nested paths are in lexical order too, "a.b" sorts before "a/b"
+			for _, p := range []string{"nested/a/b", "nested/a.b"} {
+				_, err := backend.Put(p, strings.NewReader(p))
+				assert.Nil(t, err)
+			}
+			paths, err = backend.List("nested/")
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"nested/a.b", "nested/a/b"}, paths)
+
+			// a rename replaces the object at the new path
+			assert.Nil(t, rename(backend, "nested/a.b", "nested/a/b"))
+			_, err = backend.Stat("nested/a.b")
+			assert.ErrorIs(t, err, ErrNotFound)
+			g, err := backend.Get("nested/a/b")
+			assert.Nil(t, err)
+			b, _ = io.ReadAll(g)
+			g.Close()
+			assert.Equal(t, "nested/a.b", string(b))
+			assert.ErrorIs(t, rename(backend, "nested/a.b", "nested/c"), ErrNotFound)
+
+			assert.Nil(t, store.Delete("id", "file0"))
+			assert.False(t, store.Has("id", "file0"))
+			assert.ErrorIs(t, store.Delete("id", "file0"), ErrNotFound)
+			assert.True(t, store.Has("id", "file1"))
+
+			assert.Nil(t, store.ClearAll())
+			assert.False(t, store.Has("id", "file1"))
+		})
+	}
+}
+
+func TestLogBackendReopen(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "store.log")
+	backend, err := OpenLogBackend(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Put("a", strings.NewReader("first"))
+	backend.Put("a", strings.NewReader("second"))
+	backend.Put("b", strings.NewReader("deleted"))
+	backend.Delete("b")
+	backend.Put("c", strings.NewReader("kept"))
+	assert.Nil(t, backend.Compact())
+	backend.Close()
+
+	// a torn record at the end of the log is dropped
+	f, _ := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{logOpPut, 1, 2, 3})
+	f.Close()
+
+	backend, err = OpenLogBackend(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	paths, _ := backend.List("")
+	assert.Equal(t, []string{"a", "c"}, paths)
+	r, err := backend.Get("a")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, "second", string(b))
+
+	_, err = backend.Put("d", strings.NewReader("after reopen"))
+	assert.Nil(t, err)
+	r, _ = backend.Get("d")
+	b, _ = io.ReadAll(r)
+	assert.Equal(t, "after reopen", string(b))
+}
+
+func TestFSBackendAtomicPut(t *testing.T) {
+	root := t.TempDir()
+	backend := NewFSBackend(root)
+	_, err := backend.Put("id/key", strings.NewReader("complete"))
+	assert.Nil(t, err)
+
+	// a failed stream keeps the previous content
+	failing := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	_, err = backend.Put("id/key", failing)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	r, err := backend.Get("id/key")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "complete", string(b))
+
+	// leftovers of a crash are removed at startup
+	leftover := filepath.Join(root, "id", tempPrefix+"123")
+	assert.Nil(t, os.WriteFile(leftover, []byte("partial"), 0o644))
+	paths, _ := backend.List("")
+	assert.Equal(t, []string{"id/key"}, paths)
+	NewFSBackend(root)
+	_, err = os.Stat(leftover)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestStoreIndex(t *testing.T) {
+	root := t.TempDir()
+	store := newStore(t, StoreOpts{TransformPathFunc: SHA1PathTransformFunc, Root: root})
+	_, err := store.Write("id", "docs/readme", strings.NewReader("hello"))
+	assert.Nil(t, err)
+	_, err = store.Write("id", "docs/deleted", strings.NewReader("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Delete("id", "docs/deleted"))
+	assert.Nil(t, store.Close())
+
+	// the index survives a restart
+	store = newStore(t, StoreOpts{TransformPathFunc: SHA1PathTransformFunc, Root: root})
+	meta, err := store.Stat("id", "docs/readme")
+	assert.Nil(t, err)
+	assert.Equal(t, "docs/readme", meta.Name)
+	assert.Equal(t, int64(5), meta.Size)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", meta.Checksum)
+	assert.False(t, store.Has("id", "docs/deleted"))
+	assert.Nil(t, store.index.Snapshot())
+	assert.Nil(t, store.Close())
+
+	// objects written before the index existed are picked up
+	assert.Nil(t, os.RemoveAll(filepath.Join(root, indexDirName)))
+	store = newStore(t, StoreOpts{TransformPathFunc: SHA1PathTransformFunc, Root: root})
+	defer store.Close()
+	assert.True(t, store.Has("id", "docs/readme"))
+	objects := store.Objects("id")
+	assert.Equal(t, 1, len(objects))
+	assert.Equal(t, int64(5), objects[0].Size)
+}
+
+func TestIndexTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := OpenIndex(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, idx.Put("a", Metadata{Key: "a"}))
+	assert.Nil(t, idx.Close())
+	// a corrupt record in the middle and a torn one at the end
+	f, err := os.OpenFile(filepath.Join(dir, indexLogName), os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteString("{corrupt}\n{\"Path\":\"b\",\"Meta\":{\"Key\":\"b\"}}\n{\"Path\":\"c\",\"Me")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	// the records after the corrupt one are kept
+	idx, err = OpenIndex(dir)
+	assert.Nil(t, err)
+	_, ok := idx.Get("a")
+	assert.True(t, ok)
+	_, ok = idx.Get("b")
+	assert.True(t, ok)
+	_, ok = idx.Get("c")
+	assert.False(t, ok)
+	// and the next append is not lost in the torn record
+	assert.Nil(t, idx.Put("d", Metadata{Key: "d"}))
+	assert.Nil(t, idx.Close())
+	idx, err = OpenIndex(dir)
+	assert.Nil(t, err)
+	defer idx.Close()
+	_, ok = idx.Get("d")
+	assert.True(t, ok)
+	assert.Equal(t, 3, len(idx.All()))
+}
+
+func TestStoreList(t *testing.T) {
+	store := newStore(t, StoreOpts{Backend: NewMemoryBackend()})
+	for _, key := range []string{"backups/2026/b", "backups/2025/a", "backups/2026/a", "logs/a", "backups/2026/c"} {
+		_, err := store.Write("id", key, strings.NewReader(key))
+		assert.Nil(t, err)
+	}
+	_, err := store.Write("other", "backups/2026/other", strings.NewReader("other"))
+	assert.Nil(t, err)
+
+	page, cursor, err := store.List("id", "backups/2026/", "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"backups/2026/a", "backups/2026/b"}, page)
+	assert.Equal(t, "backups/2026/b", cursor)
+
+	page, cursor, err = store.List("id", "backups/2026/", cursor, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"backups/2026/c"}, page)
+	assert.Empty(t, cursor)
+
+	page, _, err = store.List("id", "", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(page))
+}
+
+func TestStoreBuckets(t *testing.T) {
+	store := newStore(t, StoreOpts{Backend: NewMemoryBackend()})
+	_, err := store.Write("id", "k", strings.NewReader("flat"))
+	assert.Nil(t, err)
+	for _, bucket := range []string{"team-a", "team-b"} {
+		key := BucketKey(bucket, "k")
+		_, err := store.WriteMeta("id", key, Metadata{Name: "k", Bucket: bucket}, strings.NewReader(bucket))
+		assert.Nil(t, err)
+	}
+
+	// the same key in each bucket is its own object
+	for key, want := range map[string]string{"k": "flat", BucketKey("team-a", "k"): "team-a", BucketKey("team-b", "k"): "team-b"} {
+		r, err := store.Read("id", key)
+		assert.Nil(t, err)
+		data, _ := io.ReadAll(r)
+		assert.Equal(t, want, string(data))
+	}
+	bucket, key := SplitBucketKey(BucketKey("team-a", "k"))
+	assert.Equal(t, "team-a", bucket)
+	assert.Equal(t, "k", key)
+
+	page, _, err := store.List("id", "", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"k"}, page)
+	page, _, err = store.ListBucket("id", "team-a", "", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"k"}, page)
+	page, _, err = store.ListBucket("id", "team-c", "", "", 0)
+	assert.Nil(t, err)
+	assert.Empty(t, page)
+}
+
+func TestStoreCapacity(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Limit = 100
+	store := newStore(t, StoreOpts{Backend: backend, Reserve: 20})
+	_, err := store.Write("id", "a", bytes.NewReader(make([]byte, 50)))
+	assert.Nil(t, err)
+	assert.ErrorIs(t, store.CheckSpace(40), ErrNoSpace)
+	_, err = store.Write("id", "b", bytes.NewReader(make([]byte, 40)))
+	assert.ErrorIs(t, err, ErrNoSpace)
+	assert.False(t, store.Has("id", "b"))
+
+	// down to the reserve the store turns read-only
+	_, err = store.Write("id", "b", bytes.NewReader(make([]byte, 30)))
+	assert.Nil(t, err)
+	assert.True(t, store.ReadOnly())
+	assert.ErrorIs(t, store.CheckSpace(0), ErrReadOnly)
+	_, err = store.Write("id", "c", strings.NewReader("c"))
+	assert.ErrorIs(t, err, ErrReadOnly)
+
+	assert.Nil(t, store.Delete("id", "a"))
+	assert.False(t, store.ReadOnly())
+	assert.Equal(t, int64(50), store.Available())
+
+	// concurrent writes cannot both take the same room
+	assert.Nil(t, store.Delete("id", "b"))
+	start := make(chan struct{})
+	errs := make(chan error, 2)
+	for _, key := range []string{"d", "e"} {
+		go func() {
+			_, err := store.Write("id", key, &gatedReader{r: bytes.NewReader(make([]byte, 50)), start: start})
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(start)
+	failed := 0
+	for range 2 {
+		if err := <-errs; err != nil {
+			assert.ErrorIs(t, err, ErrNoSpace)
+			failed++
+		}
+	}
+	assert.Equal(t, 1, failed)
+	assert.Nil(t, store.CheckSpace(30))
+
+	// the file system of a FSBackend
+	c, err := newStore(t, StoreOpts{Root: t.TempDir()}).Capacity()
+	if errors.Is(err, ErrCapacityUnknown) {
+		t.Skip("no capacity on this platform")
+	}
+	assert.Nil(t, err)
+	assert.True(t, c.Total > 0 && c.Free <= c.Total)
+}
+
+var errDiskIO = errors.New("input/output error")
+
+func TestMultiBackend(t *testing.T) {
+	multi := &MultiBackend{}
+	faulty := NewMemoryBackend()
+	assert.Nil(t, multi.AddDisk("a", NewMemoryBackend()))
+	assert.Nil(t, multi.AddDisk("b", faulty))
+	assert.ErrorIs(t, multi.AddDisk("b", NewMemoryBackend()), ErrDiskExists)
+	// a store does not open without the disks of its Roots
+	root := t.TempDir()
+	_, err := New(StoreOpts{Root: t.TempDir(), Roots: []string{root, root}})
+	assert.ErrorIs(t, err, ErrDiskExists)
+	store := newStore(t, StoreOpts{Backend: multi})
+	keys := []string{}
+	for i := range 40 {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		_, err := store.Write("id", key, strings.NewReader(key))
+		assert.Nil(t, err)
+	}
+	for _, d := range multi.Disks() {
+		assert.True(t, d.Objects > 0, d.Name)
+	}
+
+	// a new disk takes its share of the objects
+	assert.Nil(t, multi.AddDisk("c", NewMemoryBackend()))
+	moved, err := multi.Rebalance()
+	assert.Nil(t, err)
+	assert.True(t, moved > 0)
+	assert.Equal(t, moved, multi.Disks()[2].Objects)
+	moved, err = multi.Rebalance()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, moved)
+	for _, key := range keys {
+		r, err := store.Read("id", key)
+		assert.Nil(t, err)
+		data, _ := io.ReadAll(r)
+		assert.Equal(t, key, string(data))
+	}
+
+	// an error about a single object leaves its disk healthy
+	failed := []string{}
+	multi.OnFail = func(disk string) { failed = append(failed, disk) }
+	paths, _ := multi.List("id/")
+	for _, p := range paths {
+		if d, _ := multi.locate(p); d.name != "b" {
+			continue
+		}
+		faulty.Fail(p, errDiskIO)
+		_, err := multi.Get(p)
+		assert.ErrorIs(t, err, errDiskIO)
+		break
+	}
+	assert.Empty(t, failed)
+	assert.Nil(t, multi.Disks()[1].Failed)
+
+	// the objects of a failed disk are missing, the others are intact
+	onB := multi.Disks()[1].Objects
+	faulty.Fail("", errDiskIO)
+	assert.Equal(t, []string{"b"}, multi.Check())
+	assert.Equal(t, []string{"b"}, failed)
+	assert.NotNil(t, multi.Disks()[1].Failed)
+	missing, err := store.Missing()
+	assert.Nil(t, err)
+	assert.Equal(t, onB, len(missing))
+	for _, meta := range missing {
+		assert.False(t, store.Has("id", meta.Key))
+	}
+	page, _, err := store.List("id", "", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(keys)-onB, len(page))
+	// and the writes go to the healthy disks
+	_, err = store.Write("id", missing[0].Key, strings.NewReader("again"))
+	assert.Nil(t, err)
+	assert.True(t, store.Has("id", missing[0].Key))
+
+	// a replaced disk is added back in place of the failed one
+	assert.Nil(t, multi.AddDisk("b", NewMemoryBackend()))
+	assert.ErrorIs(t, multi.AddDisk("b", NewMemoryBackend()), ErrDiskExists)
+	assert.Nil(t, multi.Disks()[1].Failed)
+	_, err = multi.Rebalance()
+	assert.Nil(t, err)
+	assert.True(t, multi.Disks()[1].Objects > 0)
+}
+
+func TestMultiBackendRebalanceWrites(t *testing.T) {
+	multi := &MultiBackend{}
+	assert.Nil(t, multi.AddDisk("a", NewMemoryBackend()))
+	for i := range 200 {
+		_, err := multi.Put(fmt.Sprintf("p%d", i), strings.NewReader("old"))
+		assert.Nil(t, err)
+	}
+	// the writes made while the objects move are not lost
+	assert.Nil(t, multi.AddDisk("b", NewMemoryBackend()))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := multi.Rebalance()
+		assert.Nil(t, err)
+	}()
+	for i := range 200 {
+		_, err := multi.Put(fmt.Sprintf("p%d", i), strings.NewReader("new"))
+		assert.Nil(t, err)
+	}
+	<-done
+	disks := multi.Disks()
+	assert.Equal(t, 200, disks[0].Objects+disks[1].Objects)
+	for i := range 200 {
+		f, err := multi.Get(fmt.Sprintf("p%d", i))
+		assert.Nil(t, err)
+		data, _ := io.ReadAll(f)
+		assert.Equal(t, "new", string(data))
+	}
+}
+
+func TestMultiBackendFreeSpace(t *testing.T) {
+	small, large := NewMemoryBackend(), NewMemoryBackend()
+	small.Limit, large.Limit = 1000, 3000
+	multi := &MultiBackend{Placement: PlaceFreeSpace}
+	assert.Nil(t, multi.AddDisk("small", small))
+	assert.Nil(t, multi.AddDisk("large", large))
+	for i := range 24 {
+		_, err := multi.Put(fmt.Sprintf("p%d", i), bytes.NewReader(make([]byte, 100)))
+		assert.Nil(t, err)
+	}
+	// the large disk fills until it has as much room as the small one
+	disks := multi.Disks()
+	assert.Equal(t, 2, disks[0].Objects)
+	assert.Equal(t, 22, disks[1].Objects)
+
+	empty := NewMemoryBackend()
+	empty.Limit = 1000
+	assert.Nil(t, multi.AddDisk("empty", empty))
+	moved, err := multi.Rebalance()
+	assert.Nil(t, err)
+	assert.True(t, moved > 0)
+	c, err := multi.Capacity()
+	assert.Nil(t, err)
+	assert.Equal(t, Capacity{Total: 5000, Free: 2600}, c)
+	for _, d := range multi.Disks() {
+		assert.True(t, d.Capacity.Free >= 800 && d.Capacity.Free <= 900, "%v has %v free", d.Name, d.Capacity.Free)
+	}
+}
+
+func TestStoreTiers(t *testing.T) {
+	hot, cold := NewMemoryBackend(), NewMemoryBackend()
+	store := newStore(t, StoreOpts{
+		Backend:         hot,
+		ColdBackend:     cold,
+		ColdCompression: CompressionFlate,
+		Lifecycle:       []LifecycleRule{{Prefix: "artifacts/", ColdAfter: 24 * time.Hour}},
+	})
+	logs := bytes.Repeat([]byte("build step ok\n"), 1000)
+	random := randomData(1, 4096)
+	for key, data := range map[string][]byte{"artifacts/logs": logs, "artifacts/random": random, "docs/readme": logs} {
+		_, err := store.Write("id", key, bytes.NewReader(data))
+		assert.Nil(t, err)
+	}
+	// the rules match the key, a replica has no name
+	_, err := store.WriteMeta("peer", "artifacts/replica", Metadata{}, bytes.NewReader(logs))
+	assert.Nil(t, err)
+
+	report, err := store.ApplyLifecycle(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.Objects)
+	report, err = store.ApplyLifecycle(time.Now().Add(48 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Objects)
+	assert.Equal(t, int64(2*len(logs)+len(random)), report.Bytes)
+	assert.True(t, report.Stored < int64(len(random))+int64(len(logs))/5)
+
+	meta, err := store.Stat("id", "artifacts/logs")
+	assert.Nil(t, err)
+	assert.Equal(t, TierCold, meta.Tier)
+	assert.Equal(t, CompressionFlate, meta.Compression)
+	assert.Equal(t, int64(len(logs)), meta.Size)
+	// incompressible data is moved as it is
+	meta, err = store.Stat("id", "artifacts/random")
+	assert.Nil(t, err)
+	assert.Equal(t, TierCold, meta.Tier)
+	assert.Empty(t, meta.Compression)
+	paths, _ := cold.List("")
+	assert.Equal(t, 3, len(paths))
+	paths, _ = hot.List("")
+	assert.Equal(t, 1, len(paths))
+	scrubbed, err := store.Scrub(0, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, scrubbed.Corrupt)
+
+	// a peek, e.g. for a proof, leaves the object cold, the
+	// compressed content is streamed and seeks by skipping
+	f, err := store.Peek("id", "artifacts/logs")
+	assert.Nil(t, err)
+	buf := make([]byte, 14)
+	for _, offset := range []int64{14 * 500, 14 * 2, 14 * 999} {
+		_, err := f.Seek(offset, io.SeekStart)
+		assert.Nil(t, err)
+		_, err = io.ReadFull(f, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "build step ok\n", string(buf))
+	}
+	_, err = f.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, f.Close())
+	r, err := store.PeekRange("id", "artifacts/logs", 14*10, 28)
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, logs[:28], data)
+	meta, err = store.Stat("id", "artifacts/logs")
+	assert.Nil(t, err)
+	assert.Equal(t, TierCold, meta.Tier)
+
+	// reading an object brings it back to the hot tier
+	rr, err := store.Read("id", "artifacts/logs")
+	assert.Nil(t, err)
+	data, _ = io.ReadAll(rr)
+	assert.Equal(t, logs, data)
+	meta, err = store.Stat("id", "artifacts/logs")
+	assert.Nil(t, err)
+	assert.Empty(t, meta.Tier)
+	assert.Empty(t, meta.Compression)
+	paths, _ = cold.List("")
+	assert.Equal(t, 2, len(paths))
+
+	assert.Nil(t, store.Delete("id", "artifacts/random"))
+	assert.Nil(t, store.Delete("peer", "artifacts/replica"))
+	paths, _ = cold.List("")
+	assert.Empty(t, paths)
+}
+
+func TestStoreCompression(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := newStore(t, StoreOpts{Backend: backend, Compression: CompressionGzip})
+	logs := bytes.Repeat([]byte(`{"level":"info","msg":"request served"}`+"\n"), 5000)
+	random := randomData(1, 100<<10)
+	n, err := store.Write("id", "logs", bytes.NewReader(logs))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(logs)), n)
+	_, err = store.Write("id", "random", bytes.NewReader(random))
+	assert.Nil(t, err)
+	_, err = store.WriteMeta("id", "flate", Metadata{Name: "flate", Compression: CompressionFlate}, bytes.NewReader(logs))
+	assert.Nil(t, err)
+
+	meta, err := store.Stat("id", "logs")
+	assert.Nil(t, err)
+	assert.Equal(t, CompressionGzip, meta.Compression)
+	assert.Equal(t, int64(len(logs)), meta.Size)
+	info, err := backend.Stat(store.objectPath("id", "logs"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size, meta.StoredSize)
+	assert.True(t, info.Size < int64(len(logs))/10)
+	meta, err = store.Stat("id", "flate")
+	assert.Nil(t, err)
+	assert.Equal(t, CompressionFlate, meta.Compression)
+	// incompressible data is stored as it is
+	meta, err = store.Stat("id", "random")
+	assert.Nil(t, err)
+	assert.Empty(t, meta.Compression)
+	info, err = backend.Stat(store.objectPath("id", "random"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(random)), info.Size)
+	assert.True(t, WorthCompressing(100, 90))
+	assert.False(t, WorthCompressing(100, 91))
+
+	for key, want := range map[string][]byte{"logs": logs, "flate": logs, "random": random} {
+		r, err := store.Read("id", key)
+		assert.Nil(t, err)
+		data, _ := io.ReadAll(r)
+		assert.Equal(t, want, data, key)
+	}
+	r, err := store.ReadRange("id", "logs", 40, 39)
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, logs[40:79], data)
+	stats := store.CompressionStats()
+	assert.Equal(t, 2, stats.Objects)
+	assert.True(t, stats.Ratio() > 10)
+	scrubbed, err := store.Scrub(0, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, scrubbed.Corrupt)
+
+	_, err = store.WriteMeta("id", "bad", Metadata{Name: "bad", Compression: "zstd"}, bytes.NewReader(logs))
+	assert.ErrorIs(t, err, ErrUnknownCompression)
+	assert.False(t, store.Has("id", "bad"))
+}
+
+func TestStoreVersions(t *testing.T) {
+	store := newStore(t, StoreOpts{Backend: NewMemoryBackend(), Dedup: true})
+	store.SetVersioning("docs", true)
+	meta := Metadata{Name: "report", Namespace: "docs"}
+	for _, content := range []string{"v1", "v2", "v3"} {
+		_, err := store.WriteMeta("id", "report", meta, strings.NewReader(content))
+		assert.Nil(t, err)
+	}
+	_, err := store.Write("id", "plain", strings.NewReader("v1"))
+	assert.Nil(t, err)
+	_, err = store.Write("id", "plain", strings.NewReader("v2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(store.Versions("id", "plain")))
+
+	versions := store.Versions("id", "report")
+	assert.Equal(t, 3, len(versions))
+	assert.True(t, versions[0].Archived.IsZero())
+	assert.False(t, versions[1].Archived.IsZero())
+	read := func(versionId string) string {
+		f, err := store.OpenVersion("id", "report", versionId)
+		assert.Nil(t, err)
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		return string(data)
+	}
+	assert.Equal(t, "v3", read(versions[0].VersionId))
+	assert.Equal(t, "v1", read(versions[2].VersionId))
+	// the older versions are not listed and do not expire with the object
+	names, _, _ := store.List("id", "", "", 0)
+	assert.Equal(t, []string{"plain", "report"}, names)
+	assert.Equal(t, 4, store.Usage("id").Objects)
+
+	// a delete leaves a marker and keeps the object
+	assert.Nil(t, store.Delete("id", "report"))
+	assert.False(t, store.Has("id", "report"))
+	versions = store.Versions("id", "report")
+	assert.Equal(t, 4, len(versions))
+	assert.True(t, versions[0].DeleteMarker)
+	_, err = store.OpenVersion("id", "report", versions[0].VersionId)
+	assert.ErrorIs(t, err, ErrDeleteMarker)
+	assert.Equal(t, "v3", read(versions[1].VersionId))
+	scrubbed, err := store.Scrub(0, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, scrubbed.Corrupt)
+	missing, err := store.Missing()
+	assert.Nil(t, err)
+	assert.Empty(t, missing)
+
+	pruned, err := store.PruneVersions("id", "report", 2, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(pruned))
+	versions = store.Versions("id", "report")
+	assert.Equal(t, 2, len(versions))
+	assert.Equal(t, "v3", read(versions[1].VersionId))
+	pruned, err = store.PruneVersions("id", "report", 0, time.Nanosecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(pruned))
+	assert.Empty(t, store.Versions("id", "report"))
+	assert.Equal(t, 1, store.DedupStats().Objects)
+}
+
+func TestStoreTrash(t *testing.T) {
+	store := newStore(t, StoreOpts{Backend: NewMemoryBackend(), TrashRetention: time.Hour})
+	for _, key := range []string{"logs/a", "logs/b", "keep"} {
+		_, err := store.Write("id", key, strings.NewReader("data of "+key))
+		assert.Nil(t, err)
+	}
+	_, err := store.WriteMeta("id", "chunk", Metadata{}, strings.NewReader("chunk"))
+	assert.Nil(t, err)
+	for _, key := range []string{"logs/a", "logs/b", "chunk"} {
+		assert.Nil(t, store.Delete("id", key))
+	}
+	assert.False(t, store.Has("id", "logs/a"))
+	names, _, _ := store.List("id", "", "", 0)
+	assert.Equal(t, []string{"keep"}, names)
+	// the objects without a name are not kept
+	trash := store.Trash("id")
+	assert.Equal(t, 2, len(trash))
+	assert.Equal(t, "logs/a", trash[0].Name)
+	assert.False(t, trash[0].Deleted.IsZero())
+	f, err := store.OpenTrash("id", "logs/b")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(f)
+	assert.Equal(t, "data of logs/b", string(data))
+
+	assert.Nil(t, store.Undelete("id", "logs/a"))
+	r, err := store.Read("id", "logs/a")
+	assert.Nil(t, err)
+	data, _ = io.ReadAll(r)
+	assert.Equal(t, "data of logs/a", string(data))
+	meta, err := store.Stat("id", "logs/a")
+	assert.Nil(t, err)
+	assert.True(t, meta.Deleted.IsZero())
+	_, err = store.Write("id", "logs/b", strings.NewReader("new"))
+	assert.Nil(t, err)
+	assert.ErrorIs(t, store.Undelete("id", "logs/b"), ErrKeyExists)
+	assert.ErrorIs(t, store.Undelete("id", "keep"), ErrNotFound)
+
+	purged, err := store.PurgeTrash(time.Now())
+	assert.Nil(t, err)
+	assert.Empty(t, purged)
+	purged, err = store.PurgeTrash(time.Now().Add(2 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(purged))
+	assert.Empty(t, store.Trash("id"))
+}
+
+func randomData(seed uint64, n int) []byte {
+	r := rand.New(rand.NewPCG(seed, seed))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	return data
+}
+
+func TestChunker(t *testing.T) {
+	data := randomData(1, 1<<20)
+	opts := ChunkerOpts{MinSize: 2048, AvgSize: 8192, MaxSize: 65536}
+
+	split := func(data []byte) []string {
+		chunks := []string{}
+		c := NewChunker(bytes.NewReader(data), opts)
+		joined := []byte{}
+		for {
+			chunk, err := c.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			assert.LessOrEqual(t, len(chunk), opts.MaxSize)
+			joined = append(joined, chunk...)
+			chunks = append(chunks, string(chunk))
+		}
+		assert.Equal(t, data, joined)
+		return chunks
+	}
+	chunks := split(data)
+	assert.Greater(t, len(chunks), 50)
+
+	// an insertion only changes the chunks around it
+	edited := slices.Concat(data[:1000], []byte("inserted"), data[1000:])
+	shared := 0
+	for _, c := range split(edited) {
+		if slices.Contains(chunks, c) {
+			shared++
+		}
+	}
+	assert.GreaterOrEqual(t, shared, len(chunks)-2)
+}
+
+func TestStoreDedup(t *testing.T) {
+	data := randomData(2, 1<<20)
+	edited := slices.Concat(data[:5000], []byte("nightly"), data[5000:])
+
+	root := t.TempDir()
+	for name, backend := range map[string]Backend{
+		"fs":     NewFSBackend(root),
+		"memory": NewMemoryBackend(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t, StoreOpts{TransformPathFunc: SHA1PathTransformFunc, Backend: backend, Dedup: true})
+			_, err := store.Write("id", "dump1", bytes.NewReader(data))
+			assert.Nil(t, err)
+			_, err = store.Write("id", "dump2", bytes.NewReader(edited))
+			assert.Nil(t, err)
+
+			stats := store.DedupStats()
+			assert.Equal(t, 2, stats.Objects)
+			assert.Equal(t, int64(2*len(data)+7), stats.LogicalSize)
+			assert.Greater(t, stats.Ratio(), 1.9)
+
+			r, err := store.Read("id", "dump2")
+			assert.Nil(t, err)
+			b, _ := io.ReadAll(r)
+			assert.Equal(t, edited, b)
+			rr, err := store.ReadRange("id", "dump1", 100000, 50000)
+			assert.Nil(t, err)
+			b, _ = io.ReadAll(rr)
+			rr.Close()
+			assert.Equal(t, data[100000:150000], b)
+			meta, err := store.Stat("id", "dump1")
+			assert.Nil(t, err)
+			assert.Equal(t, int64(len(data)), meta.Size)
+
+			// the chunks left are only the ones of dump2
+			assert.Nil(t, store.Delete("id", "dump1"))
+			assert.Equal(t, int64(len(edited)), store.DedupStats().StoredSize)
+			r, err = store.Read("id", "dump2")
+			assert.Nil(t, err)
+			b, _ = io.ReadAll(r)
+			assert.Equal(t, edited, b)
+
+			// overwriting releases the chunks of the old content
+			_, err = store.Write("id", "dump2", strings.NewReader("small"))
+			assert.Nil(t, err)
+			assert.Equal(t, 1, store.DedupStats().Chunks)
+			assert.Nil(t, store.Delete("id", "dump2"))
+			assert.Equal(t, DedupStats{}, store.DedupStats())
+			chunks, err := backend.List(chunksDirName + "/")
+			assert.Nil(t, err)
+			assert.Empty(t, chunks)
+		})
+	}
+}
+
+func TestStoreDedupReopen(t *testing.T) {
+	root := t.TempDir()
+	store := newStore(t, StoreOpts{Root: root, Dedup: true})
+	_, err := store.Write("id", "a", strings.NewReader(strings.Repeat("abc", 10000)))
+	assert.Nil(t, err)
+	_, err = store.Write("id", "b", strings.NewReader(strings.Repeat("abc", 10000)))
+	assert.Nil(t, err)
+	stats := store.DedupStats()
+	// a chunk left behind by an interrupted write
+	_, err = store.Backend.Put(chunkPath(strings.Repeat("0", 64)), strings.NewReader("orphan"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+
+	store = newStore(t, StoreOpts{Root: root, Dedup: true})
+	defer store.Close()
+	assert.Equal(t, stats, store.DedupStats())
+	_, err = store.Backend.Stat(chunkPath(strings.Repeat("0", 64)))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Nil(t, store.Delete("id", "a"))
+	r, err := store.Read("id", "b")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, strings.Repeat("abc", 10000), string(b))
+
+	// a chunk rotten in place is caught on read, not only its size
+	chunks, err := store.Backend.List(chunksDirName + "/")
+	assert.Nil(t, err)
+	info, err := store.Backend.Stat(chunks[0])
+	assert.Nil(t, err)
+	_, err = store.Backend.Put(chunks[0], strings.NewReader(strings.Repeat("x", int(info.Size))))
+	assert.Nil(t, err)
+	_, err = store.Read("id", "b")
+	assert.ErrorContains(t, err, "corrupted chunk")
+}
+
+func TestStoreScrub(t *testing.T) {
+	store := newStore(t, StoreOpts{Backend: NewMemoryBackend()})
+	data := randomData(3, 100<<10)
+	_, err := store.Write("id", "good", bytes.NewReader(data))
+	assert.Nil(t, err)
+	_, err = store.Write("id", "rotten", bytes.NewReader(data))
+	assert.Nil(t, err)
+	// flip a byte behind the back of the store
+	rotten := slices.Clone(data)
+	rotten[1000] ^= 1
+	_, err = store.Backend.Put(store.objectPath("id", "rotten"), bytes.NewReader(rotten))
+	assert.Nil(t, err)
+
+	report, err := store.Scrub(1<<20, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Objects)
+	assert.Equal(t, int64(2*len(data)), report.Bytes)
+	// 200KB at 1MB per second
+	assert.GreaterOrEqual(t, report.Finished.Sub(report.Started), 150*time.Millisecond)
+	assert.Equal(t, 1, len(report.Corrupt))
+	assert.Equal(t, "rotten", report.Corrupt[0].Key)
+	assert.False(t, store.Has("id", "rotten"))
+	assert.True(t, store.Has("id", "good"))
+	quarantined, err := store.Quarantined()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{".quarantine/id/rotten/rotten"}, quarantined)
+
+	stop := make(chan struct{})
+	close(stop)
+	_, err = store.Scrub(0, stop)
+	assert.ErrorIs(t, err, ErrScrubStopped)
+}
+
+func TestStoreScrubDedup(t *testing.T) {
+	store := newStore(t, StoreOpts{Backend: NewMemoryBackend(), Dedup: true})
+	data := randomData(4, 100<<10)
+	_, err := store.Write("id", "first", bytes.NewReader(data))
+	assert.Nil(t, err)
+	_, err = store.Write("id", "second", bytes.NewReader(data))
+	assert.Nil(t, err)
+	chunks, err := store.Backend.List(chunksDirName + "/")
+	assert.Nil(t, err)
+	_, err = store.Backend.Put(chunks[0], strings.NewReader("rot"))
+	assert.Nil(t, err)
+
+	// both objects share the corrupt chunk
+	report, err := store.Scrub(0, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(report.Corrupt))
+	assert.Equal(t, DedupStats{}, store.DedupStats())
+
+	// the chunk is written again with the next object containing it
+	_, err = store.Write("id", "first", bytes.NewReader(data))
+	assert.Nil(t, err)
+	r, err := store.Read("id", "first")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, data, b)
+	report, err = store.Scrub(0, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Corrupt)
+}
+
+func TestStoreExpiry(t *testing.T) {
+	store := newStore(t, StoreOpts{Backend: NewMemoryBackend()})
+	past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+	_, err := store.WriteMeta("id", "old", Metadata{Name: "old", Expires: &past}, strings.NewReader("data"))
+	assert.Nil(t, err)
+	_, err = store.WriteMeta("id", "fresh", Metadata{Name: "fresh", Expires: &future}, strings.NewReader("data"))
+	assert.Nil(t, err)
+	// the objects that never expire do not carry it in the index
+	record, err := json.Marshal(Metadata{Name: "forever"})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(record), "Expires")
+
+	assert.False(t, store.Has("id", "old"))
+	_, err = store.Stat("id", "old")
+	assert.ErrorIs(t, err, ErrExpired)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.True(t, store.Has("id", "fresh"))
+	names, _, err := store.List("id", "", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fresh"}, names)
+
+	expired := store.Expired(time.Now())
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, "old", expired[0].Key)
+	assert.Nil(t, store.Delete("id", "old"))
+	assert.Empty(t, store.Expired(time.Now()))
+	assert.Equal(t, 1, len(store.Expired(time.Now().Add(2*time.Hour))))
+}
+
+func TestStoreQuota(t *testing.T) {
+	store := newStore(t, StoreOpts{Backend: NewMemoryBackend(), OwnerQuota: Quota{Bytes: 10}})
+	_, err := store.Write("id", "a", strings.NewReader("123456"))
+	assert.Nil(t, err)
+	_, err = store.Write("id", "b", strings.NewReader("123456"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.False(t, store.Has("id", "b"))
+	assert.ErrorIs(t, store.CheckQuota("id", "b", "", 5), ErrQuotaExceeded)
+	assert.Nil(t, store.CheckQuota("id", "b", "", 4))
+	// the replaced object does not count
+	assert.Nil(t, store.CheckQuota("id", "a", "", 10))
+	_, err = store.Write("id", "a", strings.NewReader("1234567890"))
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Bytes: 10, Objects: 1}, store.Usage("id"))
+	// other owners have their own quota
+	_, err = store.Write("other", "b", strings.NewReader("123456"))
+	assert.Nil(t, err)
+
+	store.SetQuota("id", Quota{Objects: 1})
+	_, err = store.Write("id", "b", strings.NewReader("1"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	// namespaces are shared by the owners
+	store.SetNamespaceQuota("logs", Quota{Objects: 2})
+	for _, id := range []string{"other", "third"} {
+		_, err = store.WriteMeta(id, "log", Metadata{Name: "log", Namespace: "logs"}, strings.NewReader("x"))
+		assert.Nil(t, err)
+	}
+	_, err = store.WriteMeta("fourth", "log", Metadata{Name: "log", Namespace: "logs"}, strings.NewReader("x"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Equal(t, Usage{Bytes: 2, Objects: 2}, store.NamespaceUsage("logs"))
+}
+
+func TestStoreQuotaConcurrent(t *testing.T) {
+	store := newStore(t, StoreOpts{Backend: NewMemoryBackend(), OwnerQuota: Quota{Bytes: 10}})
+	// both writes pass the first check before either is read
+	start := make(chan struct{})
+	errs := make(chan error, 2)
+	for _, key := range []string{"a", "b"} {
+		go func() {
+			_, err := store.Write("id", key, &gatedReader{r: strings.NewReader("123456"), start: start})
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(start)
+	failed := 0
+	for range 2 {
+		if err := <-errs; err != nil {
+			assert.ErrorIs(t, err, ErrQuotaExceeded)
+			failed++
+		}
+	}
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, Usage{Bytes: 6, Objects: 1}, store.Usage("id"))
+	// nothing is left reserved
+	assert.Nil(t, store.CheckQuota("id", "c", "", 4))
+}
+
+// gatedReader blocks the reads of r until start is closed
+type gatedReader struct {
+	r     io.Reader
+	start chan struct{}
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	<-g.start
+	return g.r.Read(p)
+}
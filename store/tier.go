@@ -0,0 +1,184 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TierCold is the Tier of the objects moved to the ColdBackend,
+// the objects in the Backend have an empty Tier
+const TierCold = "cold"
+
+// accessResolution is how stale Accessed gets before a read updates
+// it, so that reading an object does not always write the index
+const accessResolution = time.Hour
+
+var ErrNoColdTier = errors.New("store has no cold tier")
+
+// LifecycleRule moves the objects whose key starts with Prefix to the
+// cold tier once they were not read for ColdAfter. The key is the one
+// made by BucketKey for the objects of a bucket, and the replicas are
+// only matched by an empty Prefix as their keys are hashes.
+type LifecycleRule struct {
+	Prefix    string
+	ColdAfter time.Duration
+}
+
+// LifecycleReport is the outcome of ApplyLifecycle
+type LifecycleReport struct {
+	// Objects is the number of objects moved to the cold tier
+	Objects int
+	// Bytes is their size and Stored what they take in the cold tier
+	Bytes  int64
+	Stored int64
+}
+
+// rule returns the first rule of the store matching meta
+func (s *Store) rule(meta Metadata) (LifecycleRule, bool) {
+	for _, r := range s.Lifecycle {
+		if strings.HasPrefix(meta.Key, r.Prefix) {
+			return r, true
+		}
+	}
+	return LifecycleRule{}, false
+}
+
+// ApplyLifecycle moves to the cold tier the objects that were not
+// read for the ColdAfter of their rule at now, compressed with
+// ColdCompression when it makes them smaller.
+func (s *Store) ApplyLifecycle(now time.Time) (LifecycleReport, error) {
+	report := LifecycleReport{}
+	if s.ColdBackend == nil {
+		return report, ErrNoColdTier
+	}
+	entries := s.index.All()
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		meta := entries[p]
+		rule, ok := s.rule(meta)
+		if !ok || meta.Tier == TierCold || meta.DeleteMarker || now.Sub(lastAccess(meta)) < rule.ColdAfter {
+			continue
+		}
+		stored, err := s.freeze(p, meta)
+		if err != nil {
+			return report, fmt.Errorf("failed to move %v to the cold tier: %w", p, err)
+		}
+		report.Objects++
+		report.Bytes += meta.Size
+		report.Stored += stored
+	}
+	return report, nil
+}
+
+func lastAccess(meta Metadata) time.Time {
+	if meta.Accessed.IsZero() {
+		return meta.Modified
+	}
+	return meta.Accessed
+}
+
+// freeze moves the object at p to the cold tier and returns its size there
+func (s *Store) freeze(p string, meta Metadata) (int64, error) {
+	f, err := s.open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// incompressible data is kept as it is
+	r, alg, err := compressReader(s.ColdCompression, f)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := s.ColdBackend.Put(p, r)
+	if err != nil {
+		return n, err
+	}
+	meta.Compression, meta.StoredSize = alg, 0
+	if len(alg) > 0 {
+		meta.StoredSize = n
+	}
+
+	var chunks []chunkRef
+	if meta.Deduplicated {
+		if rec, err := s.readRecipe(p); err == nil {
+			chunks = rec.Chunks
+		}
+	}
+	meta.Tier, meta.Deduplicated = TierCold, false
+	if err := s.index.Put(p, meta); err != nil {
+		return n, err
+	}
+	if err := s.Backend.Delete(p); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("store (%v) failed to delete %v from the hot tier: %v\n", s.Root, p, err)
+	}
+	return n, s.release(chunks)
+}
+
+// thaw moves the object at p back from the cold tier,
+// compressed with the Compression of the Store
+func (s *Store) thaw(p string, meta Metadata) error {
+	f, err := s.openCold(p, meta)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stored, alg, err := s.putCompressed(p, "", f)
+	if err != nil {
+		return err
+	}
+	meta.Tier, meta.Compression, meta.StoredSize, meta.Deduplicated = "", alg, 0, s.Dedup
+	if len(alg) > 0 {
+		meta.StoredSize = stored
+	}
+	meta.Accessed = time.Now()
+	if err := s.index.Put(p, meta); err != nil {
+		return err
+	}
+	if err := s.ColdBackend.Delete(p); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("store (%v) failed to delete %v from the cold tier: %v\n", s.Root, p, err)
+	}
+	return nil
+}
+
+// openCold returns the content of the object at p in the cold tier
+func (s *Store) openCold(p string, meta Metadata) (io.ReadSeekCloser, error) {
+	if s.ColdBackend == nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoColdTier, p)
+	}
+	f, err := s.ColdBackend.Get(p)
+	if err != nil || len(meta.Compression) == 0 {
+		return f, err
+	}
+	return decompressStream(meta.Compression, meta.Size, f, func() (io.ReadCloser, error) {
+		return s.ColdBackend.Get(p)
+	}), nil
+}
+
+// access records a read of the object at p and brings it back
+// to the hot tier when it was cold
+func (s *Store) access(p string) {
+	meta, ok := s.index.Get(p)
+	if !ok {
+		return
+	}
+	if meta.Tier == TierCold {
+		if err := s.thaw(p, meta); err != nil {
+			log.Printf("store (%v) failed to move %v back from the cold tier: %v\n", s.Root, p, err)
+		}
+		return
+	}
+	if now := time.Now(); now.Sub(meta.Accessed) >= accessResolution {
+		meta.Accessed = now
+		s.index.Put(p, meta)
+	}
+}
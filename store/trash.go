@@ -0,0 +1,115 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trashDirName is where the deleted objects are kept until they are
+// purged, at their path in the store, see hiddenPath
+const trashDirName = ".trash"
+
+var ErrKeyExists = errors.New("key exists")
+
+func trashPath(p string) string {
+	return path.Join(trashDirName, p)
+}
+
+// Trashed reports if deleting the object meta moves it to the trash,
+// the objects without a name like the chunks are deleted at once
+func (s *Store) Trashed(meta Metadata) bool {
+	return s.TrashRetention > 0 && (len(meta.Name) > 0 || len(meta.SealedName) > 0)
+}
+
+// trash moves the object at p to the trash, replacing
+// what is there from an earlier delete of the same key
+func (s *Store) trash(p string, meta Metadata) error {
+	tp := trashPath(p)
+	if _, ok := s.index.Get(tp); ok {
+		if err := s.remove(tp); err != nil {
+			return err
+		}
+	}
+	meta.Deleted = time.Now()
+	if err := s.move(p, tp, meta); err != nil {
+		return fmt.Errorf("failed to move %v to the trash: %w", meta.Key, err)
+	}
+	return nil
+}
+
+// move renames the object at p to dst and indexes it with meta, it
+// keeps its tier, compression and deduplicated chunks
+func (s *Store) move(p, dst string, meta Metadata) error {
+	backend := s.Backend
+	if meta.Tier == TierCold && s.ColdBackend != nil {
+		backend = s.ColdBackend
+	}
+	if err := rename(backend, p, dst); err != nil {
+		return err
+	}
+	if err := s.index.Put(dst, meta); err != nil {
+		return err
+	}
+	return s.index.Delete(p)
+}
+
+// Trash returns the deleted objects of id kept in the trash, sorted by
+// name, Deleted is when they were deleted
+func (s *Store) Trash(id string) []Metadata {
+	trash := []Metadata{}
+	for p, meta := range s.index.All() {
+		if meta.Id == id && strings.HasPrefix(p, trashDirName+"/") {
+			trash = append(trash, meta)
+		}
+	}
+	sort.Slice(trash, func(i, j int) bool {
+		return trash[i].Name < trash[j].Name
+	})
+	return trash
+}
+
+// OpenTrash returns a seekable handle on the deleted key in the trash
+func (s *Store) OpenTrash(id, key string) (io.ReadSeekCloser, error) {
+	tp := trashPath(s.objectPath(id, key))
+	if _, ok := s.index.Get(tp); !ok {
+		return nil, fmt.Errorf("%w: %v in the trash", ErrNotFound, key)
+	}
+	return s.open(tp)
+}
+
+// Undelete moves the deleted key back from the trash,
+// it fails with ErrKeyExists when key was written since
+func (s *Store) Undelete(id, key string) error {
+	p := s.objectPath(id, key)
+	tp := trashPath(p)
+	meta, ok := s.index.Get(tp)
+	if !ok {
+		return fmt.Errorf("%w: %v in the trash", ErrNotFound, key)
+	}
+	if _, ok := s.index.Get(p); ok {
+		return fmt.Errorf("%w: %v", ErrKeyExists, key)
+	}
+	meta.Deleted = time.Time{}
+	return s.move(tp, p, meta)
+}
+
+// PurgeTrash deletes for good the objects deleted more than
+// TrashRetention before now and returns them
+func (s *Store) PurgeTrash(now time.Time) ([]Metadata, error) {
+	purged := []Metadata{}
+	for p, meta := range s.index.All() {
+		if !strings.HasPrefix(p, trashDirName+"/") || now.Sub(meta.Deleted) < s.TrashRetention {
+			continue
+		}
+		if err := s.remove(p); err != nil {
+			return purged, err
+		}
+		purged = append(purged, meta)
+	}
+	return purged, nil
+}
@@ -0,0 +1,290 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// versionsDirName is where the older versions of the objects are
+// kept, under the path of the current object, see hiddenPath
+const versionsDirName = ".versions"
+
+var ErrDeleteMarker = errors.New("version is a delete marker")
+
+// versioning holds the namespaces whose objects keep their versions
+type versioning struct {
+	mu         sync.RWMutex
+	namespaces map[string]bool
+	// last is the last version id given, they must increase
+	last int64
+}
+
+// SetVersioning turns the versioning of the namespace ns on or off.
+// A write in a versioned namespace keeps the object it replaces as
+// an older version and a delete leaves a delete marker.
+func (s *Store) SetVersioning(ns string, on bool) {
+	s.versioning.mu.Lock()
+	defer s.versioning.mu.Unlock()
+	if s.versioning.namespaces == nil {
+		s.versioning.namespaces = make(map[string]bool)
+	}
+	s.versioning.namespaces[ns] = on
+}
+
+// Versioning reports if the namespace ns is versioned
+func (s *Store) Versioning(ns string) bool {
+	s.versioning.mu.RLock()
+	defer s.versioning.mu.RUnlock()
+	return s.versioning.namespaces[ns]
+}
+
+// newVersionId returns a version id sorting after all the
+// ones given before, even within the same nanosecond
+func (s *Store) newVersionId() string {
+	s.versioning.mu.Lock()
+	defer s.versioning.mu.Unlock()
+	now := time.Now().UnixNano()
+	if now <= s.versioning.last {
+		now = s.versioning.last + 1
+	}
+	s.versioning.last = now
+	return fmt.Sprintf("%016x", now)
+}
+
+// versioned reports if the object meta keeps its versions, the ones
+// written with a version id, e.g. replicas of a versioned object, do
+func (s *Store) versioned(meta Metadata) bool {
+	return len(meta.VersionId) > 0 || s.Versioning(meta.Namespace)
+}
+
+func versionPath(p, versionId string) string {
+	return path.Join(versionsDirName, p, versionId)
+}
+
+// writeCurrent writes r as the current object at p like write, after
+// keeping the object it replaces as a version when meta is versioned
+func (s *Store) writeCurrent(p, id, key string, meta Metadata, r io.Reader) (int64, error) {
+	if len(meta.VersionId) == 0 && s.Versioning(meta.Namespace) {
+		meta.VersionId = s.newVersionId()
+	}
+	archived := ""
+	if old, ok := s.index.Get(p); ok && len(meta.VersionId) > 0 && old.VersionId != meta.VersionId {
+		var err error
+		if archived, err = s.archive(p, old); err != nil {
+			return 0, fmt.Errorf("failed to keep the version of %v: %w", key, err)
+		}
+	}
+	meta.Archived = time.Time{}
+	n, err := s.write(p, id, key, meta, r)
+	if err != nil && len(archived) > 0 {
+		// the object was not replaced
+		s.remove(archived)
+	}
+	return n, err
+}
+
+// archive copies the current object at p described by meta to its
+// versions and returns where. An object written before its namespace
+// was versioned gets a version id then.
+func (s *Store) archive(p string, meta Metadata) (string, error) {
+	if len(meta.VersionId) == 0 {
+		meta.VersionId = s.newVersionId()
+	}
+	vp := versionPath(p, meta.VersionId)
+	meta.Archived = time.Now()
+	return vp, s.copyObject(p, vp, meta)
+}
+
+// copyObject copies the content at p to dst and indexes it with meta
+func (s *Store) copyObject(p, dst string, meta Metadata) error {
+	f, err := s.open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stored, alg, err := s.putCompressed(dst, meta.Compression, f)
+	if err != nil {
+		return err
+	}
+	meta.Compression, meta.StoredSize = alg, 0
+	if len(alg) > 0 {
+		meta.StoredSize = stored
+	}
+	meta.Tier, meta.Deduplicated = "", s.Dedup
+	return s.index.Put(dst, meta)
+}
+
+// deleteMarkerSuffix follows the version id of a deleted object in the
+// id of its delete marker, so that every node holding the object gives
+// the marker the same id, sorting right after the deleted version
+const deleteMarkerSuffix = "-deleted"
+
+// deleteCurrent removes the versioned object at p and leaves a delete
+// marker as its latest version, the object itself is kept as a version
+func (s *Store) deleteCurrent(p string, meta Metadata) error {
+	vp, err := s.archive(p, meta)
+	if err != nil {
+		return fmt.Errorf("failed to keep the version of %v: %w", meta.Key, err)
+	}
+	if err := s.remove(p); err != nil {
+		return err
+	}
+	now := time.Now()
+	marker := Metadata{
+		Id:           meta.Id,
+		Key:          meta.Key,
+		Name:         meta.Name,
+		SealedName:   meta.SealedName,
+		Namespace:    meta.Namespace,
+		Bucket:       meta.Bucket,
+		VersionId:    path.Base(vp) + deleteMarkerSuffix,
+		DeleteMarker: true,
+		Created:      now,
+		Modified:     now,
+		Archived:     now,
+	}
+	return s.index.Put(versionPath(p, marker.VersionId), marker)
+}
+
+// Discard removes key without keeping a version of it, e.g.
+// a corrupt copy about to be fetched again from the peers
+func (s *Store) Discard(id, key string) error {
+	return s.remove(s.objectPath(id, key))
+}
+
+// Versions returns the versions of key, newest first: the current
+// object if there is one, then the older versions and delete markers.
+// Archived is zero only on the current object.
+func (s *Store) Versions(id, key string) []Metadata {
+	p := s.objectPath(id, key)
+	versions := []Metadata{}
+	prefix := path.Join(versionsDirName, p) + "/"
+	for vp, meta := range s.index.All() {
+		if strings.HasPrefix(vp, prefix) {
+			versions = append(versions, meta)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].VersionId > versions[j].VersionId
+	})
+	if meta, ok := s.index.Get(p); ok {
+		versions = append([]Metadata{meta}, versions...)
+	}
+	return versions
+}
+
+// versionAt returns where the version versionId of key is kept
+func (s *Store) versionAt(id, key, versionId string) (string, Metadata, error) {
+	p := s.objectPath(id, key)
+	if meta, ok := s.index.Get(p); ok && meta.VersionId == versionId && len(versionId) > 0 {
+		return p, meta, nil
+	}
+	vp := versionPath(p, versionId)
+	if meta, ok := s.index.Get(vp); ok && len(versionId) > 0 {
+		return vp, meta, nil
+	}
+	return "", Metadata{}, fmt.Errorf("%w: version %v of %v", ErrNotFound, versionId, key)
+}
+
+// StatVersion returns the metadata of the version versionId of key
+func (s *Store) StatVersion(id, key, versionId string) (Metadata, error) {
+	_, meta, err := s.versionAt(id, key, versionId)
+	return meta, err
+}
+
+// OpenVersion returns a seekable handle on the version versionId
+// of key, ErrDeleteMarker when the version is a delete marker
+func (s *Store) OpenVersion(id, key, versionId string) (io.ReadSeekCloser, error) {
+	p, meta, err := s.versionAt(id, key, versionId)
+	if err != nil {
+		return nil, err
+	}
+	if meta.DeleteMarker {
+		return nil, fmt.Errorf("%w: %v of %v", ErrDeleteMarker, versionId, key)
+	}
+	s.access(p)
+	return s.open(p)
+}
+
+// PeekVersion is OpenVersion leaving the tier of the version
+// as it is, see Peek
+func (s *Store) PeekVersion(id, key, versionId string) (io.ReadSeekCloser, error) {
+	p, meta, err := s.versionAt(id, key, versionId)
+	if err != nil {
+		return nil, err
+	}
+	if meta.DeleteMarker {
+		return nil, fmt.Errorf("%w: %v of %v", ErrDeleteMarker, versionId, key)
+	}
+	return s.open(p)
+}
+
+// WriteVersion writes r as the older version of key described by
+// meta, e.g. when it is fetched back from a peer
+func (s *Store) WriteVersion(id, key string, meta Metadata, r io.Reader) (int64, error) {
+	if len(meta.VersionId) == 0 || meta.Archived.IsZero() {
+		return 0, fmt.Errorf("%w: %v is not an older version", ErrNotFound, key)
+	}
+	return s.write(versionPath(s.objectPath(id, key), meta.VersionId), id, key, meta, r)
+}
+
+// DeleteVersion deletes the older version versionId of key,
+// the current object is deleted with Delete
+func (s *Store) DeleteVersion(id, key, versionId string) error {
+	if len(versionId) == 0 {
+		return fmt.Errorf("%w: version of %v", ErrNotFound, key)
+	}
+	vp := versionPath(s.objectPath(id, key), versionId)
+	if _, ok := s.index.Get(vp); !ok {
+		return fmt.Errorf("%w: version %v of %v", ErrNotFound, versionId, key)
+	}
+	return s.remove(vp)
+}
+
+// PruneVersions deletes the older versions of key past the keep
+// newest ones, or archived more than maxAge ago. Zero keep or
+// maxAge do not limit. It returns the versions deleted.
+func (s *Store) PruneVersions(id, key string, keep int, maxAge time.Duration) ([]Metadata, error) {
+	pruned := []Metadata{}
+	for _, meta := range s.PrunableVersions(id, key, keep, maxAge, time.Now()) {
+		if err := s.DeleteVersion(id, key, meta.VersionId); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, meta)
+	}
+	return pruned, nil
+}
+
+// PrunableVersions returns the versions PruneVersions deletes at now
+func (s *Store) PrunableVersions(id, key string, keep int, maxAge time.Duration, now time.Time) []Metadata {
+	prunable := []Metadata{}
+	older := 0
+	for _, meta := range s.Versions(id, key) {
+		if meta.Archived.IsZero() {
+			continue
+		}
+		older++
+		if (keep > 0 && older > keep) || (maxAge > 0 && now.Sub(meta.Archived) > maxAge) {
+			prunable = append(prunable, meta)
+		}
+	}
+	return prunable
+}
+
+// OlderVersions returns the older versions of the objects of id,
+// delete markers included
+func (s *Store) OlderVersions(id string) []Metadata {
+	versions := []Metadata{}
+	for p, meta := range s.index.All() {
+		if meta.Id == id && strings.HasPrefix(p, versionsDirName+"/") {
+			versions = append(versions, meta)
+		}
+	}
+	return versions
+}